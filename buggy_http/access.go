@@ -0,0 +1,211 @@
+package buggy_http
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// accessRule allows or denies the clients in network. If all is true it matches every client,
+// if unix is true the clients on Unix domain sockets, that have no address.
+type accessRule struct {
+	allow   bool
+	all     bool
+	unix    bool
+	network netip.Prefix
+}
+
+func (r accessRule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	return action + " " + r.networkString()
+}
+
+func (r accessRule) networkString() string {
+	switch {
+	case r.all:
+		return "all"
+	case r.unix:
+		return "unix"
+	}
+	return r.network.String()
+}
+
+// matches reports whether the client with address addr is in the network of the rule,
+// addr is not valid for the clients on Unix domain sockets.
+func (r accessRule) matches(addr netip.Addr) bool {
+	if r.all {
+		return true
+	}
+	if !addr.IsValid() {
+		return r.unix
+	}
+	return !r.unix && r.network.Contains(addr.Unmap().WithZone(""))
+}
+
+// pathAccess checks the access rules on the clients of the requests under prefix.
+type pathAccess struct {
+	prefix string
+	rules  []accessRule
+}
+
+// parseAccessRules parses rules in the form "allow NETWORK" or "deny NETWORK", see parseNetwork.
+func parseAccessRules(rules []string) ([]accessRule, error) {
+	parsed := make([]accessRule, 0, len(rules))
+	for _, text := range rules {
+		action, network, _ := strings.Cut(strings.TrimSpace(text), " ")
+		if action != "allow" && action != "deny" {
+			return nil, fmt.Errorf("rule %q must start with allow or deny", text)
+		}
+
+		r, err := parseNetwork(strings.TrimSpace(network))
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", text, err)
+		}
+		r.allow = action == "allow"
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// parseNetwork returns a rule that matches network: an IPv4 or IPv6 CIDR, a single address,
+// "unix" for the clients on Unix domain sockets or "all".
+func parseNetwork(network string) (accessRule, error) {
+	switch network {
+	case "all":
+		return accessRule{all: true}, nil
+	case "unix":
+		return accessRule{unix: true}, nil
+	}
+
+	if strings.Contains(network, "/") {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return accessRule{}, fmt.Errorf("invalid CIDR %q", network)
+		}
+		return accessRule{network: prefix.Masked()}, nil
+	}
+
+	addr, err := netip.ParseAddr(network)
+	if err != nil || addr.Zone() != "" {
+		return accessRule{}, fmt.Errorf("invalid address %q", network)
+	}
+	return accessRule{network: netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
+
+// accessAllowed reports whether the first rule that matches addr allows it.
+// A client that matches no rule is allowed, so lists usually end with "deny all".
+func accessAllowed(rules []accessRule, addr netip.Addr) bool {
+	for _, r := range rules {
+		if r.matches(addr) {
+			return r.allow
+		}
+	}
+	return true
+}
+
+// addrIP returns the IP address of a TCP address, or the zero address
+// for the Unix domain sockets.
+func addrIP(addr net.Addr) netip.Addr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap()
+	}
+	if addr == nil {
+		return netip.Addr{}
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort.Addr().Unmap()
+}
+
+// isTrustedProxy reports whether the client with address addr is one of the trusted proxies.
+func isTrustedProxy(addr netip.Addr, config *buggyConfig) bool {
+	for _, r := range config.trustedProxies {
+		if r.matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendsProxyHeader reports whether the connection from addr starts with a PROXY protocol header.
+func sendsProxyHeader(addr net.Addr, config *buggyConfig) bool {
+	return config.proxyProtocol && isTrustedProxy(addrIP(addr), config)
+}
+
+// acceptAllowed reports whether the access rules allow the client of a connection from addr.
+func acceptAllowed(addr net.Addr, config *buggyConfig) bool {
+	return accessAllowed(config.access, addrIP(addr))
+}
+
+// clientAddr returns the address of the client of request, the zero address for the clients
+// on Unix domain sockets. If the connection is from a trusted proxy, it is the last address of
+// X-Forwarded-For that is not a trusted proxy, the ones before it could have been written by the client.
+func clientAddr(request *request, config *buggyConfig) netip.Addr {
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(request.remoteAddr); err == nil {
+		addr = addrPort.Addr().Unmap()
+	}
+	if !isTrustedProxy(addr, config) {
+		return addr
+	}
+
+	var forwarded []string
+	for _, value := range request.headers["x-forwarded-for"] {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// The addresses before a malformed one cannot be trusted, the last proxy is the client.
+			break
+		}
+		addr = ip.Unmap()
+		if !isTrustedProxy(addr, config) {
+			break
+		}
+	}
+	return addr
+}
+
+// findPathAccess returns the path access rules with the longest prefix that matches the path of request, or nil.
+func findPathAccess(request *request, config *buggyConfig) *pathAccess {
+	if len(config.pathAccess) == 0 {
+		return nil
+	}
+
+	var found *pathAccess
+	for _, pa := range config.pathAccess {
+		for _, p := range requestPaths(request) {
+			if hasPathPrefix(p, pa.prefix) && (found == nil || len(pa.prefix) > len(found.prefix)) {
+				found = pa
+			}
+		}
+	}
+	return found
+}
+
+// checkPathAccess answers with 403 code the requests under a path prefix whose client is denied by its rules.
+// It returns nil if the request can be served.
+func checkPathAccess(request *request, config *buggyConfig) (*response, error) {
+	pa := findPathAccess(request, config)
+	if pa == nil {
+		return nil, nil
+	}
+
+	addr := clientAddr(request, config)
+	if accessAllowed(pa.rules, addr) {
+		return nil, nil
+	}
+	return r403(), fmt.Errorf("checkPathAccess() -> %s, %s: client %s is denied under %s. 403 sent", request.method, request.path, describeClient(addr), pa.prefix)
+}
+
+func describeClient(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unix"
+	}
+	return addr.String()
+}
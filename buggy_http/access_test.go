@@ -0,0 +1,236 @@
+package buggy_http
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessRules(t *testing.T) {
+	t.Run("Valid rules", func(t *testing.T) {
+		rules, err := parseAccessRules([]string{"allow 10.0.0.0/8", " deny 192.168.1.7 ", "allow fd00::/8", "deny 10.1.2.3/16", "allow unix", "deny all"})
+		assert.NoError(t, err)
+		texts := make([]string, 0, len(rules))
+		for _, r := range rules {
+			texts = append(texts, r.String())
+		}
+		assert.Equal(t, []string{"allow 10.0.0.0/8", "deny 192.168.1.7/32", "allow fd00::/8", "deny 10.1.0.0/16", "allow unix", "deny all"}, texts)
+	})
+
+	t.Run("Invalid rules", func(t *testing.T) {
+		for _, rule := range []string{
+			"permit 10.0.0.0/8",
+			"allow",
+			"deny 10.0.0.0/33",
+			"deny 10.0.0.256",
+			"allow fe80::1%eth0",
+			"allow example.com",
+		} {
+			_, err := parseAccessRules([]string{rule})
+			assert.Error(t, err, rule)
+		}
+	})
+}
+
+func TestAccessAllowed(t *testing.T) {
+	rules, err := parseAccessRules([]string{"deny 10.1.2.3", "allow 10.0.0.0/8", "allow 2001:db8::/32", "allow unix", "deny all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]bool{
+		"10.9.8.7":           true,
+		"10.1.2.3":           false,
+		"192.168.1.1":        false,
+		"::ffff:10.9.8.7":    true,
+		"::ffff:10.1.2.3":    false,
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+		"fe80::1%eth0":       false,
+		"2001:db8::1%eth0":   true,
+		"::ffff:192.168.1.1": false,
+	}
+	for addr, want := range allowed {
+		assert.Equal(t, want, accessAllowed(rules, netip.MustParseAddr(addr)), addr)
+	}
+
+	t.Run("Unix clients", func(t *testing.T) {
+		assert.True(t, accessAllowed(rules, netip.Addr{}))
+		assert.False(t, accessAllowed(rules[4:], netip.Addr{}))
+		assert.True(t, accessAllowed(nil, netip.Addr{}))
+
+		onlyAll, _ := parseAccessRules([]string{"allow 0.0.0.0/0", "allow ::/0", "deny all"})
+		assert.False(t, accessAllowed(onlyAll, netip.Addr{}))
+	})
+
+	t.Run("No rule matches", func(t *testing.T) {
+		assert.True(t, accessAllowed(rules[:1], netip.MustParseAddr("192.168.1.1")))
+	})
+
+	t.Run("Connection addresses", func(t *testing.T) {
+		assert.Equal(t, netip.MustParseAddr("10.9.8.7"), addrIP(&net.TCPAddr{IP: net.ParseIP("10.9.8.7"), Port: 80}))
+		assert.Equal(t, netip.MustParseAddr("2001:db8::1"), addrIP(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}))
+		assert.False(t, addrIP(&net.UnixAddr{Name: "/run/bs.sock", Net: "unix"}).IsValid())
+		assert.False(t, addrIP(nil).IsValid())
+	})
+}
+
+func TestClientAddr(t *testing.T) {
+	bs := NewBuggyServer().(*buggyInstance)
+	assert.NoError(t, bs.SetTrustedProxies([]string{"10.0.0.1", "10.0.1.0/24"}, false))
+
+	client := func(remoteAddr string, forwarded ...string) string {
+		r := &request{remoteAddr: remoteAddr, headers: map[string][]string{}}
+		if len(forwarded) > 0 {
+			r.headers["x-forwarded-for"] = forwarded
+		}
+		return describeClient(clientAddr(r, bs.config))
+	}
+
+	assert.Equal(t, "192.0.2.1", client("192.0.2.1:5000"))
+	assert.Equal(t, "192.0.2.1", client("192.0.2.1:5000", "198.51.100.1"), "the header of untrusted clients is ignored")
+	assert.Equal(t, "10.0.0.1", client("10.0.0.1:5000"))
+	assert.Equal(t, "198.51.100.1", client("10.0.0.1:5000", "198.51.100.1"))
+	assert.Equal(t, "198.51.100.1", client("10.0.0.1:5000", "203.0.113.9, 198.51.100.1, 10.0.1.5"), "the addresses written by the client are skipped")
+	assert.Equal(t, "198.51.100.1", client("10.0.0.1:5000", "203.0.113.9", "198.51.100.1"))
+	assert.Equal(t, "10.0.1.5", client("10.0.0.1:5000", "198.51.100.1, not-an-ip, 10.0.1.5"), "a malformed address stops the walk")
+	assert.Equal(t, "2001:db8::1", client("[::ffff:10.0.0.1]:5000", "2001:db8::1"))
+	assert.Equal(t, "unix", client("pipe", "198.51.100.1"))
+}
+
+func TestPathAccess(t *testing.T) {
+	bs := newTestInstance(t)
+	os.MkdirAll(filepath.Join(bs.config.baseDir, "admin", "public"), 0755)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "admin", "panel.txt"), []byte("panel"), 0644)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "admin", "public", "logo.txt"), []byte("logo"), 0644)
+	assert.NoError(t, bs.SetPathAccessRules("/admin", []string{"allow 10.0.0.0/8", "deny all"}))
+	assert.NoError(t, bs.SetPathAccessRules("/admin/public/", []string{"allow all"}))
+	assert.NoError(t, bs.SetTrustedProxies([]string{"10.0.0.1"}, false))
+
+	get := func(remoteAddr string, path string, headers map[string][]string) *response {
+		if headers == nil {
+			headers = map[string][]string{}
+		}
+		r, _ := generateResponse(&request{method: "GET", path: path, proto: "HTTP/1.1", headers: headers, remoteAddr: remoteAddr}, bs.config)
+		return r
+	}
+
+	t.Run("Allowed clients", func(t *testing.T) {
+		assert.Equal(t, 200, get("10.2.3.4:5000", "/admin/panel.txt", nil).code)
+		assert.Equal(t, 200, get("192.0.2.1:5000", "/index.html", nil).code)
+		assert.Equal(t, 200, get("192.0.2.1:5000", "/admin/public/logo.txt", nil).code, "the longest prefix wins")
+	})
+
+	t.Run("Denied clients", func(t *testing.T) {
+		for _, path := range []string{"/admin/panel.txt", "/admin", "/%61dmin/panel.txt", "/index.html/../admin/panel.txt", "/index.html?/../admin/panel.txt"} {
+			assert.Equal(t, 403, get("192.0.2.1:5000", path, nil).code, path)
+		}
+		assert.Equal(t, 403, get("pipe", "/admin/panel.txt", nil).code)
+	})
+
+	t.Run("Forwarded clients", func(t *testing.T) {
+		assert.Equal(t, 403, get("10.0.0.1:5000", "/admin/panel.txt", map[string][]string{"x-forwarded-for": {"192.0.2.1"}}).code)
+		assert.Equal(t, 200, get("10.0.0.1:5000", "/admin/panel.txt", map[string][]string{"x-forwarded-for": {"10.2.3.4"}}).code)
+		assert.Equal(t, 403, get("192.0.2.1:5000", "/admin/panel.txt", map[string][]string{"x-forwarded-for": {"10.2.3.4"}}).code)
+	})
+
+	t.Run("Checked before basic auth", func(t *testing.T) {
+		assert.NoError(t, bs.SetBasicAuth("/admin", writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), ""))
+		defer func() { bs.config.auth = nil }()
+
+		assert.Equal(t, 403, get("192.0.2.1:5000", "/admin/panel.txt", nil).code)
+		assert.Equal(t, 401, get("10.2.3.4:5000", "/admin/panel.txt", nil).code)
+	})
+}
+
+func TestAcceptAccess(t *testing.T) {
+	// dial returns what the server sends on a new connection before closing it.
+	dial := func(addr string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+
+	t.Run("Denied clients are closed", func(t *testing.T) {
+		var logs lockedBuffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		bs := newTestInstance(t)
+		assert.NoError(t, bs.SetAccessRules([]string{"allow 10.0.0.0/8", "deny 127.0.0.0/8", "allow all"}))
+		addr := startTestServer(t, bs)
+
+		assert.Empty(t, dial(addr))
+		assert.Contains(t, logs.String(), "error: listenForConn(): 127.0.0.1:")
+		assert.Contains(t, logs.String(), "denied by the access rules, connection closed")
+	})
+
+	t.Run("Allowed clients are served", func(t *testing.T) {
+		bs := newTestInstance(t)
+		assert.NoError(t, bs.SetAccessRules([]string{"allow 127.0.0.1", "deny all"}))
+		addr := startTestServer(t, bs)
+
+		assert.True(t, strings.HasPrefix(dial(addr), "HTTP/1.1 200 OK\r\n"))
+	})
+}
+
+func TestSetAccessRules(t *testing.T) {
+	t.Run("Valid rules", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.NoError(t, bs.SetAccessRules([]string{"allow 10.0.0.0/8", "deny all"}))
+		assert.Len(t, bs.config.access, 2)
+		assert.NoError(t, bs.SetAccessRules(nil))
+		assert.Empty(t, bs.config.access)
+	})
+
+	t.Run("Same prefix replaces the rules", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.NoError(t, bs.SetPathAccessRules("/admin/", []string{"deny all"}))
+		assert.NoError(t, bs.SetPathAccessRules("/admin", []string{"allow 10.0.0.0/8", "deny all"}))
+		assert.Len(t, bs.config.pathAccess, 1)
+		assert.Equal(t, "/admin", bs.config.pathAccess[0].prefix)
+		assert.Len(t, bs.config.pathAccess[0].rules, 2)
+	})
+
+	t.Run("Trusted proxies", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.NoError(t, bs.SetTrustedProxies([]string{"10.0.0.1", "fd00::/8", "unix"}, true))
+		assert.Len(t, bs.config.trustedProxies, 3)
+		assert.True(t, bs.config.proxyProtocol)
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.ErrorContains(t, bs.SetAccessRules([]string{"allow 10.0.0.0/8", "deny everyone"}), `SetAccessRules(): rule "deny everyone": invalid address "everyone"`)
+		assert.ErrorContains(t, bs.SetPathAccessRules("admin", []string{"deny all"}), "must start with /")
+		assert.ErrorContains(t, bs.SetPathAccessRules("/admin", []string{"block all"}), "must start with allow or deny")
+		assert.ErrorContains(t, bs.SetTrustedProxies([]string{"proxy.local"}, false), "SetTrustedProxies(): invalid address")
+		assert.ErrorContains(t, bs.SetTrustedProxies(nil, true), "requires at least one trusted proxy")
+		assert.Empty(t, bs.config.access)
+		assert.Empty(t, bs.config.pathAccess)
+		assert.Empty(t, bs.config.trustedProxies)
+	})
+
+	t.Run("After start", func(t *testing.T) {
+		bs := newTestInstance(t)
+		startTestServer(t, bs)
+		assert.EqualError(t, bs.SetAccessRules([]string{"deny all"}), "SetAccessRules(): BuggyServer has already been started, you can no longer change its configuration")
+		assert.EqualError(t, bs.SetPathAccessRules("/admin", []string{"deny all"}), "SetPathAccessRules(): BuggyServer has already been started, you can no longer change its configuration")
+		assert.EqualError(t, bs.SetTrustedProxies([]string{"10.0.0.1"}, false), "SetTrustedProxies(): BuggyServer has already been started, you can no longer change its configuration")
+	})
+}
@@ -0,0 +1,147 @@
+package buggy_http
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultRealm is the realm of the basic auth prefixes set without one.
+const defaultRealm = "BuggyServer"
+
+// authRoute requires the credentials of a user of an htpasswd file for the paths under prefix.
+// See https://www.rfc-editor.org/rfc/rfc7617
+type authRoute struct {
+	prefix string
+	realm  string
+	file   string
+	users  htpasswd
+
+	// The hash checked for the unknown users, so that they take as long as the known ones.
+	decoy string
+}
+
+func newAuthRoute(prefix string, file string, realm string, users htpasswd) *authRoute {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	route := &authRoute{prefix: prefix, realm: realm, file: file, users: users}
+	if len(names) > 0 {
+		route.decoy = users[names[0]]
+	}
+	return route
+}
+
+// findAuthRoute returns the route with the longest prefix that matches the path of request, or nil.
+// The path is decoded and cleaned first, so that "/%70rivate" or "/public/../private" match "/private".
+func findAuthRoute(request *request, config *buggyConfig) *authRoute {
+	if len(config.auth) == 0 {
+		return nil
+	}
+
+	var found *authRoute
+	for _, route := range config.auth {
+		for _, p := range requestPaths(request) {
+			if hasPathPrefix(p, route.prefix) && (found == nil || len(route.prefix) > len(found.prefix)) {
+				found = route
+			}
+		}
+	}
+	return found
+}
+
+// requestPaths returns the decoded and cleaned paths of request that are matched against the
+// prefixes of basic auth and of the access rules. Static files are looked up with the whole target,
+// query included, so both the path without the query and the whole target are returned.
+func requestPaths(request *request) []string {
+	clean := func(rawPath string) string {
+		p, err := url.PathUnescape(rawPath)
+		if err != nil {
+			p = rawPath
+		}
+		return path.Clean("/" + p)
+	}
+
+	rawPath, _, _ := strings.Cut(request.path, "?")
+	return []string{clean(rawPath), clean(request.path)}
+}
+
+// authorize checks the credentials of a request under a basic auth prefix, and sets request.user
+// to the authenticated user. It returns a 401 response if they are missing or wrong, or nil if the
+// request can be served. Passwords are compared in constant time, and the unknown users are checked
+// against a decoy hash, so that the response time does not tell whether a user exists.
+func authorize(request *request, config *buggyConfig) (*response, error) {
+	route := findAuthRoute(request, config)
+	if route == nil {
+		return nil, nil
+	}
+
+	user, password, ok := basicCredentials(request.headers)
+	if !ok {
+		return r401(route.realm), fmt.Errorf("authorize() -> %s, %s: no credentials for %s. 401 sent", request.method, request.path, route.prefix)
+	}
+
+	hash, known := route.users[user]
+	if !known {
+		hash = route.decoy
+	}
+	if !verifyPassword(hash, password) || !known {
+		return r401(route.realm), fmt.Errorf("authorize() -> %s, %s: wrong credentials for user %q. 401 sent", request.method, request.path, user)
+	}
+
+	request.user = user
+	return nil, nil
+}
+
+// basicCredentials returns the user and password of the Basic authorization header of a request.
+func basicCredentials(headers map[string][]string) (string, string, bool) {
+	values, ok := headers["authorization"]
+	if !ok || len(values) != 1 {
+		return "", "", false
+	}
+
+	scheme, token, ok := strings.Cut(strings.TrimSpace(values[0]), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// checkRealm returns an error if realm cannot be sent as a quoted string.
+func checkRealm(realm string) error {
+	for _, c := range realm {
+		if c == '"' || c == '\\' || c < ' ' || c == 0x7f {
+			return fmt.Errorf("realm %q cannot contain quotes, backslashes or control characters", realm)
+		}
+	}
+	return nil
+}
+
+func r401(realm string) *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":             {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":           {"BuggyServer"},
+		"www-authenticate": {fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm)},
+		"content-length":   {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         401,
+		reasonPhrase: "Unauthorized",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
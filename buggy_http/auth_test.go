@@ -0,0 +1,172 @@
+package buggy_http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer collects the log of the connections served in a test.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+func writeHtpasswd(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func basicAuthHeader(user, password string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+}
+
+func TestBasicAuth(t *testing.T) {
+	bs := newTestInstance(t)
+	os.MkdirAll(filepath.Join(bs.config.baseDir, "private", "admin"), 0755)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "private", "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "private", "admin", "panel.txt"), []byte("panel"), 0644)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "public.txt"), []byte("public"), 0644)
+
+	users := writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW\n")
+	admins := writeHtpasswd(t, "root:$5$abcdefgh$gruCpC7VkOTspMQTTSAR8mtlO9Upms.fwqE5y16JVM.\n")
+	assert.NoError(t, bs.SetBasicAuth("/private", users, ""))
+	assert.NoError(t, bs.SetBasicAuth("/private/admin/", admins, "Admin area"))
+
+	get := func(path string, headers string) string {
+		return roundTrip(t, bs, "GET "+path+" HTTP/1.1\r\nConnection: close\r\n"+headers+"\r\n")
+	}
+
+	t.Run("Unprotected paths", func(t *testing.T) {
+		out := get("/public.txt", "")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(out, "public"))
+		assert.True(t, strings.HasPrefix(get("/privateer", ""), "HTTP/1.1 404 Not Found\r\n"))
+	})
+
+	t.Run("Missing credentials", func(t *testing.T) {
+		out := get("/private/secret.txt", "")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+		assert.Contains(t, out, "www-authenticate: Basic realm=\"BuggyServer\", charset=\"UTF-8\"\r\n")
+		assert.NotContains(t, out, "secret\r\n")
+	})
+
+	t.Run("Valid credentials", func(t *testing.T) {
+		out := get("/private/secret.txt", basicAuthHeader("alice", "secret"))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.True(t, strings.HasSuffix(out, "secret"))
+
+		out = get("/private/secret.txt", basicAuthHeader("bob", "secret"))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	})
+
+	t.Run("Wrong credentials", func(t *testing.T) {
+		for _, header := range []string{
+			basicAuthHeader("alice", "wrong"),
+			basicAuthHeader("carol", "secret"),
+			basicAuthHeader("alice", ""),
+			"Authorization: Basic not-base64\r\n",
+			"Authorization: Bearer " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n",
+		} {
+			out := get("/private/secret.txt", header)
+			assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"), header)
+		}
+	})
+
+	t.Run("The longest prefix wins", func(t *testing.T) {
+		out := get("/private/admin/panel.txt", basicAuthHeader("alice", "secret"))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+		assert.Contains(t, out, "www-authenticate: Basic realm=\"Admin area\", charset=\"UTF-8\"\r\n")
+
+		out = get("/private/admin/panel.txt", basicAuthHeader("root", "secret"))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	})
+
+	t.Run("Encoded paths are protected", func(t *testing.T) {
+		for _, path := range []string{
+			"/%70rivate/secret.txt",
+			"/public.txt/../private/secret.txt",
+			"//private/secret.txt",
+			"/./private/secret.txt",
+			"/public.txt?/../private/secret.txt",
+		} {
+			assert.True(t, strings.HasPrefix(get(path, ""), "HTTP/1.1 401 Unauthorized\r\n"), path)
+		}
+	})
+
+	t.Run("HEAD has the challenge", func(t *testing.T) {
+		out := roundTrip(t, bs, "HEAD /private/secret.txt HTTP/1.1\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+		assert.Contains(t, out, "www-authenticate: Basic")
+	})
+
+	t.Run("The access log has the user", func(t *testing.T) {
+		var logs lockedBuffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		get("/private/secret.txt", basicAuthHeader("alice", "secret"))
+		get("/public.txt", basicAuthHeader("alice", "secret"))
+
+		assert.Contains(t, logs.String(), "[ alice@pipe, GET, /private/secret.txt : 200 ]")
+		assert.Contains(t, logs.String(), "[ pipe, GET, /public.txt : 200 ]")
+	})
+}
+
+func TestSetBasicAuth(t *testing.T) {
+	users := writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	t.Run("Valid prefix", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.NoError(t, bs.SetBasicAuth("/private/", users, ""))
+		assert.Len(t, bs.config.auth, 1)
+		assert.Equal(t, "/private", bs.config.auth[0].prefix)
+		assert.Equal(t, "BuggyServer", bs.config.auth[0].realm)
+	})
+
+	t.Run("Same prefix replaces the file", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.NoError(t, bs.SetBasicAuth("/private", users, ""))
+		assert.NoError(t, bs.SetBasicAuth("/private", writeHtpasswd(t, ""), "Other"))
+		assert.Len(t, bs.config.auth, 1)
+		assert.Empty(t, bs.config.auth[0].users)
+		assert.Equal(t, "Other", bs.config.auth[0].realm)
+	})
+
+	t.Run("Invalid settings", func(t *testing.T) {
+		bs := NewBuggyServer().(*buggyInstance)
+		assert.ErrorContains(t, bs.SetBasicAuth("private", users, ""), "must start with /")
+		assert.ErrorContains(t, bs.SetBasicAuth("/private", users, `My "realm"`), "cannot contain quotes")
+		assert.Error(t, bs.SetBasicAuth("/private", filepath.Join(t.TempDir(), "missing"), ""))
+		assert.Empty(t, bs.config.auth)
+	})
+
+	t.Run("After start", func(t *testing.T) {
+		bs := newTestInstance(t)
+		startTestServer(t, bs)
+		err := bs.SetBasicAuth("/private", users, "")
+		assert.EqualError(t, err, "SetBasicAuth(): BuggyServer has already been started, you can no longer change its configuration")
+	})
+}
@@ -0,0 +1,270 @@
+package buggy_http
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies to choose the backend that receives a proxied request.
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceIPHash     = "ip-hash"
+)
+
+// ringReplicas is the number of points every backend has on the consistent hash ring,
+// more points spread the clients more evenly.
+const ringReplicas = 100
+
+// backend is one of the upstream servers of a proxyRoute.
+type backend struct {
+	upstream *url.URL
+
+	// host:port to dial to reach upstream.
+	addr string
+
+	mu sync.Mutex
+
+	// The number of requests that are being forwarded to the backend.
+	active int
+
+	// The number of consecutive failed requests.
+	fails int
+
+	// If true the backend has been ejected after consecutive failures,
+	// and it does not receive requests until downUntil.
+	down      bool
+	downUntil time.Time
+
+	// If true the backend has failed the last active health check.
+	unhealthy bool
+}
+
+func newBackend(upstream *url.URL) *backend {
+	return &backend{upstream: upstream, addr: upstreamAddr(upstream)}
+}
+
+// available reports whether the backend can receive requests.
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.unhealthy && (!b.down || now.After(b.downUntil))
+}
+
+// begin records that a request is being forwarded to the backend.
+func (b *backend) begin() {
+	b.mu.Lock()
+	b.active++
+	b.mu.Unlock()
+}
+
+// end records the outcome of a request forwarded to the backend.
+// After maxFails consecutive failures the backend is ejected for failTimeout,
+// zero or negative maxFails means backends are never ejected.
+func (b *backend) end(ok bool, maxFails int, failTimeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active--
+	if ok {
+		b.fails = 0
+		b.down = false
+		return
+	}
+
+	b.fails++
+	if maxFails > 0 && b.fails >= maxFails {
+		if !b.down {
+			log.Printf("error: backend %s ejected after %d consecutive failures", b.upstream, b.fails)
+		}
+		b.down = true
+		b.downUntil = time.Now().Add(failTimeout)
+	}
+}
+
+// setHealth records the outcome of an active health check.
+// A backend that fails it does not receive requests until it passes one.
+func (b *backend) setHealth(healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if healthy {
+		if b.unhealthy || b.down {
+			log.Printf("backend %s is healthy again", b.upstream)
+		}
+		b.fails = 0
+		b.down = false
+		b.unhealthy = false
+		return
+	}
+
+	if !b.unhealthy {
+		log.Printf("error: backend %s failed the health check", b.upstream)
+	}
+	b.unhealthy = true
+}
+
+func (b *backend) activeRequests() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// ringPoint is a point of a backend on the consistent hash ring.
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// newHashRing places every backend on a consistent hash ring, so that when a backend
+// is removed only the clients that were mapped to it are moved to other backends.
+func newHashRing(backends []*backend) []ringPoint {
+	ring := make([]ringPoint, 0, len(backends)*ringReplicas)
+	for _, b := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(b.upstream.String() + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// pickBackend chooses a backend of route that is not in tried, according to strategy.
+// Ejected backends are skipped, unless all the backends are ejected.
+// It returns nil when every backend has already been tried.
+func pickBackend(route *proxyRoute, strategy string, clientIP string, tried map[*backend]bool) *backend {
+	now := time.Now()
+
+	candidates := make([]*backend, 0, len(route.backends))
+	for _, b := range route.backends {
+		if !tried[b] && b.available(now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, b := range route.backends {
+			if !tried[b] {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch strategy {
+	case balanceLeastConn:
+		// Ties are broken in round-robin order.
+		start := int(atomic.AddUint64(&route.next, 1) - 1)
+		var best *backend
+		bestActive := 0
+		for i := range candidates {
+			b := candidates[(start+i)%len(candidates)]
+			if active := b.activeRequests(); best == nil || active < bestActive {
+				best, bestActive = b, active
+			}
+		}
+		return best
+
+	case balanceIPHash:
+		allowed := make(map[*backend]bool, len(candidates))
+		for _, b := range candidates {
+			allowed[b] = true
+		}
+		h := hashKey(clientIP)
+		i := sort.Search(len(route.ring), func(i int) bool { return route.ring[i].hash >= h })
+		for j := 0; j < len(route.ring); j++ {
+			point := route.ring[(i+j)%len(route.ring)]
+			if allowed[point.backend] {
+				return point.backend
+			}
+		}
+		return candidates[0]
+
+	default:
+		n := atomic.AddUint64(&route.next, 1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+// checkHealth sends a GET request for path to every backend, those that do not
+// answer with a 2xx or 3xx code are ejected until they pass a following check.
+func checkHealth(proxies []*proxyRoute, path string, timeout time.Duration) {
+	for _, route := range proxies {
+		for _, b := range route.backends {
+			b.setHealth(probeBackend(b, path, timeout) == nil)
+		}
+	}
+}
+
+// probeBackend sends a health check request to b on a new connection.
+func probeBackend(b *backend, path string, timeout time.Duration) error {
+	uc, err := dialUpstream(b.addr, timeout)
+	if err != nil {
+		return fmt.Errorf("probeBackend(): %w", err)
+	}
+	defer uc.conn.Close()
+
+	req := &request{
+		method: "GET",
+		path:   path,
+		proto:  "HTTP/1.1",
+		headers: map[string][]string{
+			"host":       {b.upstream.Host},
+			"connection": {"close"},
+			"user-agent": {"BuggyServer health check"},
+		},
+	}
+
+	r, _, err := exchange(uc, req, timeout)
+	if err != nil {
+		return fmt.Errorf("probeBackend(): %w", err)
+	}
+	if r.code < 200 || r.code >= 400 {
+		return fmt.Errorf("probeBackend(): %s answered with %d", b.upstream, r.code)
+	}
+	return nil
+}
+
+// runHealthChecks checks the health of the backends every interval, until quit is closed.
+func runHealthChecks(config *buggyConfig, quit chan struct{}) {
+	timeout := config.proxyTimeout
+	if timeout <= 0 || timeout > config.healthCheckInterval {
+		timeout = config.healthCheckInterval
+	}
+
+	ticker := time.NewTicker(config.healthCheckInterval)
+	defer ticker.Stop()
+
+	checkHealth(config.proxies, config.healthCheckPath, timeout)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			checkHealth(config.proxies, config.healthCheckPath, timeout)
+		}
+	}
+}
+
+// clientIP returns the IP address of remoteAddr, or remoteAddr if it has no port.
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,176 @@
+package buggy_http
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// namedUpstream starts a fake upstream that answers every request with its name.
+func namedUpstream(t *testing.T, name string) *fakeUpstream {
+	return startFakeUpstream(t, func(req *request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n" + name
+	})
+}
+
+// closedAddr returns the address of a port where nothing is listening.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func testBackends(n int) *proxyRoute {
+	urls := make([]*url.URL, 0, n)
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(3000+i))
+		urls = append(urls, u)
+	}
+	return newProxyRoute("/", urls)
+}
+
+func TestPickBackend(t *testing.T) {
+	t.Run("Round-robin", func(t *testing.T) {
+		route := testBackends(3)
+		var picked []*backend
+		for i := 0; i < 6; i++ {
+			picked = append(picked, pickBackend(route, balanceRoundRobin, "", nil))
+		}
+		assert.Equal(t, route.backends, picked[:3])
+		assert.Equal(t, route.backends, picked[3:])
+	})
+
+	t.Run("Least connections", func(t *testing.T) {
+		route := testBackends(3)
+		route.backends[0].begin()
+		route.backends[1].begin()
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, route.backends[2], pickBackend(route, balanceLeastConn, "", nil))
+		}
+	})
+
+	t.Run("Consistent hash by client IP", func(t *testing.T) {
+		route := testBackends(3)
+		first := pickBackend(route, balanceIPHash, "192.0.2.1", nil)
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, first, pickBackend(route, balanceIPHash, "192.0.2.1", nil))
+		}
+
+		// Only the clients of an ejected backend are moved.
+		var other *backend
+		for _, b := range route.backends {
+			if b != first {
+				other = b
+				break
+			}
+		}
+		other.setHealth(false)
+		assert.Equal(t, first, pickBackend(route, balanceIPHash, "192.0.2.1", nil))
+	})
+
+	t.Run("Tried and ejected backends are skipped", func(t *testing.T) {
+		route := testBackends(3)
+		route.backends[0].setHealth(false)
+		tried := map[*backend]bool{route.backends[1]: true}
+		assert.Equal(t, route.backends[2], pickBackend(route, balanceRoundRobin, "", tried))
+
+		tried[route.backends[2]] = true
+		assert.Equal(t, route.backends[0], pickBackend(route, balanceRoundRobin, "", tried))
+
+		tried[route.backends[0]] = true
+		assert.Nil(t, pickBackend(route, balanceRoundRobin, "", tried))
+	})
+}
+
+func TestPassiveEjection(t *testing.T) {
+	route := testBackends(1)
+	b := route.backends[0]
+
+	b.begin()
+	b.end(false, 2, time.Hour)
+	assert.True(t, b.available(time.Now()))
+
+	b.begin()
+	b.end(false, 2, time.Hour)
+	assert.False(t, b.available(time.Now()))
+	assert.True(t, b.available(time.Now().Add(2*time.Hour)))
+
+	b.begin()
+	b.end(true, 2, time.Hour)
+	assert.True(t, b.available(time.Now()))
+}
+
+func TestReplyToProxyRetry(t *testing.T) {
+	alive := namedUpstream(t, "a")
+	dead := closedAddr(t)
+
+	t.Run("GET is retried on another backend", func(t *testing.T) {
+		config := newProxyConfig(t, "/", "http://"+dead, "http://"+alive.addr)
+		config.balance = balanceRoundRobin
+		for i := 0; i < 4; i++ {
+			r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			assert.NoError(t, err)
+			assert.Equal(t, "a", string(r.body))
+		}
+	})
+
+	t.Run("POST is not retried", func(t *testing.T) {
+		config := newProxyConfig(t, "/", "http://"+dead, "http://"+alive.addr)
+		config.balance = balanceRoundRobin
+
+		codes := map[int]int{}
+		for i := 0; i < 2; i++ {
+			r, _ := reply(&request{method: "POST", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			codes[r.code]++
+		}
+		assert.Equal(t, map[int]int{200: 1, 502: 1}, codes)
+	})
+
+	t.Run("Failed backends are ejected", func(t *testing.T) {
+		config := newProxyConfig(t, "/", "http://"+dead, "http://"+alive.addr)
+		config.maxFails = 1
+		config.failTimeout = time.Hour
+
+		reply(&request{method: "POST", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		reply(&request{method: "POST", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		for i := 0; i < 4; i++ {
+			r, err := reply(&request{method: "POST", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, r.code)
+		}
+	})
+}
+
+func TestCheckHealth(t *testing.T) {
+	healthy := startFakeUpstream(t, func(req *request) string {
+		if req.path == "/healthz" {
+			return "HTTP/1.1 204 No Content\r\n\r\n"
+		}
+		return "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+	})
+	failing := startFakeUpstream(t, func(req *request) string {
+		return "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"
+	})
+
+	config := newProxyConfig(t, "/", "http://"+healthy.addr, "http://"+failing.addr, "http://"+closedAddr(t))
+	checkHealth(config.proxies, "/healthz", time.Second)
+
+	backends := config.proxies[0].backends
+	now := time.Now()
+	assert.True(t, backends[0].available(now))
+	assert.False(t, backends[1].available(now))
+	assert.False(t, backends[2].available(now))
+	assert.Equal(t, "/healthz", healthy.lastRequest().path)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, backends[0], pickBackend(config.proxies[0], balanceRoundRobin, "", nil))
+	}
+}
@@ -0,0 +1,384 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	net_http "net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCGIHeaderBytes is the maximum size of the header block a CGI script can write.
+const maxCGIHeaderBytes = 64 << 10
+
+// maxCGIRedirects is the maximum number of consecutive local redirects between CGI scripts.
+const maxCGIRedirects = 10
+
+// isCGIRequest reports whether the decoded path of request is under the CGI prefix.
+// The paths that are under it only before being cleaned, like "/cgi-bin/%2e%2e/tool.sh",
+// are CGI requests too, so that runCGI refuses them instead of serving them as static files.
+func isCGIRequest(request *request, config *buggyConfig) bool {
+	if config.cgiPrefix == "" {
+		return false
+	}
+	rawPath, _, _ := strings.Cut(request.path, "?")
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		p = rawPath
+	}
+	return hasPathPrefix(p, config.cgiPrefix) || hasPathPrefix(path.Clean("/"+p), config.cgiPrefix)
+}
+
+// cleanScriptPath decodes the URL path rawPath and cleans it, keeping the trailing slash
+// of PATH-INFO. Paths with ".." segments are refused, a script is never looked up outside
+// the directory the client asked for.
+func cleanScriptPath(rawPath string) (string, error) {
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("cleanScriptPath(): %q has a .. segment", p)
+		}
+	}
+
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// findCGIScript splits the clean URL path p in the path of a script under the directory cgiPrefix
+// of baseDir, and the remaining PATH-INFO. The script is the shortest prefix of p that is a regular file.
+// See https://www.rfc-editor.org/rfc/rfc3875#section-3.3
+func findCGIScript(baseDir string, cgiPrefix string, p string) (scriptName string, pathInfo string, err error) {
+	if !hasPathPrefix(p, cgiPrefix) {
+		return "", "", fmt.Errorf("findCGIScript(): %s is not under %s", p, cgiPrefix)
+	}
+	cgiDir, err := resolvePath(baseDir, cgiPrefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	segments := strings.Split(strings.TrimPrefix(p, cgiPrefix), "/")
+
+	scriptName = cgiPrefix
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		scriptName = strings.TrimSuffix(scriptName, "/") + "/" + segment
+
+		file, err := resolvePath(baseDir, scriptName)
+		if err != nil {
+			return "", "", err
+		}
+		if file != cgiDir && !strings.HasPrefix(file, cgiDir+string(filepath.Separator)) {
+			return "", "", fmt.Errorf("findCGIScript(): %s is outside %s", scriptName, cgiPrefix)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", "", err
+		}
+		if info.Mode().IsRegular() {
+			if rest := segments[i+1:]; len(rest) > 0 {
+				pathInfo = "/" + strings.Join(rest, "/")
+			}
+			return scriptName, pathInfo, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("findCGIScript(): no script in %s", p)
+}
+
+// cgiEnv builds the meta-variables of a CGI request.
+// See https://www.rfc-editor.org/rfc/rfc3875#section-4.1
+func cgiEnv(request *request, config *buggyConfig, scriptName, scriptFile, pathInfo, query string) []string {
+	serverName, serverPort := "", ""
+	if host, port, err := net.SplitHostPort(request.localAddr); err == nil {
+		serverName, serverPort = host, port
+	}
+	if values, ok := request.headers["host"]; ok {
+		if host, _, err := net.SplitHostPort(values[0]); err == nil {
+			serverName = host
+		} else {
+			serverName = values[0]
+		}
+	}
+
+	remoteAddr, remotePort := request.remoteAddr, ""
+	if host, port, err := net.SplitHostPort(request.remoteAddr); err == nil {
+		remoteAddr, remotePort = host, port
+	}
+
+	documentRoot, _ := filepath.Abs(config.baseDir)
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=BuggyServer",
+		"SERVER_PROTOCOL=" + request.proto,
+		"SERVER_NAME=" + serverName,
+		"SERVER_PORT=" + serverPort,
+		"REQUEST_METHOD=" + request.method,
+		"REQUEST_URI=" + request.path,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + scriptFile,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + query,
+		"REMOTE_ADDR=" + remoteAddr,
+		"REMOTE_HOST=" + remoteAddr,
+		"REMOTE_PORT=" + remotePort,
+		"DOCUMENT_ROOT=" + documentRoot,
+		"PATH=" + os.Getenv("PATH"),
+	}
+
+	if pathInfo != "" {
+		if translated, err := resolvePath(config.baseDir, pathInfo); err == nil {
+			env = append(env, "PATH_TRANSLATED="+translated)
+		}
+	}
+
+	if request.user != "" {
+		env = append(env, "AUTH_TYPE=Basic", "REMOTE_USER="+request.user)
+	}
+
+	if len(request.body) > 0 {
+		env = append(env, "CONTENT_LENGTH="+strconv.Itoa(len(request.body)))
+	}
+	if values, ok := request.headers["content-type"]; ok {
+		env = append(env, "CONTENT_TYPE="+strings.Join(values, ", "))
+	}
+
+	for name, values := range request.headers {
+		switch name {
+		// Already sent as CONTENT_LENGTH and CONTENT_TYPE.
+		case "content-length", "content-type":
+			continue
+		// HTTP_PROXY would be taken by many programs as the proxy for their own requests.
+		case "proxy":
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		env = append(env, key+"="+strings.Join(values, ", "))
+	}
+
+	return env
+}
+
+// replyToCGI runs the script under the CGI prefix that request points to, and sends its output.
+// The request body is written to the standard input of the script, the header block it writes
+// on standard output is parsed, and the rest of the output is streamed as response body.
+// The script is killed if it runs longer than the write timeout.
+// See https://www.rfc-editor.org/rfc/rfc3875
+func replyToCGI(request *request, config *buggyConfig) (*response, error) {
+	return runCGI(request, config, 0)
+}
+
+// runCGI runs a script, redirects is the number of local redirects that led to request.
+func runCGI(request *request, config *buggyConfig, redirects int) (*response, error) {
+	rawPath, query, _ := strings.Cut(request.path, "?")
+
+	p, err := cleanScriptPath(rawPath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	scriptName, pathInfo, err := findCGIScript(config.baseDir, config.cgiPrefix, p)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	scriptFile, err := resolvePath(config.baseDir, scriptName)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+	if info, err := os.Stat(scriptFile); err != nil || info.Mode().Perm()&0111 == 0 {
+		return r403(), fmt.Errorf("replyToCGI() -> %s, %s : %s is not executable. 403 sent", request.method, request.path, scriptName)
+	}
+
+	cmd := exec.Command(scriptFile)
+	cmd.Dir = filepath.Dir(scriptFile)
+	cmd.Env = cgiEnv(request, config, scriptName, scriptFile, pathInfo, query)
+	cmd.Stdin = bytes.NewReader(request.body)
+	cmd.Stderr = &cgiStderr{script: scriptName}
+	setProcessGroup(cmd)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return r500(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return r500(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	// The script can still be writing the body after reply() has returned.
+	timer := time.AfterFunc(config.writeTimeout, func() {
+		log.Printf("error: replyToCGI() -> %s, %s : %s exceeded the write timeout, killed", request.method, request.path, scriptName)
+		killProcessGroup(cmd)
+	})
+	wait := func() error {
+		err := cmd.Wait()
+		timer.Stop()
+		return err
+	}
+
+	reader := bufio.NewReader(stdout)
+	r, location, err := parseCGIHeaders(reader)
+	if err != nil {
+		killProcessGroup(cmd)
+		wait()
+		return r500(), fmt.Errorf("replyToCGI() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	// A local redirect is served as a GET request for the new path.
+	// See https://www.rfc-editor.org/rfc/rfc3875#section-6.2.2
+	if location != "" && r == nil {
+		io.Copy(io.Discard, reader)
+		wait()
+		redirected := localRedirect(request, location)
+		if !isCGIRequest(redirected, config) {
+			return reply(redirected, config)
+		}
+		if redirects >= maxCGIRedirects {
+			return r500(), fmt.Errorf("replyToCGI() -> %s, %s : too many local redirects. 500 sent", request.method, request.path)
+		}
+		return runCGI(redirected, config, redirects+1)
+	}
+
+	if request.method == "HEAD" {
+		io.Copy(io.Discard, reader)
+		if err := wait(); err != nil {
+			log.Printf("error: replyToCGI() -> %s, %s : %s: %s", request.method, request.path, scriptName, err.Error())
+		}
+		r.body = make([]byte, 0)
+		return r, nil
+	}
+
+	r.stream = func(w streamWriter) error {
+		_, copyErr := io.Copy(w, reader)
+		if err := wait(); err != nil {
+			return fmt.Errorf("replyToCGI() -> %s, %s : %s: %w", request.method, request.path, scriptName, err)
+		}
+		return copyErr
+	}
+	return r, nil
+}
+
+// localRedirect returns the GET request for location that replaces req.
+func localRedirect(req *request, location string) *request {
+	redirected := &request{
+		method:     "GET",
+		path:       location,
+		proto:      req.proto,
+		headers:    map[string][]string{},
+		body:       make([]byte, 0),
+		remoteAddr: req.remoteAddr,
+		localAddr:  req.localAddr,
+	}
+	if values, ok := req.headers["host"]; ok {
+		redirected.headers["host"] = values
+	}
+	return redirected
+}
+
+// parseCGIHeaders reads the header block written by a CGI script, and returns the response it describes.
+// If the script asks for a local redirect, the response is nil and location is the path to serve.
+// See https://www.rfc-editor.org/rfc/rfc3875#section-6.3
+func parseCGIHeaders(reader *bufio.Reader) (r *response, location string, err error) {
+	var byteCount int
+
+	headers := make(map[string][]string)
+	for {
+		line, err := readLine(reader, &byteCount, maxCGIHeaderBytes)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, "", fmt.Errorf("parseCGIHeaders(): the script output has no header block")
+			}
+			return nil, "", fmt.Errorf("parseCGIHeaders(): %w", err)
+		}
+		if strings.TrimSpace(string(line)) == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(string(line), ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, "", fmt.Errorf("parseCGIHeaders(): invalid header line: %q", line)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		headers[name] = append(headers[name], strings.TrimSpace(value))
+	}
+
+	code, reasonPhrase := 200, "OK"
+	_, hasStatus := headers["status"]
+	if hasStatus {
+		values := headers["status"]
+		status, phrase, _ := strings.Cut(values[0], " ")
+		c, err := strconv.Atoi(status)
+		if err != nil || c < 100 || c > 599 {
+			return nil, "", fmt.Errorf("parseCGIHeaders(): invalid status: %q", values[0])
+		}
+		code, reasonPhrase = c, phrase
+		delete(headers, "status")
+	}
+
+	if values, ok := headers["location"]; ok {
+		if strings.HasPrefix(values[0], "/") && !strings.HasPrefix(values[0], "//") {
+			if !hasStatus {
+				return nil, values[0], nil
+			}
+		} else if code == 200 {
+			code, reasonPhrase = 302, "Found"
+		}
+	}
+
+	if reasonPhrase == "" {
+		reasonPhrase = net_http.StatusText(code)
+	}
+
+	// Framing is decided by BuggyServer.
+	delete(headers, "transfer-encoding")
+	delete(headers, "connection")
+
+	headers["date"] = []string{time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")}
+	headers["server"] = []string{"BuggyServer"}
+
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         code,
+		reasonPhrase: reasonPhrase,
+		headers:      headers,
+		body:         make([]byte, 0),
+	}, "", nil
+}
+
+// cgiStderr writes the standard error of a CGI script to the log, one line at a time.
+type cgiStderr struct {
+	script string
+	buf    []byte
+}
+
+func (e *cgiStderr) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	for {
+		i := bytes.IndexByte(e.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("error: %s: %s", e.script, strings.TrimRight(string(e.buf[:i]), "\r"))
+		e.buf = e.buf[i+1:]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package buggy_http
+
+import "os/exec"
+
+// setProcessGroup does nothing, process groups are not available.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process of cmd, its children are left running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
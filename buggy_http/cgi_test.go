@@ -0,0 +1,218 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCGITestConfig returns a config with the scripts in a cgi-bin directory under a temporary baseDir.
+func newCGITestConfig(t *testing.T, scripts map[string]string) *buggyConfig {
+	baseDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(baseDir, "cgi-bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "index.html"), []byte("<html>index</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(baseDir, "cgi-bin", name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buggyConfig{baseDir: baseDir, cgiPrefix: "/cgi-bin", writeTimeout: 5 * time.Second}
+}
+
+// runStream returns the body written by the stream of r.
+func runStream(t *testing.T, r *response) string {
+	if r.stream == nil {
+		return string(r.body)
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	assert.NoError(t, r.stream(w))
+	w.Flush()
+	return buf.String()
+}
+
+func TestReplyToCGI(t *testing.T) {
+	config := newCGITestConfig(t, map[string]string{
+		"env.sh": "#!/bin/sh\n" +
+			"printf 'Content-Type: text/plain\\r\\n\\r\\n'\n" +
+			"echo \"$REQUEST_METHOD $SCRIPT_NAME $PATH_INFO $QUERY_STRING\"\n" +
+			"echo \"$CONTENT_LENGTH $CONTENT_TYPE $HTTP_X_CUSTOM $REMOTE_ADDR $SERVER_PORT\"\n" +
+			"echo \"proxy=$HTTP_PROXY\"\n" +
+			"cat\n",
+		"status.sh":   "#!/bin/sh\nprintf 'Status: 404 Not Here\\nX-Script: yes\\n\\nmissing'\n",
+		"redirect.sh": "#!/bin/sh\nprintf 'Location: https://example.com/\\n\\n'\n",
+		"local.sh":    "#!/bin/sh\nprintf 'Location: /index.html\\n\\n'\n",
+		"loop.sh":     "#!/bin/sh\nprintf 'Location: /cgi-bin/loop.sh\\n\\n'\n",
+		"noheader.sh": "#!/bin/sh\nexit 1\n",
+		"slow.sh":     "#!/bin/sh\nsleep 5\n",
+	})
+	os.WriteFile(filepath.Join(config.baseDir, "cgi-bin", "data.txt"), []byte("data"), 0644)
+
+	t.Run("Meta-variables and body", func(t *testing.T) {
+		r, err := reply(&request{
+			method: "POST",
+			path:   "/cgi-bin/env.sh/extra/path?a=1&b=2",
+			proto:  "HTTP/1.1",
+			headers: map[string][]string{
+				"content-type":   {"text/plain"},
+				"content-length": {"5"},
+				"x-custom":       {"value"},
+				"proxy":          {"http://evil"},
+			},
+			body:       []byte("hello"),
+			remoteAddr: "192.0.2.7:51000",
+			localAddr:  "127.0.0.1:8080",
+		}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, []string{"text/plain"}, r.headers["content-type"])
+
+		body := runStream(t, r)
+		assert.Equal(t, "POST /cgi-bin/env.sh /extra/path a=1&b=2\n5 text/plain value 192.0.2.7 8080\nproxy=\nhello", body)
+	})
+
+	t.Run("Status header", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/status.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, r.code)
+		assert.Equal(t, "Not Here", r.reasonPhrase)
+		assert.Equal(t, []string{"yes"}, r.headers["x-script"])
+		assert.NotContains(t, r.headers, "status")
+		assert.Equal(t, "missing", runStream(t, r))
+	})
+
+	t.Run("Client redirect", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/redirect.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 302, r.code)
+		assert.Equal(t, []string{"https://example.com/"}, r.headers["location"])
+		runStream(t, r)
+	})
+
+	t.Run("Local redirect", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/local.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, "<html>index</html>", string(r.body))
+	})
+
+	t.Run("Local redirect loop", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/loop.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 500, r.code)
+	})
+
+	t.Run("HEAD has no body", func(t *testing.T) {
+		r, err := reply(&request{method: "HEAD", path: "/cgi-bin/status.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Nil(t, r.stream)
+		assert.Empty(t, r.body)
+	})
+
+	t.Run("Output without header block", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/noheader.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 500, r.code)
+	})
+
+	t.Run("Missing script", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/missing.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 404, r.code)
+	})
+
+	t.Run("Not executable", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin/data.txt", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 403, r.code)
+	})
+
+	t.Run("Scripts outside the CGI directory", func(t *testing.T) {
+		os.WriteFile(filepath.Join(config.baseDir, "tool.sh"), []byte("#!/bin/sh\nprintf 'Content-Type: text/plain\\n\\nran'\n"), 0755)
+
+		for _, p := range []string{
+			"/cgi-bin/%2e%2e/tool.sh",
+			"/cgi-bin/%2E%2E/tool.sh/extra",
+			"/cgi-bin/../tool.sh",
+			"/cgi-bin/./%2e%2e/tool.sh",
+			"/cgi-bin/env.sh/../../tool.sh",
+		} {
+			req := &request{method: "GET", path: p, proto: "HTTP/1.1", headers: map[string][]string{}}
+			assert.True(t, isCGIRequest(req, config), p)
+			r, err := reply(req, config)
+			assert.Error(t, err, p)
+			assert.Equal(t, 404, r.code, p)
+		}
+	})
+
+	t.Run("Clean paths", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/cgi-bin//./env.sh/extra/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.True(t, strings.HasPrefix(runStream(t, r), "GET /cgi-bin/env.sh /extra/ \n"))
+	})
+
+	t.Run("Slow script is killed", func(t *testing.T) {
+		config.writeTimeout = 200 * time.Millisecond
+		defer func() { config.writeTimeout = 5 * time.Second }()
+
+		start := time.Now()
+		r, err := replyToCGI(&request{method: "GET", path: "/cgi-bin/slow.sh", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 500, r.code)
+		assert.Less(t, time.Since(start), 3*time.Second)
+	})
+}
+
+func TestParseCGIHeaders(t *testing.T) {
+	parse := func(raw string) (*response, string, error) {
+		return parseCGIHeaders(bufio.NewReader(strings.NewReader(raw)))
+	}
+
+	t.Run("Status without reason phrase", func(t *testing.T) {
+		r, _, err := parse("Status: 201\r\n\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, 201, r.code)
+		assert.Equal(t, "Created", r.reasonPhrase)
+	})
+
+	t.Run("Invalid status", func(t *testing.T) {
+		_, _, err := parse("Status: abc\r\n\r\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid header line", func(t *testing.T) {
+		_, _, err := parse("no colon\r\n\r\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("Location with status is sent to the client", func(t *testing.T) {
+		r, location, err := parse("Status: 301 Moved Permanently\nLocation: /new\n\n")
+		assert.NoError(t, err)
+		assert.Empty(t, location)
+		assert.Equal(t, 301, r.code)
+		assert.Equal(t, []string{"/new"}, r.headers["location"])
+	})
+}
+
+func TestHandleConnectionCGI(t *testing.T) {
+	bs := newTestInstance(t)
+	os.Mkdir(filepath.Join(bs.config.baseDir, "cgi-bin"), 0755)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "cgi-bin", "hello.sh"), []byte("#!/bin/sh\nprintf 'Content-Type: text/plain\\n\\n'\nprintf hello\n"), 0755)
+	assert.NoError(t, bs.SetCGI("/cgi-bin"))
+
+	out := roundTrip(t, bs, "GET /cgi-bin/hello.sh HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+}
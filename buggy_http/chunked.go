@@ -0,0 +1,278 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// streamWriter is the writer given to the stream function of a response.
+// Data written is buffered until Flush is called or the buffer is full.
+type streamWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// chunkedWriter writes a body with the chunked transfer coding,
+// every call to Write produces one chunk.
+// See https://www.rfc-editor.org/rfc/rfc9112#section-7.1
+type chunkedWriter struct {
+	w *bufio.Writer
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	// A zero size chunk would be the last chunk.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := cw.w.WriteString("\r\n"); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (cw *chunkedWriter) Flush() error {
+	return cw.w.Flush()
+}
+
+// close writes the last chunk followed by the trailer section.
+func (cw *chunkedWriter) close(trailers map[string][]string) error {
+	if _, err := cw.w.WriteString("0\r\n" + serializeFields(trailers) + "\r\n"); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+// identityWriter writes a body as it is, the end of the body is
+// signaled by closing the connection.
+// It is used for clients that do not support the chunked transfer coding.
+type identityWriter struct {
+	w *bufio.Writer
+}
+
+func (iw *identityWriter) Write(p []byte) (int, error) {
+	return iw.w.Write(p)
+}
+
+func (iw *identityWriter) Flush() error {
+	return iw.w.Flush()
+}
+
+// prepareStream sets the framing headers of a response that has a stream body.
+// If the stream has no declared content-length, HTTP/1.1 clients receive it
+// with the chunked transfer coding, while for HTTP/1.0 clients the
+// end of the body is signaled by closing the connection.
+func prepareStream(r *response, req *request) *response {
+	if r.stream == nil {
+		return r
+	}
+
+	if _, ok := r.headers["content-length"]; ok {
+		return r
+	}
+
+	if isHTTP10(req) {
+		delete(r.headers, "keep-alive")
+		return addCloseConnectionHeader(r)
+	}
+
+	r.headers["transfer-encoding"] = []string{"chunked"}
+
+	if len(r.trailers) > 0 {
+		names := make([]string, 0, len(r.trailers))
+		for name := range r.trailers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r.headers["trailer"] = names
+	}
+
+	return r
+}
+
+// writeStream writes the head of a response with a stream body, then calls the stream function.
+// HEAD requests only receive the head.
+func writeStream(w io.Writer, r *response, method string) error {
+	bufWriter := bufio.NewWriter(w)
+
+	if _, err := bufWriter.WriteString(serializeHead(r)); err != nil {
+		return err
+	}
+
+	if method == "HEAD" {
+		return bufWriter.Flush()
+	}
+
+	if headerFinder(r.headers, "transfer-encoding", "chunked") {
+		cw := &chunkedWriter{w: bufWriter}
+		if err := r.stream(cw); err != nil {
+			// Without the last chunk the client knows the body is incomplete.
+			cw.Flush()
+			return fmt.Errorf("writeStream(): %w", err)
+		}
+		return cw.close(r.trailers)
+	}
+
+	if value, ok := r.headers["content-length"]; ok {
+		var contentLength int64
+		if _, err := fmt.Sscan(value[0], &contentLength); err != nil {
+			return fmt.Errorf("writeStream(): invalid content-length: %w", err)
+		}
+		lw := &limitedWriter{w: bufWriter, remaining: contentLength}
+		if err := r.stream(lw); err != nil {
+			bufWriter.Flush()
+			return fmt.Errorf("writeStream(): %w", err)
+		}
+		if lw.remaining != 0 {
+			bufWriter.Flush()
+			return fmt.Errorf("writeStream(): stream is shorter than its content-length")
+		}
+		return bufWriter.Flush()
+	}
+
+	iw := &identityWriter{w: bufWriter}
+	if err := r.stream(iw); err != nil {
+		iw.Flush()
+		return fmt.Errorf("writeStream(): %w", err)
+	}
+	return iw.Flush()
+}
+
+// limitedWriter writes a body with a declared content-length
+// and refuses to write more bytes than declared.
+type limitedWriter struct {
+	w         *bufio.Writer
+	remaining int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, fmt.Errorf("limitedWriter.Write(): stream is longer than its content-length")
+	}
+	n, err := lw.w.Write(p)
+	lw.remaining -= int64(n)
+	return n, err
+}
+
+func (lw *limitedWriter) Flush() error {
+	return lw.w.Flush()
+}
+
+// serializeFields serializes header or trailer fields, one per line.
+// Set-Cookie cannot be combined in a single line, every value has its own line.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-5.3
+func serializeFields(fields map[string][]string) string {
+	var b strings.Builder
+	for key, values := range fields {
+		if key == "set-cookie" {
+			for _, value := range values {
+				b.WriteString(key + ": " + value + "\r\n")
+			}
+			continue
+		}
+		b.WriteString(key + ": " + strings.Join(values, ", ") + "\r\n")
+	}
+	return b.String()
+}
+
+// readChunked reads a body with the chunked transfer coding, and returns it decoded
+// together with its trailer fields. maxBytes limits the size of the decoded body,
+// zero or negative means there is no limit. The chunks are copied as they arrive,
+// so a chunk size larger than the data sent does not allocate memory.
+// See https://www.rfc-editor.org/rfc/rfc9112#section-7.1.3
+func readChunked(reader *bufio.Reader, maxBytes int) ([]byte, map[string][]string, error) {
+	var body bytes.Buffer
+	var byteCount int
+
+	for {
+		line, err := readLine(reader, &byteCount, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): %w", err)
+		}
+
+		// Chunk extensions are ignored.
+		size, _, _ := strings.Cut(string(line), ";")
+		// ParseUint refuses signs, and 63 bits keep the size a valid int64.
+		chunkSize, err := strconv.ParseUint(strings.TrimSpace(size), 16, 63)
+		if err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): invalid chunk size: %q", line)
+		}
+
+		if chunkSize == 0 {
+			break
+		}
+
+		if maxBytes > 0 && chunkSize > uint64(maxBytes-body.Len()) {
+			return nil, nil, fmt.Errorf("readChunked(): body exceeded %d bytes: %w", maxBytes, errPayloadTooLarge)
+		}
+
+		if _, err := io.CopyN(&body, reader, int64(chunkSize)); err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): %w", err)
+		}
+		crlf := make([]byte, 2)
+		if _, err := io.ReadFull(reader, crlf); err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): %w", err)
+		}
+		if string(crlf) != "\r\n" {
+			return nil, nil, fmt.Errorf("readChunked(): missing CRLF after chunk data")
+		}
+	}
+
+	trailers := make(map[string][]string)
+	for {
+		line, err := readLine(reader, &byteCount, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): %w", err)
+		}
+		if strings.TrimSpace(string(line)) == "" {
+			break
+		}
+		name, value, err := headerLineParser(string(line))
+		if err != nil {
+			return nil, nil, fmt.Errorf("readChunked(): %w", err)
+		}
+		trailers[name] = append(trailers[name], value...)
+	}
+
+	return append(make([]byte, 0, body.Len()), body.Bytes()...), trailers, nil
+}
+
+// copyBody reads a body of contentLength bytes, or until the end of reader if contentLength is negative.
+// maxBytes limits its size, zero or negative means there is no limit. The body is copied
+// as it arrives instead of being allocated from the declared length.
+func copyBody(reader io.Reader, contentLength int, maxBytes int) ([]byte, error) {
+	if maxBytes > 0 && contentLength > maxBytes {
+		return nil, fmt.Errorf("copyBody(): content-length %d exceeds %d bytes: %w", contentLength, maxBytes, errPayloadTooLarge)
+	}
+
+	var body bytes.Buffer
+	if contentLength >= 0 {
+		if _, err := io.CopyN(&body, reader, int64(contentLength)); err != nil {
+			return nil, fmt.Errorf("copyBody(): %w", err)
+		}
+	} else {
+		limited := reader
+		if maxBytes > 0 {
+			limited = io.LimitReader(reader, int64(maxBytes)+1)
+		}
+		if _, err := body.ReadFrom(limited); err != nil {
+			return nil, fmt.Errorf("copyBody(): %w", err)
+		}
+		if maxBytes > 0 && body.Len() > maxBytes {
+			return nil, fmt.Errorf("copyBody(): body exceeded %d bytes: %w", maxBytes, errPayloadTooLarge)
+		}
+	}
+	return append(make([]byte, 0, body.Len()), body.Bytes()...), nil
+}
@@ -0,0 +1,173 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testStreamResponse(stream func(w streamWriter) error) *response {
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         200,
+		reasonPhrase: "OK",
+		headers:      map[string][]string{"content-type": {"text/plain"}},
+		stream:       stream,
+	}
+}
+
+func TestPrepareStream(t *testing.T) {
+	stream := func(w streamWriter) error { return nil }
+
+	t.Run("HTTP/1.1 without content-length is chunked", func(t *testing.T) {
+		r := prepareStream(testStreamResponse(stream), &request{proto: "HTTP/1.1"})
+		assert.Equal(t, []string{"chunked"}, r.headers["transfer-encoding"])
+		assert.NotContains(t, r.headers, "connection")
+	})
+
+	t.Run("HTTP/1.0 without content-length closes the connection", func(t *testing.T) {
+		r := testStreamResponse(stream)
+		r.headers["connection"] = []string{"keep-alive"}
+		r = prepareStream(r, &request{proto: "HTTP/1.0"})
+		assert.NotContains(t, r.headers, "transfer-encoding")
+		assert.Equal(t, []string{"close"}, r.headers["connection"])
+	})
+
+	t.Run("Declared content-length is not chunked", func(t *testing.T) {
+		r := testStreamResponse(stream)
+		r.headers["content-length"] = []string{"5"}
+		r = prepareStream(r, &request{proto: "HTTP/1.1"})
+		assert.NotContains(t, r.headers, "transfer-encoding")
+	})
+
+	t.Run("Trailers are declared", func(t *testing.T) {
+		r := testStreamResponse(stream)
+		r.trailers = map[string][]string{"x-checksum": nil, "x-count": nil}
+		r = prepareStream(r, &request{proto: "HTTP/1.1"})
+		assert.Equal(t, []string{"x-checksum", "x-count"}, r.headers["trailer"])
+	})
+}
+
+func TestWriteStream(t *testing.T) {
+	t.Run("Chunked body with trailer", func(t *testing.T) {
+		var r *response
+		r = testStreamResponse(func(w streamWriter) error {
+			fmt.Fprint(w, "Hello, ")
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			fmt.Fprint(w, "world!")
+			r.trailers["x-count"] = []string{"2"}
+			return nil
+		})
+		r.trailers = map[string][]string{"x-count": nil}
+		prepareStream(r, &request{proto: "HTTP/1.1"})
+
+		var buf bytes.Buffer
+		assert.NoError(t, writeStream(&buf, r, "GET"))
+
+		_, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+		assert.Equal(t, "7\r\nHello, \r\n6\r\nworld!\r\n0\r\nx-count: 2\r\n\r\n", body)
+	})
+
+	t.Run("Identity body for HTTP/1.0", func(t *testing.T) {
+		r := testStreamResponse(func(w streamWriter) error {
+			_, err := fmt.Fprint(w, "Hello, world!")
+			return err
+		})
+		prepareStream(r, &request{proto: "HTTP/1.0"})
+
+		var buf bytes.Buffer
+		assert.NoError(t, writeStream(&buf, r, "GET"))
+		_, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+		assert.Equal(t, "Hello, world!", body)
+	})
+
+	t.Run("Stream longer than content-length", func(t *testing.T) {
+		r := testStreamResponse(func(w streamWriter) error {
+			_, err := fmt.Fprint(w, "Hello, world!")
+			return err
+		})
+		r.headers["content-length"] = []string{"5"}
+		prepareStream(r, &request{proto: "HTTP/1.1"})
+
+		var buf bytes.Buffer
+		assert.Error(t, writeStream(&buf, r, "GET"))
+	})
+
+	t.Run("HEAD does not call the stream", func(t *testing.T) {
+		called := false
+		r := testStreamResponse(func(w streamWriter) error {
+			called = true
+			return nil
+		})
+		prepareStream(r, &request{proto: "HTTP/1.1"})
+
+		var buf bytes.Buffer
+		assert.NoError(t, writeStream(&buf, r, "HEAD"))
+		assert.False(t, called)
+		assert.Equal(t, len(serializeHead(r)), buf.Len())
+	})
+
+	t.Run("Stream error leaves the chunked body incomplete", func(t *testing.T) {
+		r := testStreamResponse(func(w streamWriter) error {
+			fmt.Fprint(w, "partial")
+			return fmt.Errorf("boom")
+		})
+		prepareStream(r, &request{proto: "HTTP/1.1"})
+
+		var buf bytes.Buffer
+		assert.Error(t, writeStream(&buf, r, "GET"))
+		assert.NotContains(t, buf.String(), "0\r\n\r\n")
+	})
+}
+
+func TestReadChunked(t *testing.T) {
+	read := func(raw string, maxBytes int) ([]byte, map[string][]string, error) {
+		return readChunked(bufio.NewReader(strings.NewReader(raw)), maxBytes)
+	}
+
+	t.Run("Body and trailers", func(t *testing.T) {
+		body, trailers, err := read("7\r\nHello, \r\n6\r\nworld!\r\n0\r\nX-Count: 2\r\n\r\n", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello, world!", string(body))
+		assert.Equal(t, []string{"2"}, trailers["x-count"])
+	})
+
+	t.Run("Invalid chunk size", func(t *testing.T) {
+		_, _, err := read("zz\r\nabc\r\n0\r\n\r\n", 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Missing CRLF after chunk data", func(t *testing.T) {
+		_, _, err := read("3\r\nabcd\r\n0\r\n\r\n", 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Body exceeds the limit", func(t *testing.T) {
+		_, _, err := read("7\r\nHello, \r\n6\r\nworld!\r\n0\r\n\r\n", 10)
+		assert.ErrorIs(t, err, errPayloadTooLarge)
+	})
+
+	t.Run("Huge chunk sizes", func(t *testing.T) {
+		for _, size := range []string{"7fffffffffffffff", "ffffffffffffffff", "10000000000000000", "-1", "+5"} {
+			_, _, err := read(size+"\r\nabc\r\n0\r\n\r\n", 0)
+			assert.Error(t, err, size)
+
+			_, _, err = read(size+"\r\nabc\r\n0\r\n\r\n", 1024)
+			assert.Error(t, err, size)
+		}
+
+		_, _, err := read("7fffffffffffffff\r\nabc\r\n0\r\n\r\n", 1024)
+		assert.ErrorIs(t, err, errPayloadTooLarge)
+	})
+}
+
+func TestSerializeFieldsSetCookie(t *testing.T) {
+	out := serializeFields(map[string][]string{"set-cookie": {"a=1", "b=2"}})
+	assert.Equal(t, "set-cookie: a=1\r\nset-cookie: b=2\r\n", out)
+}
@@ -0,0 +1,331 @@
+package buggy_http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config is the configuration of a BuggyServer as read from a JSON file.
+// Keys are the names of the bs flags, the fields that are not in the file keep their value.
+type Config struct {
+	Host string `json:"host"`
+	Port uint   `json:"port"`
+	Dir  string `json:"dir"`
+
+	// Listen replaces Host and Port if it is not empty, see StartBuggyServerOn() for the addresses.
+	Listen []string `json:"listen"`
+
+	// SocketMode is the octal permissions of the Unix sockets, like "0660".
+	SocketMode  string `json:"socket-mode"`
+	SocketOwner string `json:"socket-owner"`
+
+	ReadTimeout    int `json:"read-timeout"`
+	WriteTimeout   int `json:"write-timeout"`
+	MaxRequestSize int `json:"max-request-size"`
+	MaxHeaderSize  int `json:"max-header-size"`
+	MaxBodySize    int `json:"max-body-size"`
+
+	ErrorPages map[int]string `json:"error-pages"`
+
+	Uploads           bool     `json:"uploads"`
+	CreateDirs        bool     `json:"create-dirs"`
+	UploadEndpoint    string   `json:"upload-endpoint"`
+	MaxUploadFileSize int      `json:"max-upload-file-size"`
+	DeletePrefixes    []string `json:"delete-prefixes"`
+	RecursiveDelete   bool     `json:"recursive-delete"`
+	WebDAV            bool     `json:"webdav"`
+
+	CGI     string          `json:"cgi"`
+	FastCGI []FastCGIConfig `json:"fastcgi"`
+
+	Proxies             []ProxyConfig `json:"proxies"`
+	ProxyTimeout        int           `json:"proxy-timeout"`
+	ProxyBalance        string        `json:"proxy-balance"`
+	HealthCheckPath     string        `json:"health-check-path"`
+	HealthCheckInterval int           `json:"health-check-interval"`
+	MaxFails            int           `json:"max-fails"`
+	FailTimeout         int           `json:"fail-timeout"`
+
+	MaxMessageSize int  `json:"max-message-size"`
+	Heartbeat      int  `json:"heartbeat"`
+	Watch          bool `json:"watch"`
+
+	SPA        string   `json:"spa"`
+	SPAExclude []string `json:"spa-exclude"`
+
+	// Rules of RulesFile are evaluated before the ones written in the configuration.
+	RulesFile string   `json:"rules-file"`
+	Rules     []string `json:"rules"`
+
+	// AuthRealm is the realm of the BasicAuth prefixes that do not set one.
+	BasicAuth []BasicAuthConfig `json:"basic-auth"`
+	AuthRealm string            `json:"auth-realm"`
+
+	// Access rules are checked when a connection is accepted, PathAccess rules on the requests under their prefix.
+	Access         []string           `json:"access"`
+	PathAccess     []PathAccessConfig `json:"path-access"`
+	TrustedProxies []string           `json:"trusted-proxies"`
+	ProxyProtocol  bool               `json:"proxy-protocol"`
+}
+
+// FastCGIConfig sends the requests that match Pattern to the FastCGI application at Address.
+type FastCGIConfig struct {
+	Pattern string `json:"pattern"`
+	Address string `json:"address"`
+}
+
+// ProxyConfig forwards the requests under Prefix to Upstreams.
+type ProxyConfig struct {
+	Prefix    string   `json:"prefix"`
+	Upstreams []string `json:"upstreams"`
+}
+
+// BasicAuthConfig requires the credentials of a user of the htpasswd File for the paths under Prefix.
+type BasicAuthConfig struct {
+	Prefix string `json:"prefix"`
+	File   string `json:"file"`
+	Realm  string `json:"realm"`
+}
+
+// PathAccessConfig checks the allow and deny Rules on the clients of the requests under Prefix.
+type PathAccessConfig struct {
+	Prefix string   `json:"prefix"`
+	Rules  []string `json:"rules"`
+}
+
+// DefaultConfig returns the configuration used when nothing is set, it matches the defaults of the bs flags.
+func DefaultConfig() Config {
+	return Config{
+		Host:                "0.0.0.0",
+		Port:                8080,
+		Dir:                 "./",
+		ReadTimeout:         -1,
+		WriteTimeout:        -1,
+		MaxRequestSize:      -1,
+		MaxHeaderSize:       -1,
+		MaxBodySize:         -1,
+		MaxUploadFileSize:   -1,
+		ProxyTimeout:        -1,
+		ProxyBalance:        balanceRoundRobin,
+		HealthCheckInterval: 10,
+		MaxFails:            3,
+		FailTimeout:         30,
+		MaxMessageSize:      1024,
+		Heartbeat:           15,
+		AuthRealm:           defaultRealm,
+	}
+}
+
+// ReadConfigFile overwrites the fields of cfg with the ones in the JSON file at path.
+// Unknown keys are an error, so that typos are not silently ignored.
+func ReadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ReadConfigFile(): %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("ReadConfigFile(): %s: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overwrites the fields of cfg with the environment variables returned by lookup.
+// The variable of a field is BS_ followed by its key in upper case, with '_' in place of '-',
+// like BS_READ_TIMEOUT. Lists of strings are separated by commas, the other lists and maps are JSON.
+func (cfg *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("json")
+		name := "BS_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case reflect.Int:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 0)
+			field.SetInt(n)
+		case reflect.Uint:
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 0)
+			field.SetUint(n)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.String {
+				list := []string{}
+				for _, item := range strings.Split(value, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						list = append(list, item)
+					}
+				}
+				field.Set(reflect.ValueOf(list))
+				break
+			}
+			err = json.Unmarshal([]byte(value), field.Addr().Interface())
+		default:
+			err = json.Unmarshal([]byte(value), field.Addr().Interface())
+		}
+		if err != nil {
+			return fmt.Errorf("ApplyEnv(): %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Addresses returns the addresses to pass to StartBuggyServerOn(): Listen, or Host and Port if it is empty.
+func (cfg *Config) Addresses() []string {
+	if len(cfg.Listen) > 0 {
+		return cfg.Listen
+	}
+	return []string{fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)}
+}
+
+// NewBuggyServerFromConfig creates a BuggyServer configured with cfg.
+// It returns the error of the first setting that is not valid, and can be
+// used to validate a configuration without starting the server.
+func NewBuggyServerFromConfig(cfg Config) (BuggyServer, error) {
+	bs := NewBuggyServer().(*buggyInstance)
+
+	if err := bs.SetBaseDir(cfg.Dir); err != nil {
+		return nil, err
+	}
+	if err := bs.SetReadTimeout(cfg.ReadTimeout); err != nil {
+		return nil, err
+	}
+	if err := bs.SetWriteTimeout(cfg.WriteTimeout); err != nil {
+		return nil, err
+	}
+	if err := bs.SetmaxRequestMiB(cfg.MaxRequestSize); err != nil {
+		return nil, err
+	}
+	if err := bs.SetMaxHeaderKiB(cfg.MaxHeaderSize); err != nil {
+		return nil, err
+	}
+	if err := bs.SetMaxBodyMiB(cfg.MaxBodySize); err != nil {
+		return nil, err
+	}
+	for code, path := range cfg.ErrorPages {
+		if err := bs.SetErrorPage(code, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := bs.SetUploads(cfg.Uploads, cfg.CreateDirs); err != nil {
+		return nil, err
+	}
+	if err := bs.SetDeletePrefixes(cfg.DeletePrefixes, cfg.RecursiveDelete); err != nil {
+		return nil, err
+	}
+	if err := bs.SetUploadEndpoint(cfg.UploadEndpoint, cfg.MaxUploadFileSize); err != nil {
+		return nil, err
+	}
+	if err := bs.SetWebDAV(cfg.WebDAV); err != nil {
+		return nil, err
+	}
+
+	if err := bs.SetCGI(cfg.CGI); err != nil {
+		return nil, err
+	}
+	for _, app := range cfg.FastCGI {
+		if err := bs.SetFastCGI(app.Pattern, app.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, proxy := range cfg.Proxies {
+		if err := bs.SetProxy(proxy.Prefix, proxy.Upstreams...); err != nil {
+			return nil, err
+		}
+	}
+	if err := bs.SetProxyTimeout(cfg.ProxyTimeout); err != nil {
+		return nil, err
+	}
+	if err := bs.SetProxyBalance(cfg.ProxyBalance); err != nil {
+		return nil, err
+	}
+	if err := bs.SetHealthCheck(cfg.HealthCheckPath, cfg.HealthCheckInterval); err != nil {
+		return nil, err
+	}
+	if err := bs.SetMaxFails(cfg.MaxFails, cfg.FailTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := bs.SetMaxMessageKiB(cfg.MaxMessageSize); err != nil {
+		return nil, err
+	}
+	if err := bs.SetHeartbeat(cfg.Heartbeat); err != nil {
+		return nil, err
+	}
+	if err := bs.SetWatch(cfg.Watch); err != nil {
+		return nil, err
+	}
+	if err := bs.SetSPA(cfg.SPA, cfg.SPAExclude); err != nil {
+		return nil, err
+	}
+
+	var mode uint64
+	if cfg.SocketMode != "" {
+		var err error
+		if mode, err = strconv.ParseUint(cfg.SocketMode, 8, 32); err != nil {
+			return nil, fmt.Errorf("NewBuggyServerFromConfig(): socket-mode %q is not an octal number", cfg.SocketMode)
+		}
+	}
+	if err := bs.SetUnixSocket(os.FileMode(mode), cfg.SocketOwner); err != nil {
+		return nil, err
+	}
+
+	for _, auth := range cfg.BasicAuth {
+		realm := auth.Realm
+		if realm == "" {
+			realm = cfg.AuthRealm
+		}
+		if err := bs.SetBasicAuth(auth.Prefix, auth.File, realm); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := bs.SetAccessRules(cfg.Access); err != nil {
+		return nil, err
+	}
+	for _, pa := range cfg.PathAccess {
+		if err := bs.SetPathAccessRules(pa.Prefix, pa.Rules); err != nil {
+			return nil, err
+		}
+	}
+	if err := bs.SetTrustedProxies(cfg.TrustedProxies, cfg.ProxyProtocol); err != nil {
+		return nil, err
+	}
+
+	if err := bs.SetRules(cfg.RulesFile); err != nil {
+		return nil, err
+	}
+	if len(cfg.Rules) > 0 {
+		rules, err := parseRules(strings.NewReader(strings.Join(cfg.Rules, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("NewBuggyServerFromConfig(): rules: %w", err)
+		}
+		bs.config.rules = append(bs.config.rules, rules...)
+	}
+
+	return bs, nil
+}
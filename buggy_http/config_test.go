@@ -0,0 +1,156 @@
+package buggy_http
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "bs.json")
+		os.WriteFile(p, []byte(content), 0644)
+		return p
+	}
+
+	t.Run("Values in the file overwrite the defaults", func(t *testing.T) {
+		cfg := DefaultConfig()
+		err := ReadConfigFile(write(`{
+			"port": 9000,
+			"read-timeout": 30,
+			"error-pages": {"404": "404.html"},
+			"proxies": [{"prefix": "/api", "upstreams": ["http://127.0.0.1:3000"]}]
+		}`), &cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(9000), cfg.Port)
+		assert.Equal(t, 30, cfg.ReadTimeout)
+		assert.Equal(t, map[int]string{404: "404.html"}, cfg.ErrorPages)
+		assert.Equal(t, []ProxyConfig{{Prefix: "/api", Upstreams: []string{"http://127.0.0.1:3000"}}}, cfg.Proxies)
+
+		// Missing keys keep their value.
+		assert.Equal(t, "0.0.0.0", cfg.Host)
+		assert.Equal(t, -1, cfg.WriteTimeout)
+	})
+
+	t.Run("Error on unknown keys", func(t *testing.T) {
+		cfg := DefaultConfig()
+		err := ReadConfigFile(write(`{"prot": 9000}`), &cfg)
+		assert.ErrorContains(t, err, "prot")
+	})
+
+	t.Run("Error on invalid JSON", func(t *testing.T) {
+		cfg := DefaultConfig()
+		assert.Error(t, ReadConfigFile(write(`{"port": "9000"}`), &cfg))
+		assert.Error(t, ReadConfigFile(write(`{`), &cfg))
+	})
+
+	t.Run("Error when the file is missing", func(t *testing.T) {
+		cfg := DefaultConfig()
+		assert.Error(t, ReadConfigFile(filepath.Join(dir, "missing.json"), &cfg))
+	})
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"BS_PORT":            "9100",
+		"BS_DIR":             "/srv/www",
+		"BS_UPLOADS":         "true",
+		"BS_WRITE_TIMEOUT":   "-1",
+		"BS_DELETE_PREFIXES": "/tmp, /uploads",
+		"BS_ERROR_PAGES":     `{"500": "500.html"}`,
+		"BS_FASTCGI":         `[{"pattern": "*.php", "address": "127.0.0.1:9000"}]`,
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	cfg := DefaultConfig()
+	assert.NoError(t, cfg.ApplyEnv(lookup))
+	assert.Equal(t, uint(9100), cfg.Port)
+	assert.Equal(t, "/srv/www", cfg.Dir)
+	assert.True(t, cfg.Uploads)
+	assert.Equal(t, -1, cfg.WriteTimeout)
+	assert.Equal(t, []string{"/tmp", "/uploads"}, cfg.DeletePrefixes)
+	assert.Equal(t, map[int]string{500: "500.html"}, cfg.ErrorPages)
+	assert.Equal(t, []FastCGIConfig{{Pattern: "*.php", Address: "127.0.0.1:9000"}}, cfg.FastCGI)
+	assert.Equal(t, "0.0.0.0", cfg.Host)
+
+	env = map[string]string{"BS_READ_TIMEOUT": "soon"}
+	assert.ErrorContains(t, cfg.ApplyEnv(lookup), "BS_READ_TIMEOUT")
+}
+
+func TestNewBuggyServerFromConfig(t *testing.T) {
+	t.Run("Valid configuration", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.Dir = t.TempDir()
+		cfg.ReadTimeout = 5
+		cfg.Uploads = true
+		cfg.DeletePrefixes = []string{"/tmp"}
+		cfg.Proxies = []ProxyConfig{{Prefix: "/api", Upstreams: []string{"http://127.0.0.1:3000"}}}
+		cfg.Rules = []string{"redirect 301 prefix /old /new"}
+
+		bs, err := NewBuggyServerFromConfig(cfg)
+		assert.NoError(t, err)
+
+		config := bs.(*buggyInstance).config
+		assert.Equal(t, 5*time.Second, config.readTimeout)
+		assert.True(t, config.uploads)
+		assert.Len(t, config.proxies, 1)
+		assert.Len(t, config.rules, 1)
+		assert.Equal(t, 1024*1024, config.maxMessageBytes)
+	})
+
+	t.Run("Error of the first invalid setting", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.ProxyBalance = "random"
+		_, err := NewBuggyServerFromConfig(cfg)
+		assert.ErrorContains(t, err, "SetProxyBalance()")
+	})
+
+	t.Run("Basic auth realms", func(t *testing.T) {
+		users := writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+		cfg := DefaultConfig()
+		cfg.AuthRealm = "Intranet"
+		cfg.BasicAuth = []BasicAuthConfig{{Prefix: "/private", File: users}, {Prefix: "/admin", File: users, Realm: "Admin"}}
+
+		bs, err := NewBuggyServerFromConfig(cfg)
+		assert.NoError(t, err)
+
+		config := bs.(*buggyInstance).config
+		assert.Equal(t, "Intranet", config.auth[0].realm)
+		assert.Equal(t, "Admin", config.auth[1].realm)
+	})
+
+	t.Run("Access rules", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.Access = []string{"allow 10.0.0.0/8", "deny all"}
+		cfg.PathAccess = []PathAccessConfig{{Prefix: "/admin", Rules: []string{"allow 10.1.0.0/16", "deny all"}}}
+		cfg.TrustedProxies = []string{"10.0.0.1"}
+		cfg.ProxyProtocol = true
+
+		bs, err := NewBuggyServerFromConfig(cfg)
+		assert.NoError(t, err)
+
+		config := bs.(*buggyInstance).config
+		assert.Equal(t, "[allow 10.0.0.0/8; deny all]", describeAccess(config.access))
+		assert.Equal(t, "[/admin=[allow 10.1.0.0/16; deny all]]", describePathAccess(config.pathAccess))
+		assert.Equal(t, "[allow 10.0.0.1/32]", describeAccess(config.trustedProxies))
+		assert.True(t, config.proxyProtocol)
+
+		cfg.Access = []string{"allow 10.0.0.0/8", "deny everyone"}
+		_, err = NewBuggyServerFromConfig(cfg)
+		assert.ErrorContains(t, err, "SetAccessRules()")
+	})
+
+	t.Run("Error on invalid rules", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.Rules = []string{"rewrite prefix /a"}
+		_, err := NewBuggyServerFromConfig(cfg)
+		assert.ErrorContains(t, err, "rules")
+	})
+}
@@ -0,0 +1,160 @@
+package buggy_http
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	net_http "net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// problemDetails is the body of an "application/problem+json" response,
+// as described in https://www.rfc-editor.org/rfc/rfc9457
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+}
+
+// addErrorBody fills the empty body of an error response (4xx, 5xx) with a small document.
+// If the client prefers JSON over HTML, the body is an RFC 9457 problem+json object,
+// otherwise it is the custom error page configured for that code, or a default HTML page.
+// Responses that already have a body, or a stream, are left untouched.
+func addErrorBody(r *response, req *request, config *buggyConfig) *response {
+	if r.code < 400 || len(r.body) > 0 || r.stream != nil {
+		return r
+	}
+
+	var body []byte
+	var contentType string
+
+	if prefersProblemJSON(req.headers) {
+		body, _ = json.Marshal(problemDetails{
+			Type:   "about:blank",
+			Title:  r.reasonPhrase,
+			Status: r.code,
+		})
+		contentType = "application/problem+json"
+
+	} else if page, err := readErrorPage(r.code, config); page != nil {
+		body = page
+		contentType = net_http.DetectContentType(page)
+
+	} else {
+		if err != nil {
+			log.Printf("error: addErrorBody(): %s", err.Error())
+		}
+		body = defaultErrorPage(r.code, r.reasonPhrase)
+		contentType = "text/html; charset=utf-8"
+	}
+
+	r.headers["content-type"] = []string{contentType}
+	r.headers["content-length"] = []string{fmt.Sprintf("%v", len(body))}
+
+	// A response to HEAD has the same headers as the one to GET, but no content.
+	if req.method != "HEAD" {
+		r.body = body
+	}
+
+	return r
+}
+
+// readErrorPage returns the content of the custom error page configured for code.
+// It returns nil, nil if no page is configured.
+func readErrorPage(code int, config *buggyConfig) ([]byte, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	p, ok := config.errorPages[code]
+	if !ok {
+		return nil, nil
+	}
+
+	path, err := validatePath(config.baseDir, p)
+	if err != nil {
+		return nil, fmt.Errorf("readErrorPage(): error page for %d: %w", code, err)
+	}
+
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("readErrorPage(): error page for %d: %w", code, err)
+	}
+
+	return page, nil
+}
+
+func defaultErrorPage(code int, reasonPhrase string) []byte {
+	title := html.EscapeString(fmt.Sprintf("%d %s", code, reasonPhrase))
+
+	return []byte("<!DOCTYPE html>\n" +
+		"<html>\n" +
+		"<head><title>" + title + "</title></head>\n" +
+		"<body>\n" +
+		"<h1>" + title + "</h1>\n" +
+		"<hr>\n" +
+		"<p>BuggyServer</p>\n" +
+		"</body>\n" +
+		"</html>\n")
+}
+
+// prefersProblemJSON reports whether the accept header of a request
+// gives JSON a higher quality value than HTML.
+// Without an accept header HTML is preferred.
+func prefersProblemJSON(headers map[string][]string) bool {
+	accept, ok := headers["accept"]
+	if !ok {
+		return false
+	}
+
+	jsonQuality := max(mediaTypeQuality(accept, "application/problem+json"), mediaTypeQuality(accept, "application/json"))
+	htmlQuality := mediaTypeQuality(accept, "text/html")
+
+	return jsonQuality > htmlQuality
+}
+
+// mediaTypeQuality returns the quality value that the values of an accept header
+// give to mediaType, using the most specific matching media range.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-12.5.1
+func mediaTypeQuality(accept []string, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+
+	quality := 0.0
+	specificity := -1
+
+	for _, value := range accept {
+		params := strings.Split(value, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case mediaRange == mainType+"/*":
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		quality = q
+		specificity = s
+	}
+
+	return quality
+}
@@ -0,0 +1,104 @@
+package buggy_http
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaTypeQuality(t *testing.T) {
+	testCases := []struct {
+		name      string
+		accept    []string
+		mediaType string
+		expected  float64
+	}{
+		{"Exact match", []string{"text/html"}, "text/html", 1},
+		{"Exact match with q", []string{"text/html;q=0.5"}, "text/html", 0.5},
+		{"Subtype wildcard", []string{"text/*;q=0.3"}, "text/html", 0.3},
+		{"Full wildcard", []string{"*/*;q=0.1"}, "text/html", 0.1},
+		{"Most specific wins", []string{"*/*", "text/html;q=0.2"}, "text/html", 0.2},
+		{"No match", []string{"image/png"}, "text/html", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, mediaTypeQuality(tc.accept, tc.mediaType))
+		})
+	}
+}
+
+func TestPrefersProblemJSON(t *testing.T) {
+	t.Run("No accept header", func(t *testing.T) {
+		assert.False(t, prefersProblemJSON(map[string][]string{}))
+	})
+
+	t.Run("Browser accept header", func(t *testing.T) {
+		headers := map[string][]string{"accept": {"text/html", "application/xhtml+xml", "application/xml;q=0.9", "*/*;q=0.8"}}
+		assert.False(t, prefersProblemJSON(headers))
+	})
+
+	t.Run("Problem JSON", func(t *testing.T) {
+		headers := map[string][]string{"accept": {"application/problem+json"}}
+		assert.True(t, prefersProblemJSON(headers))
+	})
+
+	t.Run("JSON preferred over HTML", func(t *testing.T) {
+		headers := map[string][]string{"accept": {"application/json", "text/html;q=0.5"}}
+		assert.True(t, prefersProblemJSON(headers))
+	})
+}
+
+func TestAddErrorBody(t *testing.T) {
+	baseDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(baseDir, "404.html"), []byte("<html>custom</html>"), 0644))
+
+	config := &buggyConfig{
+		baseDir:    baseDir,
+		errorPages: map[int]string{404: "404.html", 500: "missing.html"},
+	}
+
+	t.Run("Default HTML page", func(t *testing.T) {
+		r := addErrorBody(r400(), &request{method: "GET", headers: map[string][]string{}}, config)
+		assert.Equal(t, []string{"text/html; charset=utf-8"}, r.headers["content-type"])
+		assert.Contains(t, string(r.body), "400 Bad Request")
+		assert.Equal(t, []string{fmt.Sprintf("%v", len(r.body))}, r.headers["content-length"])
+	})
+
+	t.Run("Custom error page", func(t *testing.T) {
+		r := addErrorBody(r404(), &request{method: "GET", headers: map[string][]string{}}, config)
+		assert.Equal(t, "<html>custom</html>", string(r.body))
+	})
+
+	t.Run("Missing custom error page falls back to default", func(t *testing.T) {
+		r := addErrorBody(r500(), &request{method: "GET", headers: map[string][]string{}}, config)
+		assert.Contains(t, string(r.body), "500 Internal Server Error")
+	})
+
+	t.Run("Problem JSON", func(t *testing.T) {
+		req := &request{method: "GET", headers: map[string][]string{"accept": {"application/problem+json"}}}
+		r := addErrorBody(r404(), req, config)
+		assert.Equal(t, []string{"application/problem+json"}, r.headers["content-type"])
+
+		var problem problemDetails
+		assert.NoError(t, json.Unmarshal(r.body, &problem))
+		assert.Equal(t, problemDetails{Type: "about:blank", Title: "Not Found", Status: 404}, problem)
+	})
+
+	t.Run("HEAD has no body", func(t *testing.T) {
+		r := addErrorBody(r404(), &request{method: "HEAD", headers: map[string][]string{}}, config)
+		assert.Empty(t, r.body)
+		assert.NotEqual(t, []string{"0"}, r.headers["content-length"])
+	})
+
+	t.Run("Success response is untouched", func(t *testing.T) {
+		r := &response{code: 200, headers: map[string][]string{}, body: []byte{}}
+		addErrorBody(r, &request{method: "GET"}, config)
+		assert.Empty(t, r.body)
+		assert.NotContains(t, r.headers, "content-type")
+	})
+}
@@ -0,0 +1,684 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and constants.
+// See https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest    = 1
+	fcgiAbortRequest    = 2
+	fcgiEndRequest      = 3
+	fcgiParams          = 4
+	fcgiStdin           = 5
+	fcgiStdout          = 6
+	fcgiStderr          = 7
+	fcgiGetValues       = 9
+	fcgiGetValuesResult = 10
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiRequestComplete = 0
+	fcgiCantMpxConn     = 1
+	fcgiOverloaded      = 2
+	fcgiUnknownRole     = 3
+
+	// The maximum size of the content of a record.
+	fcgiMaxContent = 65535
+)
+
+// errFastCGIOverloaded is returned when the application refuses a request because it is overloaded.
+var errFastCGIOverloaded = errors.New("fastcgi application overloaded")
+
+// fastcgiRoute sends the requests that match pattern to a FastCGI application.
+type fastcgiRoute struct {
+	// A URL path prefix, e.g. "/app", or a file extension, e.g. "*.php".
+	pattern string
+
+	client *fcgiClient
+}
+
+// matches reports whether the URL path p matches the pattern of the route.
+func (route *fastcgiRoute) matches(p string) bool {
+	if ext, ok := strings.CutPrefix(route.pattern, "*"); ok {
+		// PATH-INFO can follow the script, e.g. /index.php/users.
+		for _, segment := range strings.Split(p, "/") {
+			if strings.HasSuffix(segment, ext) {
+				return true
+			}
+		}
+		return false
+	}
+	return hasPathPrefix(p, route.pattern)
+}
+
+// script splits the clean URL path p in the path of the script run by the application, and the
+// remaining PATH-INFO. With an extension pattern the script is the path up to the first segment
+// with the extension, so "/uploads/a.jpg/x.php" runs "/uploads/a.jpg/x.php" and never "/uploads/a.jpg".
+// With a prefix pattern it is the shortest prefix of p that is a file under baseDir, or p itself,
+// the application can serve paths that are not files, e.g. a framework router.
+func (route *fastcgiRoute) script(baseDir string, p string) (scriptName string, pathInfo string) {
+	ext, ok := strings.CutPrefix(route.pattern, "*")
+	if !ok {
+		scriptName, pathInfo, err := findCGIScript(baseDir, "/", p)
+		if err != nil {
+			return p, ""
+		}
+		return scriptName, pathInfo
+	}
+
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if strings.HasSuffix(segment, ext) {
+			scriptName = strings.Join(segments[:i+1], "/")
+			if rest := segments[i+1:]; len(rest) > 0 {
+				pathInfo = "/" + strings.Join(rest, "/")
+			}
+			return scriptName, pathInfo
+		}
+	}
+	return p, ""
+}
+
+// findFastCGIRoute returns the first route that matches the decoded path of request, or nil.
+func findFastCGIRoute(request *request, config *buggyConfig) *fastcgiRoute {
+	rawPath, _, _ := strings.Cut(request.path, "?")
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		p = rawPath
+	}
+	for _, route := range config.fastcgi {
+		if route.matches(p) {
+			return route
+		}
+	}
+	return nil
+}
+
+// fcgiRecord is a FastCGI record, without its padding.
+type fcgiRecord struct {
+	recType   uint8
+	requestID uint16
+	content   []byte
+}
+
+func writeRecord(w io.Writer, recType uint8, requestID uint16, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+
+	header := [8]byte{fcgiVersion1, recType}
+	binary.BigEndian.PutUint16(header[2:4], requestID)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	header[6] = uint8(padding)
+
+	record := make([]byte, 0, 8+len(content)+padding)
+	record = append(record, header[:]...)
+	record = append(record, content...)
+	record = append(record, make([]byte, padding)...)
+
+	_, err := w.Write(record)
+	return err
+}
+
+// writeRecordStream writes content as a stream of records of recType, ended by an empty record.
+func writeRecordStream(w io.Writer, recType uint8, requestID uint16, content []byte) error {
+	for len(content) > 0 {
+		n := min(len(content), fcgiMaxContent)
+		if err := writeRecord(w, recType, requestID, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeRecord(w, recType, requestID, nil)
+}
+
+func readRecord(r io.Reader) (fcgiRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fcgiRecord{}, err
+	}
+	if header[0] != fcgiVersion1 {
+		return fcgiRecord{}, fmt.Errorf("readRecord(): unsupported FastCGI version %d", header[0])
+	}
+
+	contentLength := int(binary.BigEndian.Uint16(header[4:6]))
+	body := make([]byte, contentLength+int(header[6]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fcgiRecord{}, err
+	}
+
+	return fcgiRecord{
+		recType:   header[1],
+		requestID: binary.BigEndian.Uint16(header[2:4]),
+		content:   body[:contentLength],
+	}, nil
+}
+
+// encodePairs encodes FastCGI name-value pairs.
+func encodePairs(pairs [][2]string) []byte {
+	var b bytes.Buffer
+	writeLength := func(n int) {
+		if n < 128 {
+			b.WriteByte(byte(n))
+			return
+		}
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+		b.Write(l[:])
+	}
+	for _, pair := range pairs {
+		writeLength(len(pair[0]))
+		writeLength(len(pair[1]))
+		b.WriteString(pair[0])
+		b.WriteString(pair[1])
+	}
+	return b.Bytes()
+}
+
+// decodePairs decodes FastCGI name-value pairs.
+func decodePairs(content []byte) (map[string]string, error) {
+	pairs := make(map[string]string)
+	readLength := func() (int, error) {
+		if len(content) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if content[0] < 128 {
+			n := int(content[0])
+			content = content[1:]
+			return n, nil
+		}
+		if len(content) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint32(content[:4]) &^ (1 << 31))
+		content = content[4:]
+		return n, nil
+	}
+
+	for len(content) > 0 {
+		nameLength, err := readLength()
+		if err != nil {
+			return nil, fmt.Errorf("decodePairs(): %w", err)
+		}
+		valueLength, err := readLength()
+		if err != nil {
+			return nil, fmt.Errorf("decodePairs(): %w", err)
+		}
+		if len(content) < nameLength+valueLength {
+			return nil, fmt.Errorf("decodePairs(): %w", io.ErrUnexpectedEOF)
+		}
+		pairs[string(content[:nameLength])] = string(content[nameLength : nameLength+valueLength])
+		content = content[nameLength+valueLength:]
+	}
+	return pairs, nil
+}
+
+// fcgiRequest is a request in progress on a fcgiConn.
+// Its fields are written by the read loop of the connection until done is closed.
+type fcgiRequest struct {
+	stdout bytes.Buffer
+	stderr *cgiStderr
+
+	appStatus      uint32
+	protocolStatus uint8
+	err            error
+
+	done chan struct{}
+}
+
+// fcgiConn is a connection to a FastCGI application. A read loop dispatches the
+// received records to the requests in progress, so that more requests can share
+// the connection if the application multiplexes them.
+type fcgiConn struct {
+	conn net.Conn
+
+	// Serializes the records written by concurrent requests.
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	requests map[uint16]*fcgiRequest
+	nextID   uint16
+	err      error
+}
+
+func newFcgiConn(conn net.Conn, reader *bufio.Reader) *fcgiConn {
+	c := &fcgiConn{conn: conn, requests: make(map[uint16]*fcgiRequest)}
+	go c.readLoop(reader)
+	return c
+}
+
+func (c *fcgiConn) readLoop(reader *bufio.Reader) {
+	for {
+		rec, err := readRecord(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		req := c.requests[rec.requestID]
+		c.mu.Unlock()
+		if req == nil {
+			continue
+		}
+
+		switch rec.recType {
+		case fcgiStdout:
+			// The output is kept in memory, the request ends once it exceeds the limit.
+			if req.stdout.Len()+len(rec.content) > maxProxyBodyBytes {
+				c.mu.Lock()
+				if c.requests[rec.requestID] == req {
+					req.err = fmt.Errorf("output exceeded %d bytes: %w", maxProxyBodyBytes, errPayloadTooLarge)
+					c.finish(rec.requestID, req)
+				}
+				c.mu.Unlock()
+				continue
+			}
+			req.stdout.Write(rec.content)
+		case fcgiStderr:
+			req.stderr.Write(rec.content)
+		case fcgiEndRequest:
+			c.mu.Lock()
+			// The request can have been ended by fail() or aborted in the meantime.
+			if c.requests[rec.requestID] == req {
+				if len(rec.content) >= 5 {
+					req.appStatus = binary.BigEndian.Uint32(rec.content[:4])
+					req.protocolStatus = rec.content[4]
+				}
+				c.finish(rec.requestID, req)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// finish removes the request id and closes its done channel, c.mu must be held.
+// Only the caller that removes the request closes the channel, so it is closed once.
+func (c *fcgiConn) finish(id uint16, req *fcgiRequest) {
+	if c.requests[id] != req {
+		return
+	}
+	delete(c.requests, id)
+	close(req.done)
+}
+
+// fail ends every request in progress with err, the connection cannot be used anymore.
+func (c *fcgiConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for id, req := range c.requests {
+		req.err = err
+		c.finish(id, req)
+	}
+	c.conn.Close()
+}
+
+func (c *fcgiConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// start registers a new request, and returns its ID.
+func (c *fcgiConn) start(script string) (uint16, *fcgiRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+
+	for {
+		c.nextID++
+		if _, used := c.requests[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+
+	req := &fcgiRequest{stderr: &cgiStderr{script: script}, done: make(chan struct{})}
+	c.requests[c.nextID] = req
+	return c.nextID, req, nil
+}
+
+// abort stops waiting for the request id, and asks the application to abort it.
+func (c *fcgiConn) abort(id uint16) {
+	c.mu.Lock()
+	delete(c.requests, id)
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeRecord(c.conn, fcgiAbortRequest, id, nil)
+}
+
+// fcgiClient sends requests to a FastCGI application. Connections are kept open and reused,
+// if the application multiplexes requests they all share a single connection.
+type fcgiClient struct {
+	network string
+	address string
+
+	mu sync.Mutex
+
+	// Nil until the first connection asks the application if it multiplexes requests.
+	mpxs *bool
+
+	// The connection shared by all the requests, if the application multiplexes them.
+	shared *fcgiConn
+
+	idle []*fcgiConn
+}
+
+// newFcgiClient returns a client for address, that is "unix:/path/to/socket" or "host:port".
+func newFcgiClient(address string) (*fcgiClient, error) {
+	if socket, ok := strings.CutPrefix(address, "unix:"); ok {
+		if socket == "" {
+			return nil, fmt.Errorf("newFcgiClient(): empty unix socket path")
+		}
+		return &fcgiClient{network: "unix", address: socket}, nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("newFcgiClient(): %w", err)
+	}
+	return &fcgiClient{network: "tcp", address: address}, nil
+}
+
+// get returns a connection for a new request, reused reports whether it was already open.
+func (fc *fcgiClient) get(timeout time.Duration) (c *fcgiConn, reused bool, err error) {
+	fc.mu.Lock()
+	if fc.shared != nil && !fc.shared.broken() {
+		c := fc.shared
+		fc.mu.Unlock()
+		return c, true, nil
+	}
+	for len(fc.idle) > 0 {
+		c := fc.idle[len(fc.idle)-1]
+		fc.idle = fc.idle[:len(fc.idle)-1]
+		if !c.broken() {
+			fc.mu.Unlock()
+			return c, true, nil
+		}
+	}
+	fc.mu.Unlock()
+
+	c, err = fc.dial(timeout)
+	return c, false, err
+}
+
+// put returns a connection to the pool when its request has ended.
+func (fc *fcgiClient) put(c *fcgiConn) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if c.broken() || c == fc.shared {
+		return
+	}
+	if len(fc.idle) < maxIdlePerUpstream {
+		fc.idle = append(fc.idle, c)
+		return
+	}
+	c.conn.Close()
+}
+
+func (fc *fcgiClient) dial(timeout time.Duration) (*fcgiConn, error) {
+	conn, err := net.DialTimeout(fc.network, fc.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	fc.mu.Lock()
+	probe := fc.mpxs == nil
+	fc.mu.Unlock()
+
+	if probe {
+		mpxs, err := probeMpxs(conn, reader, timeout)
+		if err != nil {
+			// The application does not answer FCGI_GET_VALUES.
+			conn.Close()
+			if conn, err = net.DialTimeout(fc.network, fc.address, timeout); err != nil {
+				return nil, err
+			}
+			reader = bufio.NewReader(conn)
+		}
+		fc.mu.Lock()
+		fc.mpxs = &mpxs
+		fc.mu.Unlock()
+	}
+
+	c := newFcgiConn(conn, reader)
+
+	fc.mu.Lock()
+	if *fc.mpxs && (fc.shared == nil || fc.shared.broken()) {
+		fc.shared = c
+	}
+	fc.mu.Unlock()
+	return c, nil
+}
+
+// closeAll closes every connection.
+func (fc *fcgiClient) closeAll() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.shared != nil {
+		fc.shared.conn.Close()
+		fc.shared = nil
+	}
+	for _, c := range fc.idle {
+		c.conn.Close()
+	}
+	fc.idle = nil
+}
+
+// probeMpxs asks the application if it can multiplex requests on a connection.
+func probeMpxs(conn net.Conn, reader *bufio.Reader, timeout time.Duration) (bool, error) {
+	conn.SetDeadline(time.Now().Add(min(timeout, 5*time.Second)))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeRecord(conn, fcgiGetValues, 0, encodePairs([][2]string{{"FCGI_MPXS_CONNS", ""}})); err != nil {
+		return false, err
+	}
+
+	rec, err := readRecord(reader)
+	if err != nil {
+		return false, err
+	}
+	if rec.recType != fcgiGetValuesResult {
+		return false, nil
+	}
+	values, err := decodePairs(rec.content)
+	if err != nil {
+		return false, err
+	}
+	return values["FCGI_MPXS_CONNS"] == "1", nil
+}
+
+// roundTrip sends a request with method to the application and waits for its end.
+// If a pooled connection was closed by the application the request is sent again once
+// on a new connection, unless it is not retryable and it could have been run already.
+func (fc *fcgiClient) roundTrip(method string, params [][2]string, body []byte, script string, timeout time.Duration) (*fcgiRequest, error) {
+	c, reused, err := fc.get(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := fc.exchange(c, params, body, script, timeout)
+	if err != nil && reused && (req == nil || isRetryable(method) && isStaleConnError(err) && req.stdout.Len() == 0) {
+		// The application closed the idle connection before answering.
+		if c, err = fc.dial(timeout); err != nil {
+			return nil, err
+		}
+		req, err = fc.exchange(c, params, body, script, timeout)
+	}
+	fc.release(c, req, err)
+	return req, err
+}
+
+// release returns c to the pool if it can still serve requests after one that ended with err,
+// otherwise it closes c. A connection is never left open outside the pool.
+func (fc *fcgiClient) release(c *fcgiConn, req *fcgiRequest, err error) {
+	usable := err == nil
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, errPayloadTooLarge):
+		// An application that multiplexes requests keeps serving the others after the abort,
+		// the other ones could still be busy with the aborted request.
+		fc.mu.Lock()
+		usable = c == fc.shared
+		fc.mu.Unlock()
+	case err != nil && req != nil && req.err == nil:
+		// The application refused the request with FCGI_END_REQUEST.
+		usable = req.protocolStatus == fcgiOverloaded || req.protocolStatus == fcgiUnknownRole
+		if req.protocolStatus == fcgiCantMpxConn {
+			fc.mu.Lock()
+			mpxs := false
+			fc.mpxs = &mpxs
+			fc.mu.Unlock()
+		}
+	}
+
+	if usable {
+		fc.put(c)
+		return
+	}
+	c.fail(fmt.Errorf("fcgiClient.release(): connection closed after %w", err))
+}
+
+// exchange sends a request on c, req is nil if it could not be sent.
+func (fc *fcgiClient) exchange(c *fcgiConn, params [][2]string, body []byte, script string, timeout time.Duration) (*fcgiRequest, error) {
+	id, req, err := c.start(script)
+	if err != nil {
+		return nil, err
+	}
+
+	begin := []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+
+	var b bytes.Buffer
+	writeRecord(&b, fcgiBeginRequest, id, begin)
+	writeRecordStream(&b, fcgiParams, id, encodePairs(params))
+	writeRecordStream(&b, fcgiStdin, id, body)
+
+	c.wmu.Lock()
+	_, err = c.conn.Write(b.Bytes())
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-req.done:
+	case <-timer.C:
+		c.abort(id)
+		return req, os.ErrDeadlineExceeded
+	}
+
+	if errors.Is(req.err, errPayloadTooLarge) {
+		c.abort(id)
+	}
+	if req.err != nil {
+		return req, req.err
+	}
+	switch req.protocolStatus {
+	case fcgiRequestComplete:
+		return req, nil
+	case fcgiOverloaded:
+		return req, errFastCGIOverloaded
+	case fcgiCantMpxConn:
+		return req, fmt.Errorf("the application cannot multiplex requests")
+	case fcgiUnknownRole:
+		return req, fmt.Errorf("the application does not support the responder role")
+	default:
+		return req, fmt.Errorf("unknown protocol status %d", req.protocolStatus)
+	}
+}
+
+// replyToFastCGI sends request to the FastCGI application of route, with the same
+// meta-variables of a CGI script. FCGI_STDOUT is the response, FCGI_STDERR is written to the log.
+// Applications that cannot be reached are answered with 502 code, overloaded ones with 503 code.
+func replyToFastCGI(request *request, route *fastcgiRoute, config *buggyConfig) (*response, error) {
+	rawPath, query, _ := strings.Cut(request.path, "?")
+
+	p, err := cleanScriptPath(rawPath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	scriptName, pathInfo := route.script(config.baseDir, p)
+	scriptFile, err := resolvePath(config.baseDir, scriptName)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	env := cgiEnv(request, config, scriptName, scriptFile, pathInfo, query)
+	params := make([][2]string, 0, len(env))
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		// The environment of BuggyServer is not sent to other processes.
+		if name == "PATH" {
+			continue
+		}
+		params = append(params, [2]string{name, value})
+	}
+
+	timeout := config.writeTimeout
+	req, err := route.client.roundTrip(request.method, params, request.body, scriptName, timeout)
+	if err != nil {
+		if errors.Is(err, errFastCGIOverloaded) {
+			return r503(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 503 sent", request.method, request.path, err)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return r504(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 504 sent", request.method, request.path, err)
+		}
+		return r502(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 502 sent", request.method, request.path, err)
+	}
+	if req.appStatus != 0 {
+		log.Printf("error: replyToFastCGI() -> %s, %s : %s exited with status %d", request.method, request.path, scriptName, req.appStatus)
+	}
+
+	reader := bufio.NewReader(&req.stdout)
+	r, location, err := parseCGIHeaders(reader)
+	if err != nil {
+		return r502(), fmt.Errorf("replyToFastCGI() -> %s, %s : %w. 502 sent", request.method, request.path, err)
+	}
+	if location != "" && r == nil {
+		redirected := localRedirect(request, location)
+		if findFastCGIRoute(redirected, config) != nil {
+			return r500(), fmt.Errorf("replyToFastCGI() -> %s, %s : local redirect to another FastCGI path %s. 500 sent", request.method, request.path, location)
+		}
+		return reply(redirected, config)
+	}
+
+	body, _ := io.ReadAll(reader)
+	if _, ok := r.headers["content-length"]; !ok {
+		r.headers["content-length"] = []string{strconv.Itoa(len(body))}
+	}
+	if request.method == "HEAD" {
+		body = make([]byte, 0)
+	}
+	r.body = body
+	return r, nil
+}
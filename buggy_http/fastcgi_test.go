@@ -0,0 +1,465 @@
+package buggy_http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResponder is a FastCGI responder that answers with handler,
+// it multiplexes requests on a connection if mpxs is true.
+type fakeResponder struct {
+	addr  string
+	mpxs  bool
+	conns int
+	mu    sync.Mutex
+
+	// The application closes the connection without answering the request with this number.
+	requests    int
+	dropRequest int
+}
+
+// startFakeResponder starts a fake FastCGI application, handler returns the
+// FCGI_STDOUT and FCGI_STDERR content for the params and stdin of a request.
+func startFakeResponder(t *testing.T, network string, mpxs bool, handler func(params map[string]string, stdin []byte) (string, string)) *fakeResponder {
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		l, err = net.Listen("unix", filepath.Join(t.TempDir(), "fcgi.sock"))
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	fr := &fakeResponder{addr: l.Addr().String(), mpxs: mpxs}
+	if network == "unix" {
+		fr.addr = "unix:" + fr.addr
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fr.mu.Lock()
+			fr.conns++
+			fr.mu.Unlock()
+			go fr.serve(conn, handler)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeResponder) serve(conn net.Conn, handler func(params map[string]string, stdin []byte) (string, string)) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	var wmu sync.Mutex
+	write := func(recType uint8, id uint16, content []byte) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		writeRecord(conn, recType, id, content)
+	}
+
+	params := map[uint16][]byte{}
+	stdin := map[uint16][]byte{}
+	for {
+		rec, err := readRecord(reader)
+		if err != nil {
+			return
+		}
+
+		switch rec.recType {
+		case fcgiGetValues:
+			value := "0"
+			if fr.mpxs {
+				value = "1"
+			}
+			write(fcgiGetValuesResult, 0, encodePairs([][2]string{{"FCGI_MPXS_CONNS", value}}))
+		case fcgiBeginRequest:
+			params[rec.requestID] = []byte{}
+			stdin[rec.requestID] = []byte{}
+		case fcgiParams:
+			params[rec.requestID] = append(params[rec.requestID], rec.content...)
+		case fcgiStdin:
+			if len(rec.content) > 0 {
+				stdin[rec.requestID] = append(stdin[rec.requestID], rec.content...)
+				continue
+			}
+			fr.mu.Lock()
+			fr.requests++
+			drop := fr.requests == fr.dropRequest
+			fr.mu.Unlock()
+			if drop {
+				return
+			}
+
+			id := rec.requestID
+			p, _ := decodePairs(params[id])
+			body := stdin[id]
+			respond := func() {
+				stdout, stderr := handler(p, body)
+				if stderr != "" {
+					write(fcgiStderr, id, []byte(stderr))
+				}
+				write(fcgiStdout, id, []byte(stdout))
+				write(fcgiStdout, id, nil)
+				end := make([]byte, 8)
+				binary.BigEndian.PutUint32(end, 0)
+				write(fcgiEndRequest, id, end)
+			}
+			if fr.mpxs {
+				go respond()
+			} else {
+				respond()
+			}
+		}
+	}
+}
+
+func (fr *fakeResponder) connCount() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.conns
+}
+
+func (fr *fakeResponder) requestCount() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.requests
+}
+
+func newFastCGIConfig(t *testing.T, pattern, address string) *buggyConfig {
+	bs := &buggyInstance{config: &buggyConfig{baseDir: t.TempDir(), writeTimeout: 5 * time.Second}}
+	if err := bs.SetFastCGI(pattern, address); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, route := range bs.config.fastcgi {
+			route.client.closeAll()
+		}
+	})
+	return bs.config
+}
+
+func TestEncodePairs(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	pairs, err := decodePairs(encodePairs([][2]string{{"A", "1"}, {"LONG", long}, {"EMPTY", ""}}))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"A": "1", "LONG": long, "EMPTY": ""}, pairs)
+
+	_, err = decodePairs([]byte{5, 1, 'a'})
+	assert.Error(t, err)
+}
+
+func TestFastCGIRouteMatches(t *testing.T) {
+	php := &fastcgiRoute{pattern: "*.php"}
+	assert.True(t, php.matches("/index.php"))
+	assert.True(t, php.matches("/index.php/users/1"))
+	assert.False(t, php.matches("/index.html"))
+
+	app := &fastcgiRoute{pattern: "/app"}
+	assert.True(t, app.matches("/app/users"))
+	assert.False(t, app.matches("/application"))
+}
+
+func TestFastCGIRouteScript(t *testing.T) {
+	baseDir := t.TempDir()
+	os.MkdirAll(filepath.Join(baseDir, "uploads"), 0755)
+	os.WriteFile(filepath.Join(baseDir, "uploads", "a.jpg"), []byte("<?php"), 0644)
+	os.WriteFile(filepath.Join(baseDir, "app"), []byte("<?php"), 0644)
+
+	php := &fastcgiRoute{pattern: "*.php"}
+	for p, want := range map[string][2]string{
+		"/index.php":             {"/index.php", ""},
+		"/index.php/users/1":     {"/index.php", "/users/1"},
+		"/uploads/a.jpg/x.php":   {"/uploads/a.jpg/x.php", ""},
+		"/a.php/b.php/c":         {"/a.php", "/b.php/c"},
+		"/uploads/a.jpg/x.php/y": {"/uploads/a.jpg/x.php", "/y"},
+	} {
+		scriptName, pathInfo := php.script(baseDir, p)
+		assert.Equal(t, want, [2]string{scriptName, pathInfo}, p)
+	}
+
+	app := &fastcgiRoute{pattern: "/app"}
+	scriptName, pathInfo := app.script(baseDir, "/app/users/1")
+	assert.Equal(t, [2]string{"/app", "/users/1"}, [2]string{scriptName, pathInfo})
+}
+
+func TestReplyToFastCGI(t *testing.T) {
+	responder := startFakeResponder(t, "tcp", false, func(params map[string]string, stdin []byte) (string, string) {
+		switch params["SCRIPT_NAME"] {
+		case "/status.php":
+			return "Status: 404 Not Found\r\nContent-Type: text/plain\r\n\r\nmissing", ""
+		case "/local.php":
+			return "Location: /index.html\r\n\r\n", ""
+		}
+		return "Content-Type: text/plain\r\n\r\n" +
+			params["REQUEST_METHOD"] + " " + params["SCRIPT_FILENAME"] + " " + params["PATH_INFO"] + " " + params["QUERY_STRING"] + " " +
+			params["HTTP_X_CUSTOM"] + " " + string(stdin), "a warning\n"
+	})
+	config := newFastCGIConfig(t, "*.php", responder.addr)
+	os.WriteFile(filepath.Join(config.baseDir, "index.php"), []byte("<?php"), 0644)
+	os.WriteFile(filepath.Join(config.baseDir, "index.html"), []byte("<html>index</html>"), 0644)
+
+	t.Run("Params, stdin and stdout", func(t *testing.T) {
+		r, err := reply(&request{
+			method:  "POST",
+			path:    "/index.php/users?id=1",
+			proto:   "HTTP/1.1",
+			headers: map[string][]string{"x-custom": {"value"}, "content-length": {"5"}},
+			body:    []byte("hello"),
+		}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		scriptFile, _ := resolvePath(config.baseDir, "/index.php")
+		assert.Equal(t, "POST "+scriptFile+" /users id=1 value hello", string(r.body))
+		assert.Equal(t, []string{"text/plain"}, r.headers["content-type"])
+	})
+
+	t.Run("Status header", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/status.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, r.code)
+		assert.Equal(t, "missing", string(r.body))
+		assert.Equal(t, []string{"7"}, r.headers["content-length"])
+	})
+
+	t.Run("Local redirect", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/local.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, "<html>index</html>", string(r.body))
+	})
+
+	t.Run("Connections are reused", func(t *testing.T) {
+		before := responder.connCount()
+		for i := 0; i < 3; i++ {
+			r, err := reply(&request{method: "GET", path: "/index.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, r.code)
+		}
+		assert.LessOrEqual(t, responder.connCount()-before, 1)
+	})
+
+	t.Run("Uploads are not run", func(t *testing.T) {
+		os.MkdirAll(filepath.Join(config.baseDir, "uploads"), 0755)
+		os.WriteFile(filepath.Join(config.baseDir, "uploads", "a.jpg"), []byte("<?php"), 0644)
+
+		r, err := reply(&request{method: "GET", path: "/uploads/a.jpg/x.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		scriptFile, _ := resolvePath(config.baseDir, "/uploads/a.jpg/x.php")
+		assert.True(t, strings.HasPrefix(string(r.body), "GET "+scriptFile+"  "), string(r.body))
+	})
+
+	t.Run("Paths with .. segments are refused", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/uploads/%2e%2e/index.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 404, r.code)
+	})
+
+	t.Run("Other paths are not sent", func(t *testing.T) {
+		r, err := reply(&request{method: "GET", path: "/index.html", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, "<html>index</html>", string(r.body))
+	})
+}
+
+func TestReplyToFastCGIMultiplexed(t *testing.T) {
+	responder := startFakeResponder(t, "unix", true, func(params map[string]string, stdin []byte) (string, string) {
+		// Slower requests end after faster ones, on the same connection.
+		if params["QUERY_STRING"] == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return "\r\n" + params["QUERY_STRING"], ""
+	})
+	config := newFastCGIConfig(t, "/app", responder.addr)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bodies []string
+	for _, query := range []string{"slow", "a", "b", "c"} {
+		wg.Add(1)
+		go func(query string) {
+			defer wg.Done()
+			r, err := reply(&request{method: "GET", path: "/app?" + query, proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			assert.NoError(t, err)
+			mu.Lock()
+			bodies = append(bodies, string(r.body))
+			mu.Unlock()
+		}(query)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	sort.Strings(bodies)
+	assert.Equal(t, []string{"a", "b", "c", "slow"}, bodies)
+	assert.Equal(t, 1, responder.connCount())
+}
+
+func TestReplyToFastCGIStaleConnection(t *testing.T) {
+	// The application runs the second request and closes the connection without answering.
+	send := func(method string) (*response, *fakeResponder) {
+		responder := startFakeResponder(t, "tcp", false, func(params map[string]string, stdin []byte) (string, string) {
+			return "Content-Type: text/plain\r\n\r\nok", ""
+		})
+		responder.mu.Lock()
+		responder.dropRequest = 2
+		responder.mu.Unlock()
+		config := newFastCGIConfig(t, "*.php", responder.addr)
+		os.WriteFile(filepath.Join(config.baseDir, "index.php"), []byte("<?php"), 0644)
+
+		_, err := reply(&request{method: "GET", path: "/index.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		r, _ := reply(&request{method: method, path: "/index.php", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		return r, responder
+	}
+
+	t.Run("GET is sent again", func(t *testing.T) {
+		r, responder := send("GET")
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, 3, responder.requestCount())
+	})
+
+	t.Run("POST is not sent again", func(t *testing.T) {
+		r, responder := send("POST")
+		assert.Equal(t, 502, r.code)
+		assert.Equal(t, 2, responder.requestCount())
+	})
+}
+
+func TestReplyToFastCGIFailures(t *testing.T) {
+	t.Run("Unreachable application is 502", func(t *testing.T) {
+		config := newFastCGIConfig(t, "/app", closedAddr(t))
+		r, err := reply(&request{method: "GET", path: "/app", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 502, r.code)
+	})
+
+	t.Run("Invalid output is 502", func(t *testing.T) {
+		responder := startFakeResponder(t, "tcp", false, func(params map[string]string, stdin []byte) (string, string) {
+			return "no header block", ""
+		})
+		config := newFastCGIConfig(t, "/app", responder.addr)
+		r, err := reply(&request{method: "GET", path: "/app", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 502, r.code)
+	})
+
+	t.Run("Slow application is 504", func(t *testing.T) {
+		responder := startFakeResponder(t, "tcp", false, func(params map[string]string, stdin []byte) (string, string) {
+			time.Sleep(time.Second)
+			return "\r\n", ""
+		})
+		config := newFastCGIConfig(t, "/app", responder.addr)
+		config.writeTimeout = 100 * time.Millisecond
+		r, err := reply(&request{method: "GET", path: "/app", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 504, r.code)
+	})
+}
+
+func TestFcgiClientRelease(t *testing.T) {
+	newConn := func() (*fcgiConn, net.Conn) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+		return newFcgiConn(client, bufio.NewReader(client)), server
+	}
+
+	t.Run("Ended requests return the connection", func(t *testing.T) {
+		fc := &fcgiClient{}
+		c, _ := newConn()
+		fc.release(c, &fcgiRequest{}, nil)
+		assert.Equal(t, []*fcgiConn{c}, fc.idle)
+
+		c, _ = newConn()
+		fc.release(c, &fcgiRequest{protocolStatus: fcgiOverloaded}, errFastCGIOverloaded)
+		assert.Len(t, fc.idle, 2)
+		assert.False(t, c.broken())
+	})
+
+	t.Run("Failed requests close the connection", func(t *testing.T) {
+		fc := &fcgiClient{}
+		for _, failure := range []struct {
+			req *fcgiRequest
+			err error
+		}{
+			{&fcgiRequest{}, os.ErrDeadlineExceeded},
+			{&fcgiRequest{err: io.ErrUnexpectedEOF}, io.ErrUnexpectedEOF},
+			{&fcgiRequest{protocolStatus: fcgiCantMpxConn}, errors.New("the application cannot multiplex requests")},
+			{nil, io.ErrClosedPipe},
+		} {
+			c, server := newConn()
+			fc.release(c, failure.req, failure.err)
+			assert.True(t, c.broken(), failure.err.Error())
+
+			// The read loop has ended and the application sees the connection closed.
+			_, err := server.Read(make([]byte, 1))
+			assert.Error(t, err)
+		}
+		assert.Empty(t, fc.idle)
+		assert.False(t, *fc.mpxs)
+	})
+
+	t.Run("Timeouts keep the shared connection", func(t *testing.T) {
+		c, _ := newConn()
+		fc := &fcgiClient{shared: c}
+		fc.release(c, &fcgiRequest{}, os.ErrDeadlineExceeded)
+		assert.False(t, c.broken())
+	})
+}
+
+func TestFcgiConnEndAndFailure(t *testing.T) {
+	// The end of a request and the failure of its connection race to close done.
+	for i := 0; i < 200; i++ {
+		client, server := net.Pipe()
+		c := newFcgiConn(client, bufio.NewReader(client))
+		id, req, err := c.start("race")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go writeRecord(server, fcgiEndRequest, id, make([]byte, 8))
+		c.fail(errors.New("connection lost"))
+		<-req.done
+		server.Close()
+	}
+}
+
+func TestFcgiConnOutputLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newFcgiConn(client, bufio.NewReader(client))
+	id, req, err := c.start("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		chunk := make([]byte, 65535)
+		for written := 0; written <= maxProxyBodyBytes; written += len(chunk) {
+			if err := writeRecord(server, fcgiStdout, id, chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	<-req.done
+	assert.ErrorIs(t, req.err, errPayloadTooLarge)
+	assert.LessOrEqual(t, req.stdout.Len(), maxProxyBodyBytes)
+	assert.False(t, c.broken())
+}
@@ -0,0 +1,273 @@
+package buggy_http
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswd holds the password hashes of the users of an Apache htpasswd file.
+// See https://httpd.apache.org/docs/current/misc/password_encryptions.html
+type htpasswd map[string]string
+
+// loadHtpasswd reads the htpasswd file at path, with a "user:hash" line per user.
+// Empty lines and lines starting with '#' are skipped. The supported hashes are
+// bcrypt ($2y$, htpasswd -B), SHA-256 and SHA-512 crypt ($5$ and $6$, like mkpasswd -m sha-512)
+// and SHA-1 ({SHA}, htpasswd -s). Any other hash is an error.
+func loadHtpasswd(path string) (htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadHtpasswd(): %w", err)
+	}
+	defer file.Close()
+
+	users := make(htpasswd)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("loadHtpasswd(): %s:%d: expected USER:HASH", path, n)
+		}
+		if err := checkPasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("loadHtpasswd(): %s:%d: user %q: %w", path, n, user, err)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("loadHtpasswd(): %s:%d: user %q is repeated", path, n, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loadHtpasswd(): %s: %w", path, err)
+	}
+	return users, nil
+}
+
+// checkPasswordHash returns an error if hash is not in a supported format.
+func checkPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return checkBcrypt(hash)
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		_, err := parseSHACrypt(hash)
+		return err
+	case strings.HasPrefix(hash, "{SHA}"):
+		if sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):]); err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("malformed {SHA} hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		return fmt.Errorf("MD5 hashes are not supported, use bcrypt (htpasswd -B)")
+	}
+	return fmt.Errorf("unsupported password hash, use bcrypt (htpasswd -B)")
+}
+
+// verifyPassword reports whether password matches hash, that has been checked with checkPasswordHash.
+// The hashes are compared in constant time.
+func verifyPassword(hash string, password string) bool {
+	var sum, expected string
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		// bcrypt compares the hashes in constant time.
+		return checkBcrypt(hash) == nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		h, err := parseSHACrypt(hash)
+		if err != nil {
+			return false
+		}
+		sum, expected = shaCrypt(h.is512, []byte(password), []byte(h.salt), h.rounds), h.sum
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		digest := sha1.Sum([]byte(password))
+		sum, expected = base64.StdEncoding.EncodeToString(digest[:]), hash[len("{SHA}"):]
+
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(expected)) == 1
+}
+
+// maxBcryptCost is the highest bcrypt cost accepted. Every failed login computes a hash,
+// and a cost of 12 already takes a quarter of a second.
+const maxBcryptCost = 12
+
+// checkBcrypt returns an error if hash is not a $2a$, $2b$ or $2y$ hash, as written by
+// htpasswd -B, or if its cost is higher than maxBcryptCost.
+func checkBcrypt(hash string) error {
+	if len(hash) < 4 || hash[3] != '$' || (hash[2] != 'a' && hash[2] != 'b' && hash[2] != 'y') {
+		return fmt.Errorf("unsupported bcrypt version %q", hash[:min(len(hash), 4)])
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return fmt.Errorf("malformed bcrypt hash: %w", err)
+	}
+	if cost > maxBcryptCost {
+		return fmt.Errorf("bcrypt cost %d is higher than %d", cost, maxBcryptCost)
+	}
+	return nil
+}
+
+// SHA-crypt, the $5$ and $6$ hashes of glibc.
+// See https://www.akkadia.org/drepper/SHA-crypt.txt
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+// shaCryptHash is a parsed $5$ or $6$ hash.
+type shaCryptHash struct {
+	is512  bool
+	rounds int
+	salt   string
+
+	// The encoded hash, after the last '$'.
+	sum string
+}
+
+// parseSHACrypt parses a hash in the form $5$[rounds=N$]SALT$HASH, or the same with $6$.
+func parseSHACrypt(hash string) (*shaCryptHash, error) {
+	h := &shaCryptHash{is512: hash[1] == '6', rounds: shaCryptDefaultRounds}
+	sumLen := 43
+	if h.is512 {
+		sumLen = 86
+	}
+
+	rest := hash[3:]
+	if value, after, ok := strings.Cut(rest, "$"); ok && strings.HasPrefix(value, "rounds=") {
+		rounds, err := strconv.Atoi(value[len("rounds="):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHA-crypt %q", value)
+		}
+		h.rounds = min(max(rounds, shaCryptMinRounds), shaCryptMaxRounds)
+		rest = after
+	}
+
+	salt, sum, ok := strings.Cut(rest, "$")
+	if !ok || len(sum) != sumLen || len(salt) > shaCryptMaxSalt {
+		return nil, fmt.Errorf("malformed SHA-crypt hash")
+	}
+	h.salt, h.sum = salt, sum
+	return h, nil
+}
+
+// shaCrypt returns the encoded SHA-256 crypt hash of password, or SHA-512 if is512 is true.
+func shaCrypt(is512 bool, password []byte, salt []byte, rounds int) string {
+	newHash, order := sha256.New, shaCrypt256Order
+	if is512 {
+		newHash, order = sha512.New, shaCrypt512Order
+	}
+	size := newHash().Size()
+
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	h = newHash()
+	h.Write(password)
+	h.Write(salt)
+	for n := len(password); n > 0; n -= size {
+		h.Write(b[:min(n, size)])
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range password {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	// The bytes are encoded in groups of three, in the order of the specification,
+	// the last group has the remaining bytes.
+	const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(w uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(alphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, g := range order {
+		encode(uint32(c[g[0]])<<16|uint32(c[g[1]])<<8|uint32(c[g[2]]), 4)
+	}
+	if is512 {
+		encode(uint32(c[63]), 2)
+	} else {
+		encode(uint32(c[31])<<8|uint32(c[30]), 3)
+	}
+	return out.String()
+}
+
+// repeatBytes returns n bytes with b repeated.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = b[i%len(b)]
+	}
+	return out
+}
+
+var shaCrypt256Order = [][3]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+}
+
+var shaCrypt512Order = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
@@ -0,0 +1,100 @@
+package buggy_http
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	// Hashes written by crypt(3) and htpasswd.
+	hashes := []struct {
+		name     string
+		password string
+		hash     string
+	}{
+		{"bcrypt $2y$", "secret", "$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW"},
+		{"bcrypt cost 5", "correct horse", "$2y$05$0123456789abcdefghijkeG78L3vLTCzcDmjO6hy3HNyZ.BRZcmKG"},
+		{"bcrypt empty password", "", "$2a$04$abcdefghijklmnopqrstuubyCG3zY1GIXMyxfivm.ClDiInHzxjiq"},
+		{"SHA-256 crypt", "secret", "$5$abcdefgh$gruCpC7VkOTspMQTTSAR8mtlO9Upms.fwqE5y16JVM."},
+		{"SHA-256 crypt with rounds", "secret", "$5$rounds=1200$saltsaltsaltsalt$D0iBx.LJn5WaCox0iKYs5TOzZTDsX7gannx3aYLUiU1"},
+		{"SHA-512 crypt", "secret", "$6$abcdefgh$ltjgWl6579NluT/Vi1nwEvcil.G5Nbc4NiXZaNGStk8PSwGfQv72N2CKPPrVACtLtip/cZ/1GM/O6IND4WQhG."},
+		{"SHA-512 crypt UTF-8", "pässwörd", "$6$rounds=2000$xyz$XXMEFG18HhZnhTB.fxidz2O5hf47HePAAvq4H8S/qyMX8oAuDXr7IAdyP.D.PSp1W7IWtbK4vGyW9A1ioRaOp/"},
+		{"SHA-1", "secret", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+	}
+
+	for _, h := range hashes {
+		t.Run(h.name, func(t *testing.T) {
+			assert.NoError(t, checkPasswordHash(h.hash))
+			assert.True(t, verifyPassword(h.hash, h.password))
+			assert.False(t, verifyPassword(h.hash, h.password+"x"))
+			assert.False(t, verifyPassword(h.hash, strings.ToUpper(h.password)+"!"))
+		})
+	}
+
+	t.Run("bcrypt uses the first 72 bytes", func(t *testing.T) {
+		hash := "$2b$04$abcdefghijklmnopqrstuuBzzIgyKkz7xMWYSzkIjUSnxEQFQ0WNe"
+		assert.True(t, verifyPassword(hash, strings.Repeat("a", 72)))
+		assert.True(t, verifyPassword(hash, strings.Repeat("a", 80)))
+		assert.False(t, verifyPassword(hash, strings.Repeat("a", 71)))
+	})
+
+	t.Run("Unsupported hashes", func(t *testing.T) {
+		for _, hash := range []string{
+			"$apr1$abcdefgh$0123456789abcdefghijkl",
+			"secret",
+			"$2x$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW",
+			"$2y$03$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW",
+			"$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdne",
+			"$2y$13$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW",
+			"$2y$31$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW",
+			"$5$abcdefgh$short",
+			"$6$rounds=many$abcdefgh$ltjgWl6579NluT/Vi1nwEvcil.G5Nbc4NiXZaNGStk8PSwGfQv72N2CKPPrVACtLtip/cZ/1GM/O6IND4WQhG.",
+			"{SHA}not base64",
+		} {
+			assert.Error(t, checkPasswordHash(hash), hash)
+			assert.False(t, verifyPassword(hash, "secret"), hash)
+		}
+	})
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "htpasswd")
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("Valid file", func(t *testing.T) {
+		users, err := loadHtpasswd(write("# users\n\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\r\nbob:$2y$04$abcdefghijklmnopqrstuu2r9OfJnfCsdneAXAGHnS4UpFFP8WIrW\n"))
+		assert.NoError(t, err)
+		assert.Len(t, users, 2)
+		assert.Equal(t, "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", users["alice"])
+	})
+
+	t.Run("Line without hash", func(t *testing.T) {
+		_, err := loadHtpasswd(write("alice\n"))
+		assert.ErrorContains(t, err, "htpasswd:1: expected USER:HASH")
+	})
+
+	t.Run("Unsupported hash", func(t *testing.T) {
+		_, err := loadHtpasswd(write("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:$apr1$abcdefgh$0123456789abcdefghijkl\n"))
+		assert.ErrorContains(t, err, `htpasswd:2: user "bob": MD5 hashes are not supported`)
+	})
+
+	t.Run("Repeated user", func(t *testing.T) {
+		_, err := loadHtpasswd(write("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+		assert.ErrorContains(t, err, `user "alice" is repeated`)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := loadHtpasswd(filepath.Join(dir, "missing"))
+		assert.Error(t, err)
+	})
+}
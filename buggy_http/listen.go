@@ -0,0 +1,242 @@
+package buggy_http
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// listen opens the listeners of address, that is one of:
+//
+//	host:port     a TCP socket
+//	unix:/path    a Unix domain socket
+//	systemd       every socket passed by systemd socket activation
+//	systemd:NAME  the sockets passed by systemd with FileDescriptorName=NAME
+func (bs *buggyInstance) listen(address string) ([]net.Listener, error) {
+	if socket, ok := strings.CutPrefix(address, "unix:"); ok {
+		uid, gid, err := lookupOwner(bs.config.socketOwner)
+		if err != nil {
+			return nil, fmt.Errorf("listen(): %w", err)
+		}
+		l, err := listenUnix(socket, bs.config.socketMode, uid, gid)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	if address == "systemd" || strings.HasPrefix(address, "systemd:") {
+		return systemdListeners(strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":"), listenFdsStart)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen(): %w", err)
+	}
+	return []net.Listener{l}, nil
+}
+
+// listenUnix listens on the Unix domain socket at path. A socket left at path by a process
+// that is no longer running is removed first. If mode is not zero it is set as the permissions
+// of the socket, uid and gid, unless they are -1, as its owner.
+func listenUnix(path string, mode os.FileMode, uid int, gid int) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, fmt.Errorf("listenUnix(): %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen(): %w", err)
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listenUnix(): %w", err)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listenUnix(): %w", err)
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path if no process accepts connections on it.
+// It returns an error if path is not a socket, or is in use.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListeners returns the listeners passed by systemd socket activation, from the
+// file descriptor first on. If name is not empty only the ones named name in LISTEN_FDNAMES.
+func systemdListeners(name string, first int) ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("systemdListeners(): no socket has been passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("systemdListeners(): invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fdName := "LISTEN_FD_" + strconv.Itoa(first+i)
+		if i < len(names) && names[i] != "" {
+			fdName = names[i]
+		}
+		if name != "" && fdName != name {
+			continue
+		}
+
+		// FileListener duplicates the descriptor, the one passed by systemd is not needed anymore.
+		file := os.NewFile(uintptr(first+i), fdName)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("systemdListeners(): %s: %w", fdName, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("systemdListeners(): no socket named %q has been passed by systemd", name)
+	}
+	return listeners, nil
+}
+
+// lookupOwner returns the uid and gid of owner, that is "user", ":group" or "user:group".
+// Users and groups are names or numeric ids, -1 means the one that is missing, both are -1 for an empty owner.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	if userName != "" {
+		id := userName
+		if u, err := user.Lookup(userName); err == nil {
+			id = u.Uid
+		}
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unknown user %q", userName)
+		}
+		uid = n
+	}
+
+	if groupName != "" {
+		id := groupName
+		if g, err := user.LookupGroup(groupName); err == nil {
+			id = g.Gid
+		}
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return -1, -1, fmt.Errorf("unknown group %q", groupName)
+		}
+		gid = n
+	}
+
+	return uid, gid, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// multiListener accepts the connections of several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.acceptFrom(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) acceptFrom(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case ml.accepted <- acceptResult{conn, err}:
+		case <-ml.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// Accept waits for the next connection of any listener.
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.conn, r.err
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every listener.
+func (ml *multiListener) Close() error {
+	var errs []error
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+		for _, l := range ml.listeners {
+			if err := l.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
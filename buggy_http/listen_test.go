@@ -0,0 +1,129 @@
+package buggy_http
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// socketDir returns a short temporary directory, Unix socket paths are limited to about 100 bytes.
+func socketDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "bs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// getIndex requests /index.html on a new connection to address of network.
+func getIndex(t *testing.T, network string, address string) string {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(socketDir(t), "bs.sock")
+
+	t.Run("Stale socket is removed", func(t *testing.T) {
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		l, err = listenUnix(socket, 0600, -1, -1)
+		assert.NoError(t, err)
+		defer l.Close()
+
+		info, err := os.Stat(socket)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		t.Run("Socket in use is an error", func(t *testing.T) {
+			_, err := listenUnix(socket, 0, -1, -1)
+			assert.ErrorContains(t, err, "in use")
+		})
+	})
+
+	t.Run("Other files are not removed", func(t *testing.T) {
+		file := filepath.Join(filepath.Dir(socket), "file")
+		os.WriteFile(file, []byte("x"), 0644)
+		_, err := listenUnix(file, 0, -1, -1)
+		assert.ErrorContains(t, err, "is not a socket")
+	})
+}
+
+func TestStartBuggyServerOn(t *testing.T) {
+	bs := newTestInstance(t)
+	assert.NoError(t, bs.SetUnixSocket(0660, ""))
+	socket := filepath.Join(socketDir(t), "bs.sock")
+
+	assert.NoError(t, bs.StartBuggyServerOn("127.0.0.1:0", "unix:"+socket))
+	defer bs.StopBuggyServer()
+
+	ml := bs.listener.(*multiListener)
+	assert.Len(t, ml.listeners, 2)
+
+	assert.Contains(t, getIndex(t, "tcp", ml.listeners[0].Addr().String()), "<html>index</html>")
+	assert.Contains(t, getIndex(t, "unix", socket), "<html>index</html>")
+
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	t.Run("Nothing is started if an address fails", func(t *testing.T) {
+		other := newTestInstance(t)
+		err := other.StartBuggyServerOn("127.0.0.1:0", "unix:"+socket)
+		assert.ErrorContains(t, err, "in use")
+		assert.Nil(t, other.listener)
+	})
+
+	t.Run("Socket is removed on stop", func(t *testing.T) {
+		assert.NoError(t, bs.StopBuggyServer())
+		_, err := os.Stat(socket)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{-1, -1}, []int{uid, gid})
+
+	uid, gid, err = lookupOwner("1000:1001")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000, 1001}, []int{uid, gid})
+
+	uid, gid, err = lookupOwner(":1001")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{-1, 1001}, []int{uid, gid})
+
+	_, _, err = lookupOwner("no-such-user-bs")
+	assert.ErrorContains(t, err, "unknown user")
+}
+
+func TestConfigAddresses(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, []string{"0.0.0.0:8080"}, cfg.Addresses())
+
+	cfg.Listen = []string{"unix:/run/bs.sock", "systemd"}
+	assert.Equal(t, []string{"unix:/run/bs.sock", "systemd"}, cfg.Addresses())
+}
@@ -0,0 +1,65 @@
+//go:build unix
+
+package buggy_http
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// systemdListeners closes the descriptors it is given, they cannot be owned by an *os.File
+	// whose finalizer would close them again.
+	passFd := func() int {
+		fd, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fd
+	}
+
+	t.Run("Error without LISTEN_PID", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "1")
+		t.Setenv("LISTEN_FDS", "1")
+		fd := passFd()
+		defer syscall.Close(fd)
+		_, err := systemdListeners("", fd)
+		assert.Error(t, err)
+	})
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "web")
+
+	t.Run("Error for an unknown name", func(t *testing.T) {
+		fd := passFd()
+		defer syscall.Close(fd)
+		_, err := systemdListeners("admin", fd)
+		assert.ErrorContains(t, err, `no socket named "admin"`)
+	})
+
+	t.Run("Named socket", func(t *testing.T) {
+		listeners, err := systemdListeners("web", passFd())
+		assert.NoError(t, err)
+		if assert.Len(t, listeners, 1) {
+			assert.Equal(t, l.Addr().String(), listeners[0].Addr().String())
+			listeners[0].Close()
+		}
+	})
+}
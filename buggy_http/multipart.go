@@ -0,0 +1,247 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// errPartTooLarge is returned when a part of a multipart body exceeds the maximum size.
+var errPartTooLarge = fmt.Errorf("multipart part too large: %w", errPayloadTooLarge)
+
+// multipartReader reads the parts of a multipart/form-data body one at a time,
+// without buffering a whole part in memory.
+// See https://www.rfc-editor.org/rfc/rfc7578 and https://www.rfc-editor.org/rfc/rfc2046#section-5.1
+type multipartReader struct {
+	r *bufio.Reader
+
+	// "--" + boundary, the line that starts every part.
+	dashBoundary []byte
+
+	// CRLF + dashBoundary, it ends the content of every part.
+	delimiter []byte
+
+	// The maximum size in bytes of the content of every part, zero or negative means no limit.
+	maxPartBytes int64
+
+	current *multipartPart
+	started bool
+	done    bool
+}
+
+// multipartPart is a part of a multipart body, its content is read with Read.
+type multipartPart struct {
+	headers map[string][]string
+
+	// The name of the form field, and the name of the uploaded file if the part is a file.
+	name     string
+	filename string
+
+	mr *multipartReader
+
+	// The maximum size in bytes of the content, zero or negative means no limit.
+	limit int64
+
+	read int64
+	eof  bool
+}
+
+// newMultipartReader returns a multipartReader for a body with the given content-type.
+func newMultipartReader(body io.Reader, contentType string, maxPartBytes int64) (*multipartReader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("newMultipartReader(): %w", err)
+	}
+	if mediaType != "multipart/form-data" {
+		return nil, fmt.Errorf("newMultipartReader(): unsupported media type %q", mediaType)
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" || len(boundary) > 70 {
+		return nil, fmt.Errorf("newMultipartReader(): invalid boundary %q", boundary)
+	}
+
+	return &multipartReader{
+		r:            bufio.NewReader(body),
+		dashBoundary: []byte("--" + boundary),
+		delimiter:    []byte("\r\n--" + boundary),
+		maxPartBytes: maxPartBytes,
+	}, nil
+}
+
+// NextPart returns the next part of the body, or io.EOF after the last one.
+// The content of the previous part that has not been read is discarded.
+func (mr *multipartReader) NextPart() (*multipartPart, error) {
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	if !mr.started {
+		if err := mr.skipPreamble(); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("NextPart(): %w", err)
+		}
+		mr.started = true
+
+	} else {
+		if mr.current != nil && !mr.current.eof {
+			// The size limit does not apply to discarded content.
+			mr.current.limit = 0
+			if _, err := io.Copy(io.Discard, mr.current); err != nil {
+				return nil, fmt.Errorf("NextPart(): %w", err)
+			}
+		}
+
+		if _, err := mr.r.Discard(len(mr.delimiter)); err != nil {
+			return nil, fmt.Errorf("NextPart(): %w", io.ErrUnexpectedEOF)
+		}
+
+		last, err := mr.readBoundaryEnd()
+		if err != nil {
+			return nil, fmt.Errorf("NextPart(): %w", err)
+		}
+		if last {
+			mr.done = true
+			return nil, io.EOF
+		}
+	}
+
+	part, err := mr.readPartHeaders()
+	if err != nil {
+		return nil, fmt.Errorf("NextPart(): %w", err)
+	}
+
+	mr.current = part
+	return part, nil
+}
+
+// skipPreamble discards everything before the first boundary line.
+func (mr *multipartReader) skipPreamble() error {
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// A line longer than the buffer cannot be a boundary line.
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		line = bytes.TrimRight(line, " \t\r\n")
+		if bytes.Equal(line, mr.dashBoundary) {
+			return nil
+		}
+		if string(line) == string(mr.dashBoundary)+"--" {
+			mr.done = true
+			return io.EOF
+		}
+	}
+}
+
+// readBoundaryEnd reads what follows a boundary, and reports if it was the close delimiter.
+func (mr *multipartReader) readBoundaryEnd() (bool, error) {
+	line, err := mr.r.ReadSlice('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && bytes.HasPrefix(line, []byte("--"))) {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	if bytes.HasPrefix(line, []byte("--")) {
+		return true, nil
+	}
+
+	// Only transport padding can follow a boundary.
+	if len(bytes.TrimRight(line, " \t\r\n")) != 0 {
+		return false, fmt.Errorf("readBoundaryEnd(): invalid boundary line")
+	}
+	return false, nil
+}
+
+func (mr *multipartReader) readPartHeaders() (*multipartPart, error) {
+	part := &multipartPart{
+		headers: make(map[string][]string),
+		mr:      mr,
+		limit:   mr.maxPartBytes,
+	}
+
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, fmt.Errorf("readPartHeaders(): header line exceeded max size")
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		l := strings.TrimSpace(string(line))
+		if l == "" {
+			break
+		}
+
+		// Values are not split on commas, a quoted filename can contain them.
+		name, value, ok := strings.Cut(l, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("readPartHeaders(): invalid header line: %q", l)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		part.headers[name] = append(part.headers[name], strings.TrimSpace(value))
+	}
+
+	if values, ok := part.headers["content-disposition"]; ok {
+		disposition, params, err := mime.ParseMediaType(values[0])
+		if err == nil && disposition == "form-data" {
+			part.name = params["name"]
+			part.filename = params["filename"]
+		}
+	}
+
+	return part, nil
+}
+
+// Read reads the content of the part, it returns io.EOF at the delimiter that ends it.
+func (p *multipartPart) Read(b []byte) (int, error) {
+	if p.eof {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	r := p.mr.r
+	delimiter := p.mr.delimiter
+
+	// The delimiter always follows the content, so at least its length can be read.
+	if _, err := r.Peek(len(delimiter)); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	peek, _ := r.Peek(r.Buffered())
+
+	n := 0
+	if i := bytes.Index(peek, delimiter); i >= 0 {
+		if i == 0 {
+			p.eof = true
+			return 0, io.EOF
+		}
+		n = min(len(b), i)
+	} else {
+		// The end of the buffer could be the beginning of the delimiter.
+		n = min(len(b), len(peek)-len(delimiter)+1)
+	}
+
+	if p.limit > 0 && p.read+int64(n) > p.limit {
+		return 0, errPartTooLarge
+	}
+
+	n = copy(b, peek[:n])
+	r.Discard(n)
+	p.read += int64(n)
+	return n, nil
+}
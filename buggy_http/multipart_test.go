@@ -0,0 +1,102 @@
+package buggy_http
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMultipartBody = "preamble\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"file\"; filename=\"a, b.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"line one\r\n--not the boundary\r\nline two\r\n" +
+	"--XyZ\r\n" +
+	"Content-Disposition: form-data; name=\"empty\"; filename=\"empty.txt\"\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"--XyZ--\r\n" +
+	"epilogue"
+
+func TestMultipartReader(t *testing.T) {
+	t.Run("Read all parts", func(t *testing.T) {
+		mr, err := newMultipartReader(strings.NewReader(testMultipartBody), "multipart/form-data; boundary=XyZ", 0)
+		assert.NoError(t, err)
+
+		part, err := mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "title", part.name)
+		assert.Equal(t, "", part.filename)
+		content, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+
+		part, err = mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "file", part.name)
+		assert.Equal(t, "a, b.txt", part.filename)
+		assert.Equal(t, []string{"text/plain"}, part.headers["content-type"])
+		content, err = io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, "line one\r\n--not the boundary\r\nline two", string(content))
+
+		part, err = mr.NextPart()
+		assert.NoError(t, err)
+		content, err = io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Empty(t, content)
+
+		_, err = mr.NextPart()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("Unread parts are skipped", func(t *testing.T) {
+		mr, _ := newMultipartReader(strings.NewReader(testMultipartBody), "multipart/form-data; boundary=XyZ", 1)
+
+		names := []string{}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			names = append(names, part.name)
+		}
+		assert.Equal(t, []string{"title", "file", "empty"}, names)
+	})
+
+	t.Run("Part larger than the limit", func(t *testing.T) {
+		mr, _ := newMultipartReader(strings.NewReader(testMultipartBody), "multipart/form-data; boundary=XyZ", 4)
+
+		part, _ := mr.NextPart()
+		_, err := io.ReadAll(part)
+		assert.True(t, errors.Is(err, errPartTooLarge))
+		assert.True(t, errors.Is(err, errPayloadTooLarge))
+	})
+
+	t.Run("Missing close delimiter", func(t *testing.T) {
+		body := "--XyZ\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\ntruncated"
+		mr, _ := newMultipartReader(strings.NewReader(body), "multipart/form-data; boundary=XyZ", 0)
+
+		part, err := mr.NextPart()
+		assert.NoError(t, err)
+		_, err = io.ReadAll(part)
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	})
+
+	t.Run("Invalid content-type", func(t *testing.T) {
+		_, err := newMultipartReader(strings.NewReader(""), "text/plain", 0)
+		assert.Error(t, err)
+
+		_, err = newMultipartReader(strings.NewReader(""), "multipart/form-data", 0)
+		assert.Error(t, err)
+	})
+}
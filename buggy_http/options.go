@@ -0,0 +1,343 @@
+package buggy_http
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Option configures a BuggyServer created with New.
+// Durations and sizes are exact, a zero value disables the timeout or the limit
+// and a negative one is an error.
+type Option func(bs *buggyInstance) error
+
+// New creates a BuggyServer with the defaults of NewBuggyServer, then applies opts in order.
+// All the options are validated, the errors of the invalid ones are returned together.
+// The setters of the returned BuggyServer can still be used until it is started.
+func New(opts ...Option) (BuggyServer, error) {
+	bs := NewBuggyServer().(*buggyInstance)
+
+	var errs []error
+	for _, opt := range opts {
+		if err := opt(bs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("New(): %w", errors.Join(errs...))
+	}
+	return bs, nil
+}
+
+// checkDuration returns an error if d is negative.
+func checkDuration(name string, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("%s(): negative duration %s", name, d)
+	}
+	return nil
+}
+
+// checkSize returns an error if size is negative.
+func checkSize(name string, size int) error {
+	if size < 0 {
+		return fmt.Errorf("%s(): negative size %d", name, size)
+	}
+	return nil
+}
+
+// WithBaseDir set the directory from which static files will be served.
+func WithBaseDir(dir string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetBaseDir(dir)
+	}
+}
+
+// WithReadTimeout set the maximum duration for reading the entire request from the
+// underling connection. If it is exceeded server respond with 408 code. Zero means no timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkDuration("WithReadTimeout", d); err != nil {
+			return err
+		}
+		if d == 0 {
+			d = noTimeout
+		}
+		bs.config.readTimeout = d
+		return nil
+	}
+}
+
+// WithWriteTimeout set the maximum duration the server has to respond.
+// If it is exceeded server respond with 500 code. Zero means no timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkDuration("WithWriteTimeout", d); err != nil {
+			return err
+		}
+		if d == 0 {
+			d = noTimeout
+		}
+		bs.config.writeTimeout = d
+		return nil
+	}
+}
+
+// WithMaxRequestSize set the maximum size in bytes of a request. Zero means no limit.
+func WithMaxRequestSize(bytes int) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkSize("WithMaxRequestSize", bytes); err != nil {
+			return err
+		}
+		bs.config.maxRequestBytes = bytes
+		return nil
+	}
+}
+
+// WithMaxHeaderSize set the maximum size in bytes of the request line and header section.
+// If it is exceeded server respond with 431 code. Zero means no limit.
+func WithMaxHeaderSize(bytes int) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkSize("WithMaxHeaderSize", bytes); err != nil {
+			return err
+		}
+		bs.config.maxHeaderBytes = bytes
+		return nil
+	}
+}
+
+// WithMaxBodySize set the maximum size in bytes of a request body.
+// If it is exceeded server respond with 413 code. Zero means no limit.
+func WithMaxBodySize(bytes int) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkSize("WithMaxBodySize", bytes); err != nil {
+			return err
+		}
+		bs.config.maxBodyBytes = bytes
+		return nil
+	}
+}
+
+// WithErrorPage serves the page at path, relative to the base directory, for the responses with code.
+func WithErrorPage(code int, path string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetErrorPage(code, path)
+	}
+}
+
+// WithUploads enables PUT requests, if createDirs is true the missing intermediate directories are created.
+func WithUploads(createDirs bool) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetUploads(true, createDirs)
+	}
+}
+
+// WithDeletePrefixes enables DELETE requests under prefixes, they also require WithUploads.
+// If recursive is true directories are removed with all their content.
+func WithDeletePrefixes(recursive bool, prefixes ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetDeletePrefixes(prefixes, recursive)
+	}
+}
+
+// WithUploadEndpoint enables the browser upload endpoint, it also requires WithUploads.
+// maxFileSize is the maximum size in bytes of each file, zero means no limit.
+func WithUploadEndpoint(endpoint string, maxFileSize int) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkSize("WithUploadEndpoint", maxFileSize); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("WithUploadEndpoint(): endpoint %q must start with /", endpoint)
+		}
+		endpoint = path.Clean(endpoint)
+		if endpoint == "/" {
+			return fmt.Errorf("WithUploadEndpoint(): endpoint cannot be /")
+		}
+
+		bs.config.uploadEndpoint = endpoint
+		bs.config.maxPartBytes = maxFileSize
+		return nil
+	}
+}
+
+// WithWebDAV enables the WebDAV methods.
+func WithWebDAV() Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetWebDAV(true)
+	}
+}
+
+// WithCGI runs the scripts under the URL path prefix as CGI programs.
+func WithCGI(prefix string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetCGI(prefix)
+	}
+}
+
+// WithFastCGI sends the requests that match pattern to the FastCGI application at address.
+func WithFastCGI(pattern string, address string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetFastCGI(pattern, address)
+	}
+}
+
+// WithProxy forwards the requests under prefix to upstreams.
+func WithProxy(prefix string, upstreams ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetProxy(prefix, upstreams...)
+	}
+}
+
+// WithProxyTimeout set the maximum duration to connect to an upstream server and receive
+// its response. If it is exceeded server respond with 504 code. Zero means no timeout.
+func WithProxyTimeout(d time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkDuration("WithProxyTimeout", d); err != nil {
+			return err
+		}
+		bs.config.proxyTimeout = d
+		return nil
+	}
+}
+
+// WithProxyBalance set the strategy to choose the backend of a proxied request.
+func WithProxyBalance(strategy string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetProxyBalance(strategy)
+	}
+}
+
+// WithHealthCheck sends a GET request for path to every backend each interval.
+func WithHealthCheck(path string, interval time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("WithHealthCheck(): path %q must start with /", path)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("WithHealthCheck(): the interval must be greater than zero")
+		}
+
+		bs.config.healthCheckPath = path
+		bs.config.healthCheckInterval = interval
+		return nil
+	}
+}
+
+// WithMaxFails ejects a backend for failTimeout after maxFails consecutive failed requests.
+// Zero maxFails means backends are never ejected.
+func WithMaxFails(maxFails int, failTimeout time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if maxFails < 0 {
+			return fmt.Errorf("WithMaxFails(): negative number of fails %d", maxFails)
+		}
+		if maxFails > 0 && failTimeout <= 0 {
+			return fmt.Errorf("WithMaxFails(): the fail timeout must be greater than zero")
+		}
+
+		bs.config.maxFails = maxFails
+		bs.config.failTimeout = failTimeout
+		return nil
+	}
+}
+
+// WithWebSocket accepts WebSocket connections on the URL path, every connection is handed to handler.
+func WithWebSocket(path string, handler WebSocketHandler) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetWebSocket(path, handler)
+	}
+}
+
+// WithMaxMessageSize set the maximum size in bytes of a WebSocket message.
+// If it is exceeded the connection is closed with 1009 code. Zero means no limit.
+func WithMaxMessageSize(bytes int) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkSize("WithMaxMessageSize", bytes); err != nil {
+			return err
+		}
+		bs.config.maxMessageBytes = bytes
+		return nil
+	}
+}
+
+// WithEventStream answers GET requests to the URL path with an event stream written by handler.
+func WithEventStream(path string, handler EventStreamHandler) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetEventStream(path, handler)
+	}
+}
+
+// WithHeartbeat set the interval between the comments sent on idle event streams.
+// Zero means no heartbeat is sent.
+func WithHeartbeat(d time.Duration) Option {
+	return func(bs *buggyInstance) error {
+		if err := checkDuration("WithHeartbeat", d); err != nil {
+			return err
+		}
+		bs.config.heartbeat = d
+		return nil
+	}
+}
+
+// WithWatch enables the live reload of the HTML pages when the base directory changes.
+func WithWatch() Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetWatch(true)
+	}
+}
+
+// WithSPA answers the paths of a single-page application that match no file with fallback,
+// except the ones under the exclude prefixes.
+func WithSPA(fallback string, exclude ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetSPA(fallback, exclude)
+	}
+}
+
+// WithUnixSocket set the permissions and the owner, "user", ":group" or "user:group",
+// of the Unix domain sockets. Zero mode and empty owner mean they are not changed.
+func WithUnixSocket(mode os.FileMode, owner string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetUnixSocket(mode, owner)
+	}
+}
+
+// WithRules loads the rewrite and redirect rules of the file at path.
+func WithRules(path string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetRules(path)
+	}
+}
+
+// WithBasicAuth requires the credentials of a user of the htpasswd file at htpasswdPath
+// for the paths under prefix. Empty realm means "BuggyServer".
+func WithBasicAuth(prefix string, htpasswdPath string, realm string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetBasicAuth(prefix, htpasswdPath, realm)
+	}
+}
+
+// WithAccessRules checks rules, "allow NETWORK" or "deny NETWORK", in order on the client of every
+// accepted connection, the denied ones are closed.
+func WithAccessRules(rules ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetAccessRules(rules)
+	}
+}
+
+// WithPathAccessRules answers with 403 code the requests under prefix of the clients denied by rules.
+func WithPathAccessRules(prefix string, rules ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetPathAccessRules(prefix, rules)
+	}
+}
+
+// WithTrustedProxies trusts the X-Forwarded-For header of proxies and, if proxyProtocol is true,
+// reads the PROXY protocol header at the start of their connections.
+func WithTrustedProxies(proxyProtocol bool, proxies ...string) Option {
+	return func(bs *buggyInstance) error {
+		return bs.SetTrustedProxies(proxies, proxyProtocol)
+	}
+}
@@ -0,0 +1,83 @@
+package buggy_http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("Defaults without options", func(t *testing.T) {
+		bs, err := New()
+		assert.NoError(t, err)
+		assert.Equal(t, NewBuggyServer().(*buggyInstance).config, bs.(*buggyInstance).config)
+	})
+
+	t.Run("Durations and sizes are exact", func(t *testing.T) {
+		bs, err := New(
+			WithBaseDir(t.TempDir()),
+			WithReadTimeout(1500*time.Millisecond),
+			WithWriteTimeout(2*time.Second),
+			WithMaxHeaderSize(1500),
+			WithMaxBodySize(100),
+			WithUploadEndpoint("/_upload/", 4096),
+			WithMaxMessageSize(512),
+			WithHeartbeat(500*time.Millisecond),
+			WithMaxFails(2, time.Minute),
+		)
+		assert.NoError(t, err)
+
+		config := bs.(*buggyInstance).config
+		assert.Equal(t, 1500*time.Millisecond, config.readTimeout)
+		assert.Equal(t, 2*time.Second, config.writeTimeout)
+		assert.Equal(t, sizeLimits{header: 1500, body: 100}, config.sizeLimits())
+		assert.Equal(t, "/_upload", config.uploadEndpoint)
+		assert.Equal(t, 4096, config.maxPartBytes)
+		assert.Equal(t, 512, config.maxMessageBytes)
+		assert.Equal(t, 500*time.Millisecond, config.heartbeat)
+		assert.Equal(t, 2, config.maxFails)
+		assert.Equal(t, time.Minute, config.failTimeout)
+	})
+
+	t.Run("Zero disables", func(t *testing.T) {
+		bs, err := New(
+			WithReadTimeout(time.Second),
+			WithReadTimeout(0),
+			WithWriteTimeout(0),
+			WithMaxMessageSize(0),
+			WithHeartbeat(0),
+			WithMaxFails(0, 0),
+		)
+		assert.NoError(t, err)
+
+		config := bs.(*buggyInstance).config
+		assert.Equal(t, noTimeout, config.readTimeout)
+		assert.Equal(t, noTimeout, config.writeTimeout)
+		assert.Equal(t, 0, config.maxMessageBytes)
+		assert.Equal(t, time.Duration(0), config.heartbeat)
+		assert.Equal(t, 0, config.maxFails)
+	})
+
+	t.Run("Errors of all the invalid options", func(t *testing.T) {
+		bs, err := New(
+			WithReadTimeout(-time.Second),
+			WithBaseDir(t.TempDir()),
+			WithMaxBodySize(-1),
+			WithProxyBalance("random"),
+			WithHealthCheck("/health", 0),
+		)
+		assert.Nil(t, bs)
+		assert.ErrorContains(t, err, "WithReadTimeout(): negative duration -1s")
+		assert.ErrorContains(t, err, "WithMaxBodySize(): negative size -1")
+		assert.ErrorContains(t, err, `SetProxyBalance(): unknown strategy "random"`)
+		assert.ErrorContains(t, err, "WithHealthCheck(): the interval must be greater than zero")
+	})
+
+	t.Run("Setters still work until start", func(t *testing.T) {
+		bs, err := New(WithMaxHeaderSize(100))
+		assert.NoError(t, err)
+		assert.NoError(t, bs.SetMaxHeaderKiB(2))
+		assert.Equal(t, 2048, bs.(*buggyInstance).config.maxHeaderBytes)
+	})
+}
@@ -0,0 +1,376 @@
+package buggy_http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errRequestNotSent wraps the errors of the requests that could not be written to an upstream server.
+var errRequestNotSent = errors.New("request not sent")
+
+// proxyRoute forwards the requests whose path starts with prefix to a pool of upstream servers.
+type proxyRoute struct {
+	// URL path prefix of the forwarded requests.
+	prefix string
+
+	// The upstream servers, if one has a path it replaces prefix in the requests it receives.
+	backends []*backend
+
+	// Incremented for every request balanced with round-robin.
+	next uint64
+
+	// The consistent hash ring of backends, used to balance by client IP.
+	ring []ringPoint
+}
+
+func newProxyRoute(prefix string, upstreams []*url.URL) *proxyRoute {
+	route := &proxyRoute{prefix: prefix}
+	for _, u := range upstreams {
+		route.backends = append(route.backends, newBackend(u))
+	}
+	route.ring = newHashRing(route.backends)
+	return route
+}
+
+// hopByHopHeaders are meaningful only for a single connection, and are not forwarded.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// maxProxyBodyBytes is the maximum size of the body of a response of an upstream server,
+// and of the output of a FastCGI application. The whole body is kept in memory before
+// being sent to the client.
+const maxProxyBodyBytes = 64 << 20
+
+// maxIdlePerUpstream is the maximum number of idle connections kept open to every upstream server.
+const maxIdlePerUpstream = 8
+
+// upstreamConn is a connection to an upstream server.
+type upstreamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// upstreamPool keeps the idle keep-alive connections to upstream servers,
+// so that they can be reused by the following requests.
+type upstreamPool struct {
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn
+}
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{idle: make(map[string][]*upstreamConn)}
+}
+
+// get returns an idle connection to addr, or dials a new one.
+// reused reports whether the connection was idle in the pool.
+func (p *upstreamPool) get(addr string, timeout time.Duration) (uc *upstreamConn, reused bool, err error) {
+	p.mu.Lock()
+	if conns := p.idle[addr]; len(conns) > 0 {
+		uc = conns[len(conns)-1]
+		p.idle[addr] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return uc, true, nil
+	}
+	p.mu.Unlock()
+
+	uc, err = dialUpstream(addr, timeout)
+	return uc, false, err
+}
+
+// put returns a connection to the pool, it is closed if the pool for addr is full.
+func (p *upstreamPool) put(addr string, uc *upstreamConn) {
+	p.mu.Lock()
+	if len(p.idle[addr]) < maxIdlePerUpstream {
+		p.idle[addr] = append(p.idle[addr], uc)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	uc.conn.Close()
+}
+
+// closeAll closes every idle connection.
+func (p *upstreamPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.idle {
+		for _, uc := range conns {
+			uc.conn.Close()
+		}
+		delete(p.idle, addr)
+	}
+}
+
+func dialUpstream(addr string, timeout time.Duration) (*upstreamConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// findProxyRoute returns the route with the longest prefix that matches the decoded and cleaned path
+// of request, or nil.
+func findProxyRoute(request *request, config *buggyConfig) *proxyRoute {
+	if !strings.HasPrefix(request.path, "/") {
+		return nil
+	}
+	p := requestPaths(request)[0]
+
+	var found *proxyRoute
+	for _, route := range config.proxies {
+		if hasPathPrefix(p, route.prefix) && (found == nil || len(route.prefix) > len(found.prefix)) {
+			found = route
+		}
+	}
+	return found
+}
+
+// replyToProxy forwards request to a backend of route, and returns its response.
+// GET and HEAD requests are idempotent, so if a backend fails they are sent to another one.
+// Failures to reach the backends are answered with 502 code, timeouts with 504 code.
+func replyToProxy(request *request, route *proxyRoute, config *buggyConfig) (*response, error) {
+	timeout := config.proxyTimeout
+	if timeout <= 0 {
+		timeout = noTimeout
+	}
+
+	attempts := 1
+	if isRetryable(request.method) {
+		attempts = len(route.backends)
+	}
+
+	ip := clientIP(request.remoteAddr)
+	tried := make(map[*backend]bool, attempts)
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		b := pickBackend(route, config.balance, ip, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		var r *response
+		b.begin()
+		r, err = roundTripUpstream(config.upstreams, b.addr, forwardedRequest(request, route.prefix, b.upstream), timeout)
+		b.end(err == nil, config.maxFails, config.failTimeout)
+
+		if err == nil {
+			return proxiedResponse(r, request.method), nil
+		}
+		if i+1 < attempts {
+			log.Printf("error: replyToProxy() -> %s, %s : %s. Retrying on another backend", request.method, request.path, err.Error())
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return r504(), fmt.Errorf("replyToProxy() -> %s, %s : %w. 504 sent", request.method, request.path, err)
+	}
+	return r502(), fmt.Errorf("replyToProxy() -> %s, %s : %w. 502 sent", request.method, request.path, err)
+}
+
+// roundTripUpstream sends req to addr and reads the response.
+// A pooled connection can be closed by the upstream server while idle, in that case
+// the request is sent again once on a new connection. Requests that are not retryable
+// are sent again only if they could not be written, the upstream server could have
+// run them before closing the connection.
+func roundTripUpstream(pool *upstreamPool, addr string, req *request, timeout time.Duration) (*response, error) {
+	uc, reused, err := pool.get(addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("roundTripUpstream(): %w", err)
+	}
+
+	r, keepAlive, err := exchange(uc, req, timeout)
+	if err != nil && reused && isStaleConnError(err) && (errors.Is(err, errRequestNotSent) || isRetryable(req.method)) {
+		uc.conn.Close()
+		if uc, err = dialUpstream(addr, timeout); err != nil {
+			return nil, fmt.Errorf("roundTripUpstream(): %w", err)
+		}
+		r, keepAlive, err = exchange(uc, req, timeout)
+	}
+	if err != nil {
+		uc.conn.Close()
+		return nil, fmt.Errorf("roundTripUpstream(): %w", err)
+	}
+
+	if keepAlive {
+		uc.conn.SetDeadline(time.Time{})
+		pool.put(addr, uc)
+	} else {
+		uc.conn.Close()
+	}
+	return r, nil
+}
+
+// exchange writes req on uc and reads the response,
+// keepAlive reports whether the connection can be reused.
+func exchange(uc *upstreamConn, req *request, timeout time.Duration) (r *response, keepAlive bool, err error) {
+	uc.conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := uc.conn.Write([]byte(serializeRequest(req))); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", errRequestNotSent, err)
+	}
+
+	r, err = responseParser(uc.reader, req.method, maxProxyBodyBytes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keepAlive = r.proto == "HTTP/1.1" && !headerFinder(r.headers, "connection", "close")
+
+	// Without framing the body ends when the upstream server closes the connection.
+	_, hasLength := r.headers["content-length"]
+	if !hasLength && !headerFinder(r.headers, "transfer-encoding", "chunked") &&
+		req.method != "HEAD" && r.code != 204 && r.code != 304 {
+		keepAlive = false
+	}
+
+	return r, keepAlive, nil
+}
+
+// isRetryable reports whether a request with method can be sent again after a failure.
+// GET and HEAD requests are idempotent and, unlike PUT and DELETE, they do not change anything.
+func isRetryable(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
+
+// isStaleConnError reports whether err is caused by a connection closed before sending any response.
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// forwardedRequest returns the request sent to upstream, for a route with prefix.
+// The Host header is rewritten to the upstream server, and the original client
+// is recorded in the X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers.
+func forwardedRequest(req *request, prefix string, upstream *url.URL) *request {
+	headers := make(map[string][]string, len(req.headers))
+	for name, values := range req.headers {
+		headers[name] = append([]string(nil), values...)
+	}
+	removeHopByHop(headers)
+
+	// The expectation has already been met by BuggyServer.
+	delete(headers, "expect")
+
+	if values, ok := req.headers["host"]; ok {
+		headers["x-forwarded-host"] = values
+	}
+	if req.remoteAddr != "" {
+		headers["x-forwarded-for"] = append(headers["x-forwarded-for"], clientIP(req.remoteAddr))
+	}
+	headers["x-forwarded-proto"] = []string{"http"}
+	headers["host"] = []string{upstream.Host}
+	headers["via"] = append(headers["via"], "1.1 BuggyServer")
+
+	if _, ok := req.headers["content-length"]; ok || len(req.body) > 0 {
+		headers["content-length"] = []string{strconv.Itoa(len(req.body))}
+	}
+
+	return &request{
+		method:  req.method,
+		path:    upstreamPath(forwardPath(req, prefix), prefix, upstream),
+		proto:   "HTTP/1.1",
+		headers: headers,
+		body:    req.body,
+	}
+}
+
+// forwardPath returns the path of req to forward under prefix. The path of the client is kept
+// if it is clean once decoded and starts with prefix, otherwise the decoded and cleaned path,
+// that selected the route, is escaped again so that the upstream server receives the same path.
+func forwardPath(req *request, prefix string) string {
+	rawPath, query, hasQuery := strings.Cut(req.path, "?")
+	decoded, err := url.PathUnescape(rawPath)
+
+	cleaned := requestPaths(req)[0]
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if err == nil && decoded == cleaned && hasPathPrefix(rawPath, prefix) {
+		return req.path
+	}
+
+	p := (&url.URL{Path: cleaned}).EscapedPath()
+	if hasQuery {
+		p += "?" + query
+	}
+	return p
+}
+
+// upstreamPath replaces prefix in p with the path of upstream.
+func upstreamPath(p string, prefix string, upstream *url.URL) string {
+	base := strings.TrimSuffix(upstream.Path, "/")
+	if base == "" {
+		return p
+	}
+
+	rest := p
+	if prefix != "/" {
+		rest = strings.TrimPrefix(p, prefix)
+	}
+	if rest == "" || strings.HasPrefix(rest, "?") {
+		return base + "/" + rest
+	}
+	return base + rest
+}
+
+// upstreamAddr returns the host:port to dial to reach upstream.
+func upstreamAddr(upstream *url.URL) string {
+	if upstream.Port() != "" {
+		return upstream.Host
+	}
+	return net.JoinHostPort(upstream.Hostname(), "80")
+}
+
+// proxiedResponse returns the response of the upstream server, without its hop-by-hop headers,
+// so that it can be sent to the client.
+func proxiedResponse(r *response, method string) *response {
+	headers := r.headers
+	removeHopByHop(headers)
+
+	// The body has already been read, if it was chunked it is now sent with its content-length.
+	if method != "HEAD" && r.code != 204 && r.code != 304 {
+		headers["content-length"] = []string{strconv.Itoa(len(r.body))}
+	}
+	headers["via"] = append(headers["via"], "1.1 BuggyServer")
+
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         r.code,
+		reasonPhrase: r.reasonPhrase,
+		headers:      headers,
+		body:         r.body,
+	}
+}
+
+// removeHopByHop deletes the hop-by-hop headers, and the headers listed in connection.
+func removeHopByHop(headers map[string][]string) {
+	for _, name := range headers["connection"] {
+		delete(headers, strings.ToLower(strings.TrimSpace(name)))
+	}
+	for _, name := range hopByHopHeaders {
+		delete(headers, name)
+	}
+}
@@ -0,0 +1,318 @@
+package buggy_http
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUpstream is a local HTTP/1.1 server that answers every request with handler.
+type fakeUpstream struct {
+	addr string
+
+	mu       sync.Mutex
+	conns    int
+	requests []*request
+}
+
+func startFakeUpstream(t *testing.T, handler func(req *request) string) *fakeUpstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	u := &fakeUpstream{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			u.mu.Lock()
+			u.conns++
+			u.mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					req, err := requestParser(reader, sizeLimits{}, conn)
+					if err != nil {
+						return
+					}
+					u.mu.Lock()
+					u.requests = append(u.requests, req)
+					u.mu.Unlock()
+
+					raw := handler(req)
+					if raw == "" {
+						return
+					}
+					if _, err := conn.Write([]byte(raw)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) lastRequest() *request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.requests) == 0 {
+		return nil
+	}
+	return u.requests[len(u.requests)-1]
+}
+
+func (u *fakeUpstream) requestCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+func (u *fakeUpstream) connCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conns
+}
+
+func newProxyConfig(t *testing.T, prefix string, upstreams ...string) *buggyConfig {
+	bs := &buggyInstance{config: &buggyConfig{writeTimeout: 1<<63 - 1}}
+	if err := bs.SetProxy(prefix, upstreams...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bs.config.upstreams.closeAll)
+	return bs.config
+}
+
+func TestReplyToProxy(t *testing.T) {
+	upstream := startFakeUpstream(t, func(req *request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nKeep-Alive: timeout=5\r\nX-Upstream: yes\r\n\r\nhello"
+	})
+	config := newProxyConfig(t, "/api", "http://"+upstream.addr)
+
+	t.Run("Headers are rewritten", func(t *testing.T) {
+		req := &request{
+			method: "POST",
+			path:   "/api/users?id=1",
+			proto:  "HTTP/1.1",
+			headers: map[string][]string{
+				"host":            {"example.com"},
+				"connection":      {"keep-alive", "x-secret"},
+				"x-secret":        {"hop"},
+				"x-forwarded-for": {"10.0.0.1"},
+				"content-length":  {"3"},
+				"expect":          {"100-continue"},
+			},
+			body:       []byte("foo"),
+			remoteAddr: "192.0.2.7:51000",
+		}
+
+		r, err := reply(req, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, "hello", string(r.body))
+		assert.Equal(t, []string{"yes"}, r.headers["x-upstream"])
+		assert.NotContains(t, r.headers, "keep-alive")
+		assert.Equal(t, []string{"1.1 BuggyServer"}, r.headers["via"])
+
+		forwarded := upstream.lastRequest()
+		assert.Equal(t, "/api/users?id=1", forwarded.path)
+		assert.Equal(t, []string{upstream.addr}, forwarded.headers["host"])
+		assert.Equal(t, []string{"example.com"}, forwarded.headers["x-forwarded-host"])
+		assert.Equal(t, []string{"10.0.0.1", "192.0.2.7"}, forwarded.headers["x-forwarded-for"])
+		assert.Equal(t, []string{"http"}, forwarded.headers["x-forwarded-proto"])
+		assert.NotContains(t, forwarded.headers, "x-secret")
+		assert.NotContains(t, forwarded.headers, "connection")
+		assert.NotContains(t, forwarded.headers, "expect")
+		assert.Equal(t, "foo", string(forwarded.body))
+	})
+
+	t.Run("Keep-alive connections are reused", func(t *testing.T) {
+		before := upstream.connCount()
+		for i := 0; i < 3; i++ {
+			r, err := reply(&request{method: "GET", path: "/api", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, r.code)
+		}
+		assert.LessOrEqual(t, upstream.connCount()-before, 1)
+	})
+
+	t.Run("Paths outside the prefix are not forwarded", func(t *testing.T) {
+		assert.Nil(t, findProxyRoute(&request{path: "/apiary"}, config))
+		assert.Nil(t, findProxyRoute(&request{path: "/api/../admin"}, config))
+		assert.Nil(t, findProxyRoute(&request{path: "/api/%2e%2e/admin"}, config))
+	})
+
+	t.Run("Decoded paths are forwarded", func(t *testing.T) {
+		assert.NotNil(t, findProxyRoute(&request{path: "/%61pi/users"}, config))
+		assert.NotNil(t, findProxyRoute(&request{path: "/static/../api/users"}, config))
+	})
+}
+
+func TestReplyToProxyChunked(t *testing.T) {
+	upstream := startFakeUpstream(t, func(req *request) string {
+		return "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7\r\n, world\r\n0\r\n\r\n"
+	})
+	config := newProxyConfig(t, "/", "http://"+upstream.addr)
+
+	r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.body))
+	assert.Equal(t, []string{"12"}, r.headers["content-length"])
+	assert.NotContains(t, r.headers, "transfer-encoding")
+}
+
+func TestReplyToProxyStaleConnection(t *testing.T) {
+	// The upstream server closes every connection after the first response, without saying so.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := requestParser(bufio.NewReader(conn), sizeLimits{}, conn); err == nil {
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}
+			conn.Close()
+		}
+	}()
+
+	config := newProxyConfig(t, "/", "http://"+l.Addr().String())
+	for i := 0; i < 2; i++ {
+		r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, "ok", string(r.body))
+
+		// Let the close reach the pooled connection.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReplyToProxyStaleConnectionRetries(t *testing.T) {
+	// The upstream server runs the second request and closes the connection without answering.
+	send := func(method string) (*response, *fakeUpstream) {
+		var mu sync.Mutex
+		n := 0
+		upstream := startFakeUpstream(t, func(req *request) string {
+			mu.Lock()
+			defer mu.Unlock()
+			n++
+			if n == 2 {
+				return ""
+			}
+			return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+		})
+		config := newProxyConfig(t, "/", "http://"+upstream.addr)
+
+		_, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.NoError(t, err)
+		r, _ := reply(&request{method: method, path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		return r, upstream
+	}
+
+	t.Run("GET is sent again", func(t *testing.T) {
+		r, upstream := send("GET")
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, 3, upstream.requestCount())
+	})
+
+	t.Run("POST is not sent again", func(t *testing.T) {
+		r, upstream := send("POST")
+		assert.Equal(t, 502, r.code)
+		assert.Equal(t, 2, upstream.requestCount())
+	})
+}
+
+func TestReplyToProxyFailures(t *testing.T) {
+	t.Run("Unreachable upstream is 502", func(t *testing.T) {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := l.Addr().String()
+		l.Close()
+
+		config := newProxyConfig(t, "/", "http://"+addr)
+		r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 502, r.code)
+	})
+
+	t.Run("Invalid response is 502", func(t *testing.T) {
+		upstream := startFakeUpstream(t, func(req *request) string {
+			return "garbage\r\n\r\n"
+		})
+		config := newProxyConfig(t, "/", "http://"+upstream.addr)
+		r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 502, r.code)
+	})
+
+	t.Run("Slow upstream is 504", func(t *testing.T) {
+		upstream := startFakeUpstream(t, func(req *request) string {
+			time.Sleep(2 * time.Second)
+			return ""
+		})
+		config := newProxyConfig(t, "/", "http://"+upstream.addr)
+		config.proxyTimeout = 100 * time.Millisecond
+
+		r, err := reply(&request{method: "GET", path: "/", proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		assert.Error(t, err)
+		assert.Equal(t, 504, r.code)
+	})
+}
+
+func TestUpstreamPath(t *testing.T) {
+	upstream := func(raw string) *url.URL {
+		u, _ := url.Parse(raw)
+		return u
+	}
+
+	assert.Equal(t, "/api/users", upstreamPath("/api/users", "/api", upstream("http://localhost:3000")))
+	assert.Equal(t, "/v1/users", upstreamPath("/api/users", "/api", upstream("http://localhost:3000/v1")))
+	assert.Equal(t, "/v1/", upstreamPath("/api", "/api", upstream("http://localhost:3000/v1/")))
+	assert.Equal(t, "/v1/?q=1", upstreamPath("/api?q=1", "/api", upstream("http://localhost:3000/v1")))
+	assert.Equal(t, "/v1/users", upstreamPath("/users", "/", upstream("http://localhost:3000/v1")))
+}
+
+func TestForwardPath(t *testing.T) {
+	forward := func(p string, prefix string) string {
+		return forwardPath(&request{path: p}, prefix)
+	}
+
+	assert.Equal(t, "/api/users?q=1", forward("/api/users?q=1", "/api"))
+	assert.Equal(t, "/api/a%2Fb/", forward("/api/a%2Fb/", "/api"))
+	assert.Equal(t, "/api/users", forward("/%61pi/users", "/api"))
+	assert.Equal(t, "/api/users/?q=1", forward("/static/../api//users/?q=1", "/api"))
+	assert.Equal(t, "/api/a%20b", forward("/api/x/%2e%2e/a%20b", "/api"))
+}
+
+func TestHandleConnectionProxy(t *testing.T) {
+	upstream := startFakeUpstream(t, func(req *request) string {
+		return "HTTP/1.1 201 Created\r\nContent-Length: 7\r\nConnection: close\r\n\r\ncreated"
+	})
+
+	bs := newTestInstance(t)
+	assert.NoError(t, bs.SetProxy("/api", "http://"+upstream.addr))
+
+	out := roundTrip(t, bs, "GET /api/items HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+	assert.Contains(t, out, "\r\n\r\ncreated")
+	assert.True(t, strings.HasSuffix(out, "<html>index</html>"))
+	assert.Equal(t, []string{"pipe"}, upstream.lastRequest().headers["x-forwarded-for"])
+}
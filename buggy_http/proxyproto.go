@@ -0,0 +1,131 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// The PROXY protocol header sent by a proxy at the start of a connection, with the address of its client.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+// proxyV1MaxLen is the maximum length of a version 1 header, CRLF included.
+const proxyV1MaxLen = 107
+
+// proxyV2Signature starts a version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn is a connection received from a proxy, RemoteAddr returns the address of its client.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (pc *proxiedConn) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+// readProxyHeader reads the PROXY protocol header, version 1 or 2, at the start of conn from reader.
+// It returns conn with the address of the client of the proxy, or conn itself if the header does not
+// have one, like the health checks of the proxy.
+func readProxyHeader(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	start, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("readProxyHeader(): %s: %w", conn.RemoteAddr(), err)
+	}
+
+	var source net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		source, err = readProxyV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		source, err = readProxyV1(reader)
+	default:
+		err = fmt.Errorf("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("readProxyHeader(): %s: %w", conn.RemoteAddr(), err)
+	}
+
+	if source == nil {
+		return conn, nil
+	}
+	return &proxiedConn{Conn: conn, remoteAddr: source}, nil
+}
+
+// readProxyV1 reads a text header, like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol header: %w", err)
+	}
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed PROXY protocol header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol header %q", line)
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q in PROXY protocol header", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q in PROXY protocol header", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header. Only the TCP addresses are taken, the other families,
+// the LOCAL command and the TLVs are skipped.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("PROXY protocol header: %w", err)
+	}
+
+	switch header[12] & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", header[12]&0xf)
+	}
+
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("truncated PROXY protocol addresses")
+	}
+
+	ip, _ := netip.AddrFromSlice(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
@@ -0,0 +1,132 @@
+package buggy_http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyV2Header returns a version 2 header with the command cmd, the family fam and addrs.
+func proxyV2Header(cmd byte, fam byte, addrs []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	read := func(raw string) (net.Conn, string, error) {
+		conn, other := net.Pipe()
+		defer other.Close()
+
+		reader := bufio.NewReader(strings.NewReader(raw))
+		proxied, err := readProxyHeader(conn, reader)
+		rest, _ := io.ReadAll(reader)
+		return proxied, string(rest), err
+	}
+
+	t.Run("Version 1", func(t *testing.T) {
+		conn, rest, err := read("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", rest)
+
+		conn, _, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+		conn, rest, err = read("PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "pipe", conn.RemoteAddr().String())
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", rest)
+	})
+
+	t.Run("Version 2", func(t *testing.T) {
+		ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+		conn, rest, err := read(proxyV2Header(0x1, 0x11, ipv4) + "GET / HTTP/1.1\r\n\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", rest)
+
+		ipv6 := make([]byte, 36)
+		copy(ipv6, net.ParseIP("2001:db8::1"))
+		copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+		binary.BigEndian.PutUint16(ipv6[32:], 56324)
+		conn, _, err = read(proxyV2Header(0x1, 0x21, append(ipv6, 0x04, 0x00, 0x01, 0x00)))
+		assert.NoError(t, err, "the TLVs are skipped")
+		assert.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+		conn, rest, err = read(proxyV2Header(0x0, 0x00, nil) + "GET / HTTP/1.1\r\n\r\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "pipe", conn.RemoteAddr().String(), "LOCAL has no client")
+		assert.Equal(t, "GET / HTTP/1.1\r\n\r\n", rest)
+	})
+
+	t.Run("Invalid headers", func(t *testing.T) {
+		for _, raw := range []string{
+			"GET / HTTP/1.1\r\n\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+			"PROXY TCP4 " + strings.Repeat("1", 100) + " 198.51.100.1 56324 443\r\n",
+			proxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1}),
+			proxyV2Header(0x2, 0x11, make([]byte, 12)),
+			proxyV2Header(0x1, 0x11, make([]byte, 4))[:20],
+			"PROXY",
+		} {
+			_, _, err := read(raw)
+			assert.Error(t, err, raw)
+		}
+	})
+}
+
+func TestProxyProtocol(t *testing.T) {
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	bs := newTestInstance(t)
+	assert.NoError(t, bs.SetAccessRules([]string{"deny 192.0.2.0/24", "allow all"}))
+	assert.NoError(t, bs.SetTrustedProxies([]string{"127.0.0.1"}, true))
+	addr := startTestServer(t, bs)
+
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(raw))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+
+	t.Run("The client of the header is served", func(t *testing.T) {
+		out := send("PROXY TCP4 198.51.100.7 127.0.0.1 5000 80\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, logs.String(), "[ 198.51.100.7:5000, GET, / : 200 ]")
+	})
+
+	t.Run("The client of the header is denied", func(t *testing.T) {
+		out := send("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+		assert.Empty(t, out)
+		assert.Contains(t, logs.String(), "error: handleConnection(): 192.0.2.1:5000 is denied by the access rules, connection closed")
+	})
+
+	t.Run("The header is required", func(t *testing.T) {
+		out := send("GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+		assert.Empty(t, out)
+		assert.Contains(t, logs.String(), "missing PROXY protocol header")
+	})
+}
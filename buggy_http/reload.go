@@ -0,0 +1,222 @@
+package buggy_http
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reload validates cfg and applies it to the new connections of a running BuggyServer,
+// the connections already open keep the previous configuration until they are closed.
+// The base directory, timeouts, size limits, error pages, uploads, WebDAV, CGI, SPA fallback,
+// rules, basic auth, with its htpasswd files read again, access rules, trusted proxies
+// and WebSocket and event stream limits are reloaded.
+// FastCGI applications, proxies, health checks, watch mode and Unix socket settings are kept,
+// their changes are logged and applied on restart. The health checks keep probing the proxies
+// of the start and watch mode keeps watching the base directory of the start.
+// If cfg is not valid the running configuration is not changed.
+func (bs *buggyInstance) Reload(cfg Config) error {
+	if bs.listener == nil {
+		return fmt.Errorf("Reload(): BuggyServer has not been started, use the setters")
+	}
+
+	next, err := NewBuggyServerFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("Reload(): %w", err)
+	}
+	src := next.(*buggyInstance).config
+
+	bs.reloadMu.Lock()
+	defer bs.reloadMu.Unlock()
+
+	current := bs.liveConfig()
+	merged := *current
+
+	merged.baseDir = src.baseDir
+	merged.readTimeout = src.readTimeout
+	merged.writeTimeout = src.writeTimeout
+	merged.maxRequestBytes = src.maxRequestBytes
+	merged.maxHeaderBytes = src.maxHeaderBytes
+	merged.maxBodyBytes = src.maxBodyBytes
+	merged.errorPages = src.errorPages
+	merged.uploads = src.uploads
+	merged.createDirs = src.createDirs
+	merged.deletePrefixes = src.deletePrefixes
+	merged.recursiveDelete = src.recursiveDelete
+	merged.uploadEndpoint = src.uploadEndpoint
+	merged.maxPartBytes = src.maxPartBytes
+	merged.webdav = src.webdav
+	merged.cgiPrefix = src.cgiPrefix
+	merged.maxMessageBytes = src.maxMessageBytes
+	merged.heartbeat = src.heartbeat
+	merged.spaFallback = src.spaFallback
+	merged.spaExclude = src.spaExclude
+	merged.rules = src.rules
+	merged.auth = src.auth
+	merged.access = src.access
+	merged.pathAccess = src.pathAccess
+	merged.trustedProxies = src.trustedProxies
+	merged.proxyProtocol = src.proxyProtocol
+
+	changes := configChanges(current, &merged)
+	for _, change := range changes {
+		log.Printf("Reload(): %s", change)
+	}
+	for _, name := range restartOnlyChanges(current, src) {
+		log.Printf("error: Reload(): %s changed, it is applied only on restart", name)
+	}
+	if len(changes) == 0 {
+		log.Printf("Reload(): no change")
+	}
+
+	bs.live.Store(&merged)
+	return nil
+}
+
+// configChanges describes the reloadable settings that differ between old and next.
+func configChanges(old *buggyConfig, next *buggyConfig) []string {
+	var changes []string
+	compare := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, describeSetting(a), describeSetting(b)))
+		}
+	}
+
+	compare("base directory", old.baseDir, next.baseDir)
+	compare("read timeout", old.readTimeout, next.readTimeout)
+	compare("write timeout", old.writeTimeout, next.writeTimeout)
+	compare("max request size bytes", old.maxRequestBytes, next.maxRequestBytes)
+	compare("max header size bytes", old.maxHeaderBytes, next.maxHeaderBytes)
+	compare("max body size bytes", old.maxBodyBytes, next.maxBodyBytes)
+	compare("error pages", old.errorPages, next.errorPages)
+	compare("uploads", old.uploads, next.uploads)
+	compare("create dirs", old.createDirs, next.createDirs)
+	compare("delete prefixes", old.deletePrefixes, next.deletePrefixes)
+	compare("recursive delete", old.recursiveDelete, next.recursiveDelete)
+	compare("upload endpoint", old.uploadEndpoint, next.uploadEndpoint)
+	compare("max upload file size bytes", old.maxPartBytes, next.maxPartBytes)
+	compare("webdav", old.webdav, next.webdav)
+	compare("cgi prefix", old.cgiPrefix, next.cgiPrefix)
+	compare("max message size bytes", old.maxMessageBytes, next.maxMessageBytes)
+	compare("heartbeat", old.heartbeat, next.heartbeat)
+	compare("spa fallback", old.spaFallback, next.spaFallback)
+	compare("spa exclude", old.spaExclude, next.spaExclude)
+	compare("rules", describeRules(old.rules), describeRules(next.rules))
+	compare("basic auth", describeAuth(old.auth), describeAuth(next.auth))
+	compare("access rules", describeAccess(old.access), describeAccess(next.access))
+	compare("path access", describePathAccess(old.pathAccess), describePathAccess(next.pathAccess))
+	compare("trusted proxies", describeAccess(old.trustedProxies), describeAccess(next.trustedProxies))
+	compare("proxy protocol", old.proxyProtocol, next.proxyProtocol)
+
+	return changes
+}
+
+// restartOnlyChanges returns the names of the settings that cannot be reloaded and differ between old and next.
+func restartOnlyChanges(old *buggyConfig, next *buggyConfig) []string {
+	var names []string
+
+	fastcgi := func(c *buggyConfig) []string {
+		routes := make([]string, 0, len(c.fastcgi))
+		for _, route := range c.fastcgi {
+			routes = append(routes, route.pattern+"="+route.client.network+":"+route.client.address)
+		}
+		return routes
+	}
+	proxies := func(c *buggyConfig) []string {
+		routes := make([]string, 0, len(c.proxies))
+		for _, route := range c.proxies {
+			for _, b := range route.backends {
+				routes = append(routes, route.prefix+"="+b.upstream.String())
+			}
+		}
+		sort.Strings(routes)
+		return routes
+	}
+
+	if !reflect.DeepEqual(fastcgi(old), fastcgi(next)) {
+		names = append(names, "fastcgi")
+	}
+	if !reflect.DeepEqual(proxies(old), proxies(next)) {
+		names = append(names, "proxies")
+	}
+	if old.proxyTimeout != next.proxyTimeout || old.balance != next.balance ||
+		old.maxFails != next.maxFails || old.failTimeout != next.failTimeout {
+		names = append(names, "proxy settings")
+	}
+	if old.healthCheckPath != next.healthCheckPath || (next.healthCheckPath != "" && old.healthCheckInterval != next.healthCheckInterval) {
+		names = append(names, "health checks")
+	}
+	if (old.liveReload != nil) != (next.liveReload != nil) {
+		names = append(names, "watch")
+	} else if next.liveReload != nil && old.baseDir != next.baseDir {
+		names = append(names, "watched directory")
+	}
+	if old.socketMode != next.socketMode || old.socketOwner != next.socketOwner {
+		names = append(names, "unix socket settings")
+	}
+	return names
+}
+
+// describeSetting formats a setting for the reload log.
+func describeSetting(v any) string {
+	switch v := v.(type) {
+	case time.Duration:
+		if v == noTimeout {
+			return "none"
+		}
+		return v.String()
+	case string:
+		if v == "" {
+			return `""`
+		}
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+func describeRules(rules []*rule) string {
+	lines := make([]string, 0, len(rules))
+	for _, r := range rules {
+		if r.redirect != 0 {
+			lines = append(lines, fmt.Sprintf("redirect %d %s %s %s", r.redirect, r.kind, r.pattern, r.target))
+		} else {
+			lines = append(lines, fmt.Sprintf("rewrite %s %s %s", r.kind, r.pattern, r.target))
+		}
+	}
+	return "[" + strings.Join(lines, "; ") + "]"
+}
+
+// describeAuth lists the basic auth prefixes, with the users of their files.
+// Passwords are not logged, so a changed password is applied without being listed as a change.
+func describeAuth(routes []*authRoute) string {
+	lines := make([]string, 0, len(routes))
+	for _, route := range routes {
+		users := make([]string, 0, len(route.users))
+		for user := range route.users {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		lines = append(lines, fmt.Sprintf("%s=%s realm=%q users=%s", route.prefix, route.file, route.realm, strings.Join(users, ",")))
+	}
+	return "[" + strings.Join(lines, "; ") + "]"
+}
+
+// describeAccess lists rules in their text form, the trusted proxies with their networks only.
+func describeAccess(rules []accessRule) string {
+	lines := make([]string, 0, len(rules))
+	for _, r := range rules {
+		lines = append(lines, r.String())
+	}
+	return "[" + strings.Join(lines, "; ") + "]"
+}
+
+func describePathAccess(paths []*pathAccess) string {
+	lines := make([]string, 0, len(paths))
+	for _, pa := range paths {
+		lines = append(lines, pa.prefix+"="+describeAccess(pa.rules))
+	}
+	return "[" + strings.Join(lines, "; ") + "]"
+}
@@ -0,0 +1,116 @@
+package buggy_http
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(oldDir, "index.html"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(newDir, "index.html"), []byte("new"), 0644)
+
+	cfg := DefaultConfig()
+	cfg.Dir = oldDir
+	server, err := NewBuggyServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := server.(*buggyInstance)
+
+	t.Run("Error before start", func(t *testing.T) {
+		assert.Error(t, bs.Reload(cfg))
+	})
+
+	addr := startTestServer(t, bs)
+
+	// A keep-alive connection opened before the reload.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	get := func() string {
+		conn.Write([]byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		r, err := responseParser(reader, "GET", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(r.body)
+	}
+	assert.Equal(t, "old", get())
+
+	t.Run("Invalid configuration is refused", func(t *testing.T) {
+		invalid := cfg
+		invalid.Dir = newDir
+		invalid.ProxyBalance = "random"
+		assert.Error(t, bs.Reload(invalid))
+		assert.Equal(t, oldDir, bs.liveConfig().baseDir)
+	})
+
+	t.Run("New connections use the new configuration", func(t *testing.T) {
+		next := cfg
+		next.Dir = newDir
+		next.ReadTimeout = 60
+		assert.NoError(t, bs.Reload(next))
+
+		out := rawRequest(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\nnew"))
+		assert.Equal(t, 60*time.Second, bs.liveConfig().readTimeout)
+	})
+
+	t.Run("Open connections keep the old configuration", func(t *testing.T) {
+		assert.Equal(t, "old", get())
+	})
+
+	t.Run("Basic auth is reloaded", func(t *testing.T) {
+		next := cfg
+		next.Dir = newDir
+		next.BasicAuth = []BasicAuthConfig{{Prefix: "/", File: writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")}}
+		assert.NoError(t, bs.Reload(next))
+
+		out := rawRequest(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 401 Unauthorized\r\n"))
+	})
+
+	t.Run("Access rules are reloaded", func(t *testing.T) {
+		next := cfg
+		next.Dir = newDir
+		next.PathAccess = []PathAccessConfig{{Prefix: "/", Rules: []string{"deny 127.0.0.0/8"}}}
+		assert.NoError(t, bs.Reload(next))
+
+		out := rawRequest(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	})
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := &buggyConfig{baseDir: "/a", readTimeout: 1<<63 - 1, uploads: false}
+	next := &buggyConfig{baseDir: "/b", readTimeout: 30 * time.Second, uploads: false}
+
+	assert.Equal(t, []string{
+		"base directory: /a -> /b",
+		"read timeout: none -> 30s",
+	}, configChanges(old, next))
+	assert.Empty(t, configChanges(old, old))
+}
+
+func TestRestartOnlyChanges(t *testing.T) {
+	old := &buggyConfig{balance: balanceRoundRobin}
+	next := &buggyConfig{balance: balanceLeastConn, liveReload: newLiveReload()}
+	assert.Equal(t, []string{"proxy settings", "watch"}, restartOnlyChanges(old, next))
+
+	watched := &buggyConfig{baseDir: "/a", liveReload: newLiveReload()}
+	moved := &buggyConfig{baseDir: "/b", liveReload: newLiveReload()}
+	assert.Equal(t, []string{"watched directory"}, restartOnlyChanges(watched, moved))
+	assert.Empty(t, restartOnlyChanges(&buggyConfig{baseDir: "/a"}, &buggyConfig{baseDir: "/b"}))
+}
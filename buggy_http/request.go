@@ -2,18 +2,39 @@ package buggy_http
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 )
 
+var (
+	// The request has an expect header with an expectation the server cannot meet.
+	errExpectationFailed = errors.New("expectation failed")
+
+	// The body of the request exceeds the maximum size the server will accept.
+	errPayloadTooLarge = errors.New("payload too large")
+
+	// The request line or the header section exceed the maximum size the server will accept.
+	errHeaderTooLarge = errors.New("header fields too large")
+)
+
 type request struct {
 	method  string
 	path    string
 	proto   string
 	headers map[string][]string
 	body    []byte
+
+	// The network address of the client that sent the request.
+	remoteAddr string
+
+	// The network address of the server that received the request.
+	localAddr string
+
+	// The user authenticated with basic auth, empty if the path is not protected.
+	user string
 }
 
 func requestLineParser(line string) (*request, error) {
@@ -52,16 +73,51 @@ func headerLineParser(line string) (string, []string, error) {
 	return name, value, nil
 }
 
-func requestParser(reader *bufio.Reader, maxRequestMiB int) (*request, error) {
+// sizeLimits are the maximum sizes in bytes of a request,
+// zero or negative values mean there is no limit.
+type sizeLimits struct {
+	// The whole request: request line, header section and body.
+	request int
 
-	var maxRequestBytes int = 0
-	if maxRequestMiB > 0 {
-		maxRequestBytes = maxRequestMiB * (1 << 20)
+	// The request line and the header section.
+	header int
+
+	// The body.
+	body int
+}
+
+// bodyLimit returns the maximum size of the body of a request whose
+// request line and header section are headerBytes long.
+// A negative value means there is no limit.
+func (l sizeLimits) bodyLimit(headerBytes int) int {
+	limit := -1
+	if l.body > 0 {
+		limit = l.body
+	}
+	if l.request > 0 {
+		remaining := max(l.request-headerBytes, 0)
+		if limit < 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+	return limit
+}
+
+// requestParser reads a request from reader.
+// If the client sent 'expect: 100-continue', before reading the body the
+// interim response '100 Continue' is written to interim, unless interim is nil.
+// Requests that exceed limits fail with errHeaderTooLarge or errPayloadTooLarge,
+// the size of the body is checked against its content-length before it is read.
+func requestParser(reader *bufio.Reader, limits sizeLimits, interim io.Writer) (*request, error) {
+
+	maxHeaderBytes := limits.header
+	if limits.request > 0 && (maxHeaderBytes <= 0 || limits.request < maxHeaderBytes) {
+		maxHeaderBytes = limits.request
 	}
 
 	var byteCount int = 0
 
-	startLine, err := readLine(reader, &byteCount, maxRequestBytes)
+	startLine, err := readLine(reader, &byteCount, maxHeaderBytes)
 	if err != nil {
 		return &request{}, fmt.Errorf("requestParser(): %w", err)
 	}
@@ -72,7 +128,7 @@ func requestParser(reader *bufio.Reader, maxRequestMiB int) (*request, error) {
 	}
 
 	for {
-		byteLine, err := readLine(reader, &byteCount, maxRequestBytes)
+		byteLine, err := readLine(reader, &byteCount, maxHeaderBytes)
 		if err != nil {
 			return parsedRequest, fmt.Errorf("requestParser(): %w", err)
 		}
@@ -99,7 +155,28 @@ func requestParser(reader *bufio.Reader, maxRequestMiB int) (*request, error) {
 		return parsedRequest, fmt.Errorf("requestParser(): BuggyServer does not support transfer-encoding: chunked")
 	}
 
-	if err = readBody(reader, parsedRequest); err != nil {
+	contentLength, err := parseContentLength(parsedRequest.headers)
+	if err != nil {
+		return parsedRequest, fmt.Errorf("requestParser(): %w", err)
+	}
+
+	// The body is rejected before allocating memory for it.
+	if bodyLimit := limits.bodyLimit(byteCount); bodyLimit >= 0 && contentLength > bodyLimit {
+		return parsedRequest, fmt.Errorf("requestParser(): content-length %d exceeds %d bytes: %w", contentLength, bodyLimit, errPayloadTooLarge)
+	}
+
+	expectContinue, err := checkExpectation(parsedRequest)
+	if err != nil {
+		return parsedRequest, fmt.Errorf("requestParser(): %w", err)
+	}
+
+	if expectContinue && contentLength > 0 && interim != nil {
+		if _, err := io.WriteString(interim, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return parsedRequest, fmt.Errorf("requestParser(): writing 100 Continue: %w", err)
+		}
+	}
+
+	if err = readBody(reader, parsedRequest, contentLength); err != nil {
 		return parsedRequest, fmt.Errorf("requestParser(): %w", err)
 	}
 
@@ -107,23 +184,103 @@ func requestParser(reader *bufio.Reader, maxRequestMiB int) (*request, error) {
 	return parsedRequest, nil
 }
 
-func readLine(reader *bufio.Reader, byteCount *int, maxRequestBytes int) ([]byte, error) {
+// serializeRequest serializes a request, it is used to forward requests to other servers.
+func serializeRequest(req *request) string {
+	return fmt.Sprintf("%s %s %s\r\n", req.method, req.path, req.proto) +
+		serializeFields(req.headers) + "\r\n" + string(req.body)
+}
+
+func readLine(reader *bufio.Reader, byteCount *int, maxBytes int) ([]byte, error) {
 	line, isPrefix, err := reader.ReadLine()
 	if err != nil {
 		return nil, err
 	}
 	if isPrefix {
-		return nil, fmt.Errorf("readLine(): line exceeded max size")
+		return nil, fmt.Errorf("readLine(): line exceeded max size: %w", errHeaderTooLarge)
 	}
-	if maxRequestBytes > 0 {
-		*byteCount += len(line)
-		if *byteCount > int(maxRequestBytes) {
-			return nil, fmt.Errorf("readLine(): request exceeded max size")
-		}
+	*byteCount += len(line)
+	if maxBytes > 0 && *byteCount > maxBytes {
+		return nil, fmt.Errorf("readLine(): header section exceeded %d bytes: %w", maxBytes, errHeaderTooLarge)
 	}
 	return line, nil
 }
 
+// parseHTTPVersion parses the HTTP-version of a request line, e.g. "HTTP/1.1".
+// See https://www.rfc-editor.org/rfc/rfc9112#section-2.3
+func parseHTTPVersion(proto string) (major, minor int, err error) {
+	version, ok := strings.CutPrefix(proto, "HTTP/")
+	if !ok || len(version) != 3 || version[1] != '.' ||
+		version[0] < '0' || version[0] > '9' || version[2] < '0' || version[2] > '9' {
+		return 0, 0, fmt.Errorf("parseHTTPVersion(): invalid HTTP version: %q", proto)
+	}
+
+	return int(version[0] - '0'), int(version[2] - '0'), nil
+}
+
+// isHTTP10 reports whether the request has been sent by an HTTP/1.0 client.
+func isHTTP10(req *request) bool {
+	major, minor, err := parseHTTPVersion(req.proto)
+	return err == nil && major == 1 && minor == 0
+}
+
+// wantsKeepAlive reports whether the connection can be reused after the response to req.
+// HTTP/1.1 connections are persistent unless 'connection: close' is sent,
+// HTTP/1.0 connections are closed unless 'connection: keep-alive' is sent.
+// See https://www.rfc-editor.org/rfc/rfc9112#section-9.3
+func wantsKeepAlive(req *request) bool {
+	if headerFinder(req.headers, "connection", "close") {
+		return false
+	}
+	if isHTTP10(req) {
+		return headerFinder(req.headers, "connection", "keep-alive")
+	}
+	return true
+}
+
+// checkExpectation checks the expect header of a request before its body is read.
+// It returns true if the client is waiting for a '100 Continue' interim response
+// before sending the body.
+// Expectations other than 100-continue fail with errExpectationFailed.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-10.1.1
+func checkExpectation(req *request) (bool, error) {
+	values, ok := req.headers["expect"]
+
+	// A server that receives 100-continue in an HTTP/1.0 request must ignore it.
+	if !ok || isHTTP10(req) {
+		return false, nil
+	}
+
+	for _, v := range values {
+		if !strings.EqualFold(v, "100-continue") {
+			return false, fmt.Errorf("checkExpectation(): %q: %w", v, errExpectationFailed)
+		}
+	}
+
+	return true, nil
+}
+
+// parseContentLength returns the value of the content-length header, or 0 if it is missing.
+func parseContentLength(headers map[string][]string) (int, error) {
+	value, ok := headers["content-length"]
+	if !ok {
+		return 0, nil
+	}
+
+	contentLength, err := strconv.Atoi(value[0])
+	if err != nil || contentLength < 0 {
+		return 0, fmt.Errorf("parseContentLength(): invalid content-length: %q", value[0])
+	}
+
+	// Multiple content-length values are only valid if they are all the same.
+	for _, v := range value[1:] {
+		if v != value[0] {
+			return 0, fmt.Errorf("parseContentLength(): different content-length values: %q", value)
+		}
+	}
+
+	return contentLength, nil
+}
+
 // This function serves to find if a heder exist in the headersMap
 // and if it has a given value.
 func headerFinder(headersMap map[string][]string, header, value string) bool {
@@ -137,20 +294,11 @@ func headerFinder(headersMap map[string][]string, header, value string) bool {
 	return false
 }
 
-func readBody(reader *bufio.Reader, req *request) error {
-	if value, ok := req.headers["content-length"]; ok {
-		contentLength, err := strconv.Atoi(value[0])
-		if err != nil {
-			return err
-		}
-
-		req.body = make([]byte, contentLength)
-		_, err = io.ReadFull(reader, req.body)
-		if err != nil {
-			return fmt.Errorf("readBody(): %w", err)
-		}
-	} else {
-		req.body = make([]byte, 0)
+func readBody(reader *bufio.Reader, req *request, contentLength int) error {
+	body, err := copyBody(reader, contentLength, 0)
+	if err != nil {
+		return fmt.Errorf("readBody(): %w", err)
 	}
+	req.body = body
 	return nil
 }
@@ -1,7 +1,11 @@
 package buggy_http
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -143,3 +147,176 @@ func TestRequestLineParser(t *testing.T) {
 		})
 	}
 }
+
+func TestParseHTTPVersion(t *testing.T) {
+	testCases := []struct {
+		proto         string
+		expectedMajor int
+		expectedMinor int
+		expectError   bool
+	}{
+		{"HTTP/1.1", 1, 1, false},
+		{"HTTP/1.0", 1, 0, false},
+		{"HTTP/2.0", 2, 0, false},
+		{"HTTP/1", 0, 0, true},
+		{"HTTP/1.10", 0, 0, true},
+		{"http/1.1", 0, 0, true},
+		{"", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.proto, func(t *testing.T) {
+			major, minor, err := parseHTTPVersion(tc.proto)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedMajor, major)
+			assert.Equal(t, tc.expectedMinor, minor)
+		})
+	}
+}
+
+func TestWantsKeepAlive(t *testing.T) {
+	testCases := []struct {
+		name     string
+		req      *request
+		expected bool
+	}{
+		{"HTTP/1.1 default", &request{proto: "HTTP/1.1", headers: map[string][]string{}}, true},
+		{"HTTP/1.1 close", &request{proto: "HTTP/1.1", headers: map[string][]string{"connection": {"close"}}}, false},
+		{"HTTP/1.0 default", &request{proto: "HTTP/1.0", headers: map[string][]string{}}, false},
+		{"HTTP/1.0 keep-alive", &request{proto: "HTTP/1.0", headers: map[string][]string{"connection": {"Keep-Alive"}}}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, wantsKeepAlive(tc.req))
+		})
+	}
+}
+
+func TestCheckExpectation(t *testing.T) {
+	testCases := []struct {
+		name             string
+		req              *request
+		expectedContinue bool
+		expectedError    error
+	}{
+		{
+			name:             "No expect header",
+			req:              &request{proto: "HTTP/1.1", headers: map[string][]string{"content-length": {"10"}}},
+			expectedContinue: false,
+		},
+		{
+			name:             "100-continue",
+			req:              &request{proto: "HTTP/1.1", headers: map[string][]string{"expect": {"100-Continue"}, "content-length": {"10"}}},
+			expectedContinue: true,
+		},
+		{
+			name:             "100-continue ignored for HTTP/1.0",
+			req:              &request{proto: "HTTP/1.0", headers: map[string][]string{"expect": {"100-continue"}, "content-length": {"10"}}},
+			expectedContinue: false,
+		},
+		{
+			name:          "Unknown expectation",
+			req:           &request{proto: "HTTP/1.1", headers: map[string][]string{"expect": {"foo"}}},
+			expectedError: errExpectationFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expectContinue, err := checkExpectation(tc.req)
+			if tc.expectedError != nil {
+				assert.True(t, errors.Is(err, tc.expectedError))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedContinue, expectContinue)
+		})
+	}
+}
+
+func TestRequestParserExpectContinue(t *testing.T) {
+	t.Run("100 Continue is sent before reading the body", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"
+		var interim bytes.Buffer
+
+		req, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{}, &interim)
+		assert.NoError(t, err)
+		assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", interim.String())
+		assert.Equal(t, []byte("hello"), req.body)
+	})
+
+	t.Run("100 Continue is not sent when the body is too large", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 2097152\r\n\r\n"
+		var interim bytes.Buffer
+
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{request: 1 << 20}, &interim)
+		assert.True(t, errors.Is(err, errPayloadTooLarge))
+		assert.Empty(t, interim.String())
+	})
+}
+
+func TestSizeLimitsBodyLimit(t *testing.T) {
+	testCases := []struct {
+		name        string
+		limits      sizeLimits
+		headerBytes int
+		expected    int
+	}{
+		{"No limits", sizeLimits{}, 100, -1},
+		{"Body limit", sizeLimits{body: 50}, 100, 50},
+		{"Request limit", sizeLimits{request: 150}, 100, 50},
+		{"Smallest limit wins", sizeLimits{request: 150, body: 10}, 100, 10},
+		{"Header section fills the request", sizeLimits{request: 100}, 120, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.limits.bodyLimit(tc.headerBytes))
+		})
+	}
+}
+
+func TestRequestParserSizeLimits(t *testing.T) {
+	t.Run("Body larger than the body limit", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world"
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{body: 10}, nil)
+		assert.True(t, errors.Is(err, errPayloadTooLarge))
+	})
+
+	t.Run("Body counted against the request limit", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world"
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{request: 40}, nil)
+		assert.True(t, errors.Is(err, errPayloadTooLarge))
+	})
+
+	t.Run("Header section larger than the header limit", func(t *testing.T) {
+		raw := "GET /foo HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\n"
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{header: 64}, nil)
+		assert.True(t, errors.Is(err, errHeaderTooLarge))
+	})
+
+	t.Run("Request within limits", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world"
+		req, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{request: 100, header: 64, body: 11}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello world"), req.body)
+	})
+
+	t.Run("Declared content-length is not allocated", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nContent-Length: 9223372036854775807\r\n\r\nhello world"
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{}, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid content-length", func(t *testing.T) {
+		raw := "PUT /foo HTTP/1.1\r\nContent-Length: -1\r\n\r\n"
+		_, err := requestParser(bufio.NewReader(strings.NewReader(raw)), sizeLimits{}, nil)
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, errPayloadTooLarge))
+	})
+}
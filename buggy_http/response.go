@@ -1,13 +1,18 @@
 package buggy_http
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"math"
+	"net"
 	net_http "net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -17,11 +22,33 @@ type response struct {
 	reasonPhrase string
 	headers      map[string][]string
 	body         []byte
+
+	// If stream is not nil, it is called to write the body in place of body.
+	// A stream without content-length header is sent with the chunked transfer coding.
+	stream func(w streamWriter) error
+
+	// Trailer fields sent after a chunked body, values can be set by stream.
+	trailers map[string][]string
+
+	// If hijack is not nil, the connection is handed to it after the response has been sent,
+	// with the reader that holds the bytes already received. The connection is closed when it returns.
+	hijack func(conn net.Conn, reader *bufio.Reader)
 }
 
 // generateResponse generates a response for a give request.
 // If error is not nil, the returned response have the HTTP code associated with that error.
-func generateResponse(request *request, t time.Duration, baseDir string) (*response, error) {
+// The write timeout only bounds the time to build the response: stream bodies, like event
+// streams, are written after it returns.
+func generateResponse(request *request, config *buggyConfig) (*response, error) {
+
+	// The client and the credentials are checked on the path requested by the client, before any rewrite,
+	// reply() checks them again on the rewritten path.
+	if r, err := checkPathAccess(request, config); r != nil {
+		return r, err
+	}
+	if r, err := authorize(request, config); r != nil {
+		return r, err
+	}
 
 	ch := make(chan *struct {
 		r   *response
@@ -29,7 +56,7 @@ func generateResponse(request *request, t time.Duration, baseDir string) (*respo
 	})
 
 	go func() {
-		r, err := reply(request, baseDir)
+		r, err := reply(request, config)
 		ch <- &struct {
 			r   *response
 			err error
@@ -40,40 +67,154 @@ func generateResponse(request *request, t time.Duration, baseDir string) (*respo
 	case result := <-ch:
 		return result.r, result.err
 
-	case <-time.After(t):
+	case <-time.After(config.writeTimeout):
 		return r500(), fmt.Errorf("generateResponse() -> %s, %s: the server has exceeded the time limit to generate a response. 500 sent", request.method, request.path)
 	}
 }
 
-func reply(request *request, baseDir string) (*response, error) {
+func reply(request *request, config *buggyConfig) (*response, error) {
+
+	baseDir := config.baseDir
 
-	if request.proto != "HTTP/1.1" {
+	// Every HTTP/1.x client is answered with HTTP/1.1, the highest minor version supported.
+	// See https://www.rfc-editor.org/rfc/rfc9110#section-6.2
+	if major, _, err := parseHTTPVersion(request.proto); err != nil || major != 1 {
 		return addCloseConnectionHeader(r505()), fmt.Errorf("reply() -> %s, %s: HTTP version not supported. 505 sent", request.method, request.path)
 	}
 
+	if len(config.rules) > 0 {
+		rewritten, redirect := applyRules(request, config.rules)
+		if redirect != nil {
+			return redirect, nil
+		}
+
+		// A rule can rewrite a public path into a protected prefix, so the new path is checked too.
+		if rewritten != request {
+			if r, err := checkPathAccess(rewritten, config); r != nil {
+				return r, err
+			}
+			if r, err := authorize(rewritten, config); r != nil {
+				return r, err
+			}
+		}
+		request = rewritten
+	}
+
+	if handler := findWebSocketHandler(request, config); handler != nil {
+		return replyToWebSocket(request, handler, config)
+	}
+
+	if handler := findEventStreamHandler(request, config); handler != nil {
+		return replyToEventStream(request, handler, config)
+	}
+
+	if route := findProxyRoute(request, config); route != nil {
+		return replyToProxy(request, route, config)
+	}
+
+	if route := findFastCGIRoute(request, config); route != nil {
+		return replyToFastCGI(request, route, config)
+	}
+
+	if isCGIRequest(request, config) {
+		return replyToCGI(request, config)
+	}
+
+	if config.webdav && isDAVMethod(request.method) {
+		return replyToDAV(request, config)
+	}
+
 	switch request.method {
 	case "OPTIONS":
-		return replyToOPTIONS(request, baseDir)
+		return replyToOPTIONS(request, config)
 
 	case "GET":
-		return replyToGET(request, baseDir)
+		if isUploadEndpoint(request, config) {
+			return replyToUploadForm(request, config)
+		}
+		if fallback := spaFallback(request, config); fallback != nil {
+			request = fallback
+		}
+		r, err := replyToGET(request, baseDir)
+		if config.liveReload != nil {
+			injectReloadScript(r, request.method)
+		}
+		return r, err
 
 	case "HEAD":
-		return replyToHEAD(request, baseDir)
+		if isUploadEndpoint(request, config) {
+			return replyToUploadForm(request, config)
+		}
+		if fallback := spaFallback(request, config); fallback != nil {
+			request = fallback
+		}
+		r, err := replyToHEAD(request, baseDir)
+		if config.liveReload != nil {
+			injectReloadScript(r, request.method)
+		}
+		return r, err
+
+	case "POST":
+		if isUploadEndpoint(request, config) {
+			return replyToPOST(request, config)
+		}
+		return r405(allowedMethods(config)), fmt.Errorf("reply() -> %s, %s: POST is allowed only to the upload endpoint. 405 sent", request.method, request.path)
+
+	case "PUT":
+		if config.uploads {
+			return replyToPUT(request, config)
+		}
+		return r405(allowedMethods(config)), fmt.Errorf("reply() -> %s, %s: uploads are disabled. 405 sent", request.method, request.path)
+
+	case "DELETE":
+		if config.uploads && len(config.deletePrefixes) > 0 {
+			return replyToDELETE(request, config)
+		}
+		return r405(allowedMethods(config)), fmt.Errorf("reply() -> %s, %s: deletes are disabled. 405 sent", request.method, request.path)
 
 	default:
-		return r405(), fmt.Errorf("reply() -> %s, %s: HTTP method not allowed. 405 sent", request.method, request.path)
+		return r405(allowedMethods(config)), fmt.Errorf("reply() -> %s, %s: HTTP method not allowed. 405 sent", request.method, request.path)
 	}
 
 }
 
-func replyToOPTIONS(request *request, baseDir string) (*response, error) {
+// allowedMethods returns the HTTP methods enabled by config.
+func allowedMethods(config *buggyConfig) []string {
+	methods := []string{"GET", "HEAD", "OPTIONS"}
+	if config.uploads {
+		methods = append(methods, "PUT")
+		if config.uploadEndpoint != "" {
+			methods = append(methods, "POST")
+		}
+		if len(config.deletePrefixes) > 0 {
+			methods = append(methods, "DELETE")
+		}
+	}
+	if config.webdav {
+		methods = append(methods, "PROPFIND", "PROPPATCH")
+		if config.uploads {
+			methods = append(methods, "MKCOL", "COPY", "MOVE")
+		}
+	}
+	return methods
+}
+
+func replyToOPTIONS(request *request, config *buggyConfig) (*response, error) {
 
 	// asterisk (*) refer to the entire server.
 	if request.path != "*" {
 
-		_, err := validatePath(baseDir, request.path)
-		if err != nil {
+		// WebDAV clients also send OPTIONS to directories.
+		if config.webdav {
+			_, filePath, err := davResource(request.path, config)
+			if err == nil {
+				_, err = os.Stat(filePath)
+			}
+			if err != nil {
+				return r404(), fmt.Errorf("replyToOPTIONS() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+			}
+
+		} else if _, err := validatePath(config.baseDir, request.path); err != nil {
 			return r404(), fmt.Errorf("replyToOPTIONS() -> %s, %s : %w. 404 sent", request.method, request.path, err)
 		}
 	}
@@ -81,12 +222,17 @@ func replyToOPTIONS(request *request, baseDir string) (*response, error) {
 	t := time.Now().UTC()
 
 	headers := map[string][]string{
-		"allow":         {"GET", "HEAD", "OPTIONS"},
+		"allow":         allowedMethods(config),
 		"cache-control": {"max-age=604800"},
 		"date":          {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
 		"server":        {"BuggyServer"},
 	}
 
+	// WebDAV compliance class, see https://www.rfc-editor.org/rfc/rfc4918#section-10.1
+	if config.webdav {
+		headers["dav"] = []string{"1"}
+	}
+
 	return &response{
 		proto:        "HTTP/1.1",
 		code:         204,
@@ -176,27 +322,144 @@ func replyToHEAD(request *request, baseDir string) (*response, error) {
 }
 
 func serializeResponse(response *response) string {
+	return serializeHead(response) + string(response.body)
+}
+
+// responseParser reads a response from reader, it is used to read the responses of other servers.
+// method is the method of the request, responses to HEAD have no content.
+// Interim 1xx responses are skipped. The body is decoded if it has the chunked transfer coding,
+// and is read until the end of reader if it has no content-length. maxBytes limits the size
+// of the body, zero or negative means there is no limit.
+func responseParser(reader *bufio.Reader, method string, maxBytes int) (*response, error) {
+	for {
+		r, err := responseHeadParser(reader)
+		if err != nil {
+			return r, fmt.Errorf("responseParser(): %w", err)
+		}
 
-	r := fmt.Sprintf("%s %d %s\r\n", response.proto, response.code, response.reasonPhrase)
+		if r.code >= 100 && r.code < 200 {
+			continue
+		}
+
+		if method == "HEAD" || r.code == 204 || r.code == 304 {
+			r.body = make([]byte, 0)
+			return r, nil
+		}
+
+		if headerFinder(r.headers, "transfer-encoding", "chunked") {
+			body, trailers, err := readChunked(reader, maxBytes)
+			if err != nil {
+				return r, fmt.Errorf("responseParser(): %w", err)
+			}
+			r.body = body
+			for name, values := range trailers {
+				r.headers[name] = append(r.headers[name], values...)
+			}
+			return r, nil
+		}
 
-	for key, values := range response.headers {
-		r += key + ": "
-		for i, value := range values {
-			r += value
-			if i != len(values)-1 {
-				r += ", "
+		if _, ok := r.headers["content-length"]; ok {
+			contentLength, err := parseContentLength(r.headers)
+			if err != nil {
+				return r, fmt.Errorf("responseParser(): %w", err)
+			}
+			if r.body, err = copyBody(reader, contentLength, maxBytes); err != nil {
+				return r, fmt.Errorf("responseParser(): %w", err)
 			}
+			return r, nil
+		}
+
+		body, err := copyBody(reader, -1, maxBytes)
+		if err != nil {
+			return r, fmt.Errorf("responseParser(): %w", err)
 		}
-		r += "\r\n"
+		r.body = body
+		return r, nil
 	}
+}
 
-	r += "\r\n" + string(response.body)
+// responseHeadParser reads the status line and the header section of a response.
+func responseHeadParser(reader *bufio.Reader) (*response, error) {
+	var byteCount int
 
-	return r
+	statusLine, err := readLine(reader, &byteCount, 0)
+	if err != nil {
+		return &response{}, fmt.Errorf("responseHeadParser(): %w", err)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(string(statusLine)), " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return &response{}, fmt.Errorf("responseHeadParser(): invalid status line: %q", statusLine)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 || code > 599 {
+		return &response{}, fmt.Errorf("responseHeadParser(): invalid status code: %q", statusLine)
+	}
+
+	r := &response{
+		proto:   parts[0],
+		code:    code,
+		headers: make(map[string][]string),
+	}
+	if len(parts) == 3 {
+		r.reasonPhrase = parts[2]
+	}
+
+	for {
+		line, err := readLine(reader, &byteCount, 0)
+		if err != nil {
+			return r, fmt.Errorf("responseHeadParser(): %w", err)
+		}
+		if strings.TrimSpace(string(line)) == "" {
+			break
+		}
+
+		name, value, err := headerLineParser(string(line))
+		if err != nil {
+			return r, fmt.Errorf("responseHeadParser(): %w", err)
+		}
+
+		// The value of set-cookie can contain commas, and cannot be combined.
+		if name == "set-cookie" {
+			_, raw, _ := strings.Cut(string(line), ":")
+			value = []string{strings.TrimSpace(raw)}
+		}
+
+		r.headers[name] = append(r.headers[name], value...)
+	}
+
+	return r, nil
+}
+
+// serializeHead serializes the status line and the header section of a response.
+func serializeHead(response *response) string {
+	return fmt.Sprintf("%s %d %s\r\n", response.proto, response.code, response.reasonPhrase) +
+		serializeFields(response.headers) + "\r\n"
 }
 
 func validatePath(baseDir string, p string) (string, error) {
 
+	absPath, err := resolvePath(baseDir, p)
+	if err != nil {
+		return "", err
+	}
+
+	// Check if the file exists
+	fileInfo, err := os.Stat(absPath)
+	if err != nil {
+		return "", err
+	}
+	if fileInfo.IsDir() {
+		return "", fmt.Errorf("validatePath(): invalid path path is to a directory")
+	}
+
+	return absPath, nil
+}
+
+// resolvePath returns the absolute path of p inside baseDir,
+// without checking if it exists.
+func resolvePath(baseDir string, p string) (string, error) {
+
 	path := filepath.Join(baseDir, p)
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -209,20 +472,96 @@ func validatePath(baseDir string, p string) (string, error) {
 	}
 
 	// Check for path traversal
-	if !strings.HasPrefix(absPath, absBaseDir) {
+	if absPath != absBaseDir && !strings.HasPrefix(absPath, absBaseDir+string(filepath.Separator)) {
 		return "", fmt.Errorf("validatePath(): invalid path: path is outside the base directory")
 	}
 
-	// Check if the file exists
-	fileInfo, err := os.Stat(absPath)
+	return absPath, nil
+}
+
+// checkRealDir returns an error if dir, once its symbolic links are resolved, is outside baseDir.
+// resolvePath only checks the path lexically, so the requests that change files check the
+// directory they write in: a link under baseDir must not let them write outside of it.
+// Only the existing part of dir is resolved, the missing directories are created inside it.
+func checkRealDir(baseDir string, dir string) error {
+	absBaseDir, err := filepath.Abs(baseDir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if fileInfo.IsDir() {
-		return "", fmt.Errorf("validatePath(): invalid path path is to a directory")
+	realBaseDir, err := filepath.EvalSymlinks(absBaseDir)
+	if err != nil {
+		return err
 	}
 
-	return absPath, nil
+	for {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if realDir != realBaseDir && !strings.HasPrefix(realDir, realBaseDir+string(filepath.Separator)) {
+				return fmt.Errorf("checkRealDir(): %s is outside the base directory", realDir)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+func r101(protocol string) *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":       {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":     {"BuggyServer"},
+		"upgrade":    {protocol},
+		"connection": {"Upgrade"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         101,
+		reasonPhrase: "Switching Protocols",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r201() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         201,
+		reasonPhrase: "Created",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r204() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":   {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server": {"BuggyServer"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         204,
+		reasonPhrase: "No Content",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
 }
 
 func r400() *response {
@@ -243,6 +582,23 @@ func r400() *response {
 	}
 }
 
+func r403() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         403,
+		reasonPhrase: "Forbidden",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
 func r404() *response {
 	t := time.Now().UTC()
 
@@ -260,11 +616,11 @@ func r404() *response {
 	}
 }
 
-func r405() *response {
+func r405(allow []string) *response {
 	t := time.Now().UTC()
 
 	headers := map[string][]string{
-		"allow":          {"GET", "HEAD", "OPTIONS"},
+		"allow":          allow,
 		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
 		"server":         {"BuggyServer"},
 		"content-length": {"0"},
@@ -296,6 +652,130 @@ func r408() *response {
 	}
 }
 
+func r409() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         409,
+		reasonPhrase: "Conflict",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r412() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         412,
+		reasonPhrase: "Precondition Failed",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r413() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"connection":     {"close"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         413,
+		reasonPhrase: "Content Too Large",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r415() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         415,
+		reasonPhrase: "Unsupported Media Type",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r417() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"connection":     {"close"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         417,
+		reasonPhrase: "Expectation Failed",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r426() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"upgrade":        {"websocket"},
+		"connection":     {"Upgrade"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         426,
+		reasonPhrase: "Upgrade Required",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r431() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"connection":     {"close"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         431,
+		reasonPhrase: "Request Header Fields Too Large",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
 func r500() *response {
 	t := time.Now().UTC()
 
@@ -314,6 +794,57 @@ func r500() *response {
 	}
 }
 
+func r502() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         502,
+		reasonPhrase: "Bad Gateway",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r503() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         503,
+		reasonPhrase: "Service Unavailable",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
+func r504() *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         504,
+		reasonPhrase: "Gateway Timeout",
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
+
 func r505() *response {
 	t := time.Now().UTC()
 
@@ -341,7 +872,7 @@ func addCloseConnectionHeader(r *response) *response {
 // Add 'connection: keep-alive' and 'keep-alive: timeout=X, max=10' headers to a response
 func addKeepAliveHeaders(r *response, timeout int) *response {
 	r.headers["connection"] = []string{"keep-alive"}
-	if timeout != (1<<63 - 1) {
+	if timeout != int(noTimeout) {
 		r.headers["keep-alive"] = []string{fmt.Sprintf("timeout=%d", timeout/int(math.Pow(10, 9)))}
 	}
 	return r
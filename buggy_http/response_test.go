@@ -1,8 +1,10 @@
 package buggy_http
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -39,3 +41,112 @@ func TestSerializeResponse(t *testing.T) {
 
 	assert.True(t, result == expected1 || result == expected2, "The result does not match any of the expected strings.")
 }
+
+func TestAllowedMethods(t *testing.T) {
+	t.Run("Read-only server", func(t *testing.T) {
+		assert.Equal(t, []string{"GET", "HEAD", "OPTIONS"}, allowedMethods(&buggyConfig{}))
+	})
+
+	t.Run("Uploads enabled", func(t *testing.T) {
+		assert.Equal(t, []string{"GET", "HEAD", "OPTIONS", "PUT"}, allowedMethods(&buggyConfig{uploads: true}))
+	})
+
+	t.Run("Uploads and deletes enabled", func(t *testing.T) {
+		config := &buggyConfig{uploads: true, deletePrefixes: []string{"/tmp"}}
+		assert.Equal(t, []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}, allowedMethods(config))
+	})
+
+	t.Run("Deletes without uploads", func(t *testing.T) {
+		config := &buggyConfig{deletePrefixes: []string{"/tmp"}}
+		assert.Equal(t, []string{"GET", "HEAD", "OPTIONS"}, allowedMethods(config))
+	})
+}
+
+func TestResponseParser(t *testing.T) {
+	parse := func(raw string, method string) (*response, error) {
+		return responseParser(bufio.NewReader(strings.NewReader(raw)), method, 0)
+	}
+
+	t.Run("Content-Length body", func(t *testing.T) {
+		r, err := parse("HTTP/1.1 404 Not Found\r\nContent-Length: 3\r\n\r\nabcdef", "GET")
+		assert.NoError(t, err)
+		assert.Equal(t, 404, r.code)
+		assert.Equal(t, "Not Found", r.reasonPhrase)
+		assert.Equal(t, "abc", string(r.body))
+	})
+
+	t.Run("Chunked body with trailer", func(t *testing.T) {
+		r, err := parse("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\nX-Sum: 1\r\n\r\n", "GET")
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", string(r.body))
+		assert.Equal(t, []string{"1"}, r.headers["x-sum"])
+	})
+
+	t.Run("Body until EOF", func(t *testing.T) {
+		r, err := parse("HTTP/1.0 200 OK\r\n\r\nabc", "GET")
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", string(r.body))
+	})
+
+	t.Run("HEAD has no body", func(t *testing.T) {
+		r, err := parse("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n", "HEAD")
+		assert.NoError(t, err)
+		assert.Empty(t, r.body)
+		assert.Equal(t, []string{"3"}, r.headers["content-length"])
+	})
+
+	t.Run("Interim responses are skipped", func(t *testing.T) {
+		r, err := parse("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n", "PUT")
+		assert.NoError(t, err)
+		assert.Equal(t, 204, r.code)
+	})
+
+	t.Run("Set-Cookie values are not split", func(t *testing.T) {
+		r, err := parse("HTTP/1.1 200 OK\r\nSet-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nSet-Cookie: b=2\r\nContent-Length: 0\r\n\r\n", "GET")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, r.headers["set-cookie"])
+	})
+
+	t.Run("Invalid status line", func(t *testing.T) {
+		_, err := parse("FOO 200 OK\r\n\r\n", "GET")
+		assert.Error(t, err)
+		_, err = parse("HTTP/1.1 abc OK\r\n\r\n", "GET")
+		assert.Error(t, err)
+	})
+}
+
+func TestResponseParserLimits(t *testing.T) {
+	parse := func(raw string, maxBytes int) (*response, error) {
+		return responseParser(bufio.NewReader(strings.NewReader(raw)), "GET", maxBytes)
+	}
+
+	t.Run("Bodies under the limit", func(t *testing.T) {
+		for _, raw := range []string{
+			"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\n\r\nhello",
+		} {
+			r, err := parse(raw, 5)
+			assert.NoError(t, err, raw)
+			assert.Equal(t, "hello", string(r.body), raw)
+		}
+	})
+
+	t.Run("Bodies over the limit", func(t *testing.T) {
+		for _, raw := range []string{
+			"HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nhello!",
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n",
+			"HTTP/1.1 200 OK\r\n\r\nhello!",
+		} {
+			_, err := parse(raw, 5)
+			assert.ErrorIs(t, err, errPayloadTooLarge, raw)
+		}
+	})
+
+	t.Run("Declared sizes are not allocated", func(t *testing.T) {
+		_, err := parse("HTTP/1.1 200 OK\r\nContent-Length: 9223372036854775807\r\n\r\nhello", 0)
+		assert.Error(t, err)
+		_, err = parse("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7fffffffffffffff\r\nhello", 0)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,227 @@
+package buggy_http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	net_http "net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of rule matchers.
+const (
+	matchPrefix = "prefix"
+	matchGlob   = "glob"
+	matchRegex  = "regex"
+)
+
+// rule rewrites the path of the requests it matches, or redirects them.
+type rule struct {
+	// The redirect status code, zero for an internal rewrite.
+	redirect int
+
+	// One of matchPrefix, matchGlob or matchRegex.
+	kind    string
+	pattern string
+
+	// The compiled pattern of glob and regex rules.
+	re *regexp.Regexp
+
+	// The new path or location, $1, $2 or ${name} are replaced by the captures of re.
+	target string
+}
+
+// newRule validates and compiles a rule.
+// A redirect must be 301, 302, 307 or 308, and a rewrite target must be a path.
+func newRule(redirect int, kind string, pattern string, target string) (*rule, error) {
+	switch redirect {
+	case 0:
+		if !strings.HasPrefix(target, "/") {
+			return nil, fmt.Errorf("newRule(): rewrite target %q must start with /", target)
+		}
+	case 301, 302, 307, 308:
+		if target == "" {
+			return nil, fmt.Errorf("newRule(): redirect target cannot be empty")
+		}
+	default:
+		return nil, fmt.Errorf("newRule(): %d is not a redirect status code, use 301, 302, 307 or 308", redirect)
+	}
+
+	r := &rule{redirect: redirect, kind: kind, pattern: pattern, target: target}
+
+	var err error
+	switch kind {
+	case matchPrefix:
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("newRule(): prefix %q must start with /", pattern)
+		}
+		r.pattern = path.Clean(pattern)
+	case matchGlob:
+		r.re, err = regexp.Compile(globToRegex(pattern))
+	case matchRegex:
+		r.re, err = regexp.Compile(pattern)
+	default:
+		return nil, fmt.Errorf("newRule(): unknown matcher %q, use prefix, glob or regex", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("newRule(): %w", err)
+	}
+	return r, nil
+}
+
+// globToRegex converts a glob pattern to an anchored regular expression.
+// '*' matches any sequence of characters but '/', '**' any sequence, and '?' a single character but '/'.
+// Every wildcard is a capture group, numbered from 1 in order.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString("(.*)")
+			i++
+		case glob[i] == '*':
+			b.WriteString("([^/]*)")
+		case glob[i] == '?':
+			b.WriteString("([^/])")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// match returns the target of the rule for the URL path p, and whether it matches.
+// Prefix rules replace the prefix with their target.
+func (r *rule) match(p string) (string, bool) {
+	if r.kind == matchPrefix {
+		if !hasPathPrefix(p, r.pattern) {
+			return "", false
+		}
+		rest := strings.TrimPrefix(p, strings.TrimSuffix(r.pattern, "/"))
+		if rest == "" || strings.HasSuffix(r.target, "/") {
+			rest = strings.TrimPrefix(rest, "/")
+		}
+		return r.target + rest, true
+	}
+
+	captures := r.re.FindStringSubmatchIndex(p)
+	if captures == nil {
+		return "", false
+	}
+	return string(r.re.ExpandString(nil, r.target, p, captures)), true
+}
+
+// applyRules evaluates rules in order against the path of request, the first one that matches wins.
+// It returns the rewritten request, or the redirect response. If no rule matches request is returned.
+// The query of request is kept, after the one of the target if it has one.
+func applyRules(request *request, rules []*rule) (*request, *response) {
+	p, query, _ := strings.Cut(request.path, "?")
+
+	for _, r := range rules {
+		target, ok := r.match(p)
+		if !ok {
+			continue
+		}
+
+		if query != "" {
+			if strings.Contains(target, "?") {
+				target += "&" + query
+			} else {
+				target += "?" + query
+			}
+		}
+
+		if r.redirect != 0 {
+			return nil, rRedirect(r.redirect, target)
+		}
+
+		rewritten := *request
+		rewritten.path = target
+		return &rewritten, nil
+	}
+
+	return request, nil
+}
+
+// parseRules reads a list of rules, one per line:
+//
+//	rewrite MATCHER PATTERN TARGET
+//	redirect CODE MATCHER PATTERN TARGET
+//
+// MATCHER is prefix, glob or regex. Empty lines and lines starting with # are skipped.
+func parseRules(reader io.Reader) ([]*rule, error) {
+	var rules []*rule
+
+	scanner := bufio.NewScanner(reader)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var r *rule
+		var err error
+
+		switch {
+		case fields[0] == "rewrite" && len(fields) == 4:
+			r, err = newRule(0, fields[1], fields[2], fields[3])
+
+		case fields[0] == "redirect" && len(fields) == 5:
+			code, convErr := strconv.Atoi(fields[1])
+			if convErr != nil {
+				return nil, fmt.Errorf("parseRules(): line %d: invalid redirect code %q", n, fields[1])
+			}
+			r, err = newRule(code, fields[2], fields[3], fields[4])
+
+		default:
+			return nil, fmt.Errorf("parseRules(): line %d: expected \"rewrite MATCHER PATTERN TARGET\" or \"redirect CODE MATCHER PATTERN TARGET\"", n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parseRules(): line %d: %w", n, err)
+		}
+		rules = append(rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("parseRules(): %w", err)
+	}
+
+	return rules, nil
+}
+
+// loadRules reads the rules of rulesFile.
+func loadRules(rulesFile string) ([]*rule, error) {
+	file, err := os.Open(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("loadRules(): %w", err)
+	}
+	defer file.Close()
+
+	return parseRules(file)
+}
+
+// rRedirect returns a redirect response with code to location.
+func rRedirect(code int, location string) *response {
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"location":       {location},
+		"content-length": {"0"},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         code,
+		reasonPhrase: net_http.StatusText(code),
+		headers:      headers,
+		body:         make([]byte, 0),
+	}
+}
@@ -0,0 +1,155 @@
+package buggy_http
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobToRegex(t *testing.T) {
+	assert.Equal(t, `^/blog/([^/]*)\.html$`, globToRegex("/blog/*.html"))
+	assert.Equal(t, `^/assets/(.*)$`, globToRegex("/assets/**"))
+	assert.Equal(t, `^/v([^/])/x$`, globToRegex("/v?/x"))
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		kind, pattern, target string
+		path                  string
+		want                  string
+		ok                    bool
+	}{
+		{"prefix", "/docs", "/manual", "/docs/intro.html", "/manual/intro.html", true},
+		{"prefix", "/docs/", "/manual/", "/docs/intro.html", "/manual/intro.html", true},
+		{"prefix", "/docs", "/manual", "/docs", "/manual", true},
+		{"prefix", "/docs", "/manual", "/docsearch", "", false},
+		{"prefix", "/", "/v2", "/a/b", "/v2/a/b", true},
+		{"glob", "/blog/*/*.html", "/posts/$1-$2.html", "/blog/2024/hello.html", "/posts/2024-hello.html", true},
+		{"glob", "/blog/*.html", "/x", "/blog/a/b.html", "", false},
+		{"glob", "/assets/**", "/static/$1", "/assets/css/site.css", "/static/css/site.css", true},
+		{"regex", "^/users/([0-9]+)$", "/profile.html?id=$1", "/users/42", "/profile.html?id=42", true},
+		{"regex", "^/users/(?P<id>[0-9]+)$", "/u/${id}", "/users/7", "/u/7", true},
+		{"regex", "^/users/([0-9]+)$", "/x", "/users/abc", "", false},
+	}
+
+	for _, test := range tests {
+		r, err := newRule(0, test.kind, test.pattern, test.target)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		got, ok := r.match(test.path)
+		assert.Equal(t, test.ok, ok, test.pattern+" "+test.path)
+		assert.Equal(t, test.want, got, test.pattern+" "+test.path)
+	}
+}
+
+func TestNewRuleErrors(t *testing.T) {
+	_, err := newRule(0, "prefix", "/a", "relative")
+	assert.Error(t, err)
+	_, err = newRule(303, "prefix", "/a", "/b")
+	assert.Error(t, err)
+	_, err = newRule(0, "exact", "/a", "/b")
+	assert.Error(t, err)
+	_, err = newRule(0, "regex", "^/(a", "/b")
+	assert.Error(t, err)
+	_, err = newRule(0, "prefix", "a", "/b")
+	assert.Error(t, err)
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+# legacy paths
+redirect 301 prefix /old /new
+rewrite   regex ^/u/([0-9]+)$   /users.html?id=$1
+`))
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, 301, rules[0].redirect)
+		assert.Equal(t, "regex", rules[1].kind)
+	}
+
+	_, err = parseRules(strings.NewReader("rewrite prefix /a"))
+	assert.ErrorContains(t, err, "line 1")
+
+	_, err = parseRules(strings.NewReader("\nredirect moved prefix /a /b"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestApplyRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(`
+redirect 308 regex ^/api/v1/(.*)$ https://api.example.com/v2/$1
+rewrite prefix /docs /manual
+rewrite regex ^/u/([0-9]+)$ /users.html?id=$1
+rewrite prefix / /never
+`))
+	assert.NoError(t, err)
+
+	apply := func(path string) (*request, *response) {
+		return applyRules(&request{method: "GET", path: path, headers: map[string][]string{}}, rules)
+	}
+
+	t.Run("Redirect", func(t *testing.T) {
+		_, r := apply("/api/v1/users?page=2")
+		if assert.NotNil(t, r) {
+			assert.Equal(t, 308, r.code)
+			assert.Equal(t, "Permanent Redirect", r.reasonPhrase)
+			assert.Equal(t, []string{"https://api.example.com/v2/users?page=2"}, r.headers["location"])
+		}
+	})
+
+	t.Run("First matching rule wins", func(t *testing.T) {
+		req, r := apply("/docs/intro.html")
+		assert.Nil(t, r)
+		assert.Equal(t, "/manual/intro.html", req.path)
+	})
+
+	t.Run("Queries are merged", func(t *testing.T) {
+		req, _ := apply("/u/42?tab=posts")
+		assert.Equal(t, "/users.html?id=42&tab=posts", req.path)
+	})
+}
+
+func TestReplyWithRules(t *testing.T) {
+	baseDir := t.TempDir()
+	os.WriteFile(filepath.Join(baseDir, "new.html"), []byte("new page"), 0644)
+	os.WriteFile(filepath.Join(baseDir, "rules.txt"), []byte("rewrite prefix /old.html /new.html\nredirect 302 prefix /moved /new.html\n"), 0644)
+
+	bs := &buggyInstance{config: &buggyConfig{baseDir: baseDir, writeTimeout: 1<<63 - 1}}
+	assert.NoError(t, bs.SetRules(filepath.Join(baseDir, "rules.txt")))
+
+	r, err := reply(&request{method: "GET", path: "/old.html", proto: "HTTP/1.1", headers: map[string][]string{}}, bs.config)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.code)
+	assert.Equal(t, "new page", string(r.body))
+
+	r, err = reply(&request{method: "GET", path: "/moved", proto: "HTTP/1.1", headers: map[string][]string{}}, bs.config)
+	assert.NoError(t, err)
+	assert.Equal(t, 302, r.code)
+	assert.Equal(t, []string{"/new.html"}, r.headers["location"])
+}
+
+func TestRewriteIntoProtectedPrefix(t *testing.T) {
+	bs := newTestInstance(t)
+	os.MkdirAll(filepath.Join(bs.config.baseDir, "private"), 0755)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "private", "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "rules.txt"), []byte("rewrite prefix /public /private\n"), 0644)
+	assert.NoError(t, bs.SetRules(filepath.Join(bs.config.baseDir, "rules.txt")))
+	assert.NoError(t, bs.SetBasicAuth("/private", writeHtpasswd(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), ""))
+	assert.NoError(t, bs.SetPathAccessRules("/private", []string{"allow 10.0.0.0/8", "deny all"}))
+
+	get := func(remoteAddr string, headers map[string][]string) *response {
+		r, _ := generateResponse(&request{method: "GET", path: "/public/secret.txt", proto: "HTTP/1.1", headers: headers, remoteAddr: remoteAddr}, bs.config)
+		return r
+	}
+
+	assert.Equal(t, 403, get("192.0.2.1:5000", map[string][]string{}).code)
+	assert.Equal(t, 401, get("10.2.3.4:5000", map[string][]string{}).code)
+
+	credentials := strings.TrimSuffix(strings.TrimPrefix(basicAuthHeader("alice", "secret"), "Authorization: "), "\r\n")
+	r := get("10.2.3.4:5000", map[string][]string{"authorization": {credentials}})
+	assert.Equal(t, 200, r.code)
+	assert.Equal(t, "secret", string(r.body))
+}
@@ -8,8 +8,13 @@ import (
 	"log"
 	"math"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -27,8 +32,146 @@ type buggyConfig struct {
 	// If it is exceeded server respond with 500 code.
 	writeTimeout time.Duration
 
-	// The maximum size of request the server will accept in MiB.
-	maxRequestMiB int
+	// The maximum size of request the server will accept in bytes, zero means no limit.
+	maxRequestBytes int
+
+	// The maximum size of request line and header section the server will accept in bytes.
+	// If it is exceeded server respond with 431 code. Zero means no limit.
+	maxHeaderBytes int
+
+	// The maximum size of request body the server will accept in bytes.
+	// If it is exceeded server respond with 413 code. Zero means no limit.
+	maxBodyBytes int
+
+	// If true PUT requests write files under baseDir.
+	uploads bool
+
+	// If true PUT requests create the missing intermediate directories.
+	createDirs bool
+
+	// URL path prefixes under which DELETE requests can remove files,
+	// DELETE is enabled only if uploads is true and there is at least one prefix.
+	deletePrefixes []string
+
+	// If true DELETE requests can remove directories with all their content.
+	recursiveDelete bool
+
+	// URL path of the endpoint that accepts multipart/form-data uploads from browsers,
+	// empty means disabled. It requires uploads to be true.
+	uploadEndpoint string
+
+	// The maximum size in bytes of each file uploaded to uploadEndpoint, zero means no limit.
+	maxPartBytes int
+
+	// If true the WebDAV methods are enabled, so that baseDir can be mounted as a network drive.
+	// MKCOL, COPY and MOVE also require uploads to be true.
+	webdav bool
+
+	// Custom error pages, the key is the HTTP status code and the value
+	// is the path of the page relative to baseDir.
+	errorPages map[int]string
+
+	// URL path prefix of the directory with the CGI scripts, empty means disabled.
+	cgiPrefix string
+
+	// Paths sent to FastCGI applications.
+	fastcgi []*fastcgiRoute
+
+	// Path prefixes forwarded to upstream servers.
+	proxies []*proxyRoute
+
+	// The strategy to choose the backend of a proxied request: "round-robin", "least-conn" or "ip-hash".
+	balance string
+
+	// URL path requested to every backend each healthCheckInterval, empty means disabled.
+	// Backends that do not answer with a 2xx or 3xx code stop receiving requests until they pass a check.
+	healthCheckPath     string
+	healthCheckInterval time.Duration
+
+	// After maxFails consecutive failed requests a backend is ejected for failTimeout.
+	// Zero or negative maxFails means backends are never ejected.
+	maxFails    int
+	failTimeout time.Duration
+
+	// The maximum duration to connect to an upstream server and receive its response.
+	// If it is exceeded server respond with 504 code. Zero means there is no timeout.
+	proxyTimeout time.Duration
+
+	// The idle keep-alive connections to the upstream servers.
+	upstreams *upstreamPool
+
+	// WebSocket handlers by URL path.
+	websockets map[string]WebSocketHandler
+
+	// The maximum size of a WebSocket message the server will accept in bytes.
+	// If it is exceeded the connection is closed with 1009 code. Zero means no limit.
+	maxMessageBytes int
+
+	// Event stream handlers by URL path.
+	eventStreams map[string]EventStreamHandler
+
+	// The interval between the comments sent on idle event streams, zero means never.
+	heartbeat time.Duration
+
+	// If not nil baseDir is watched, and the browsers reload the HTML pages when it changes.
+	liveReload *liveReload
+
+	// URL path of the file served for the paths of a single-page application
+	// that match no file, empty means disabled.
+	spaFallback string
+
+	// URL path prefixes that never fall back to spaFallback.
+	spaExclude []string
+
+	// Rewrite and redirect rules, evaluated in order before any other routing.
+	rules []*rule
+
+	// The permissions of the Unix domain sockets, zero means they are not changed.
+	socketMode os.FileMode
+
+	// The owner of the Unix domain sockets, "user", ":group" or "user:group".
+	// Empty means it is not changed.
+	socketOwner string
+
+	// Path prefixes that require basic auth.
+	auth []*authRoute
+
+	// Rules checked in order on the client of every accepted connection, the denied ones are closed.
+	access []accessRule
+
+	// Rules checked on the client of the requests under a path prefix, the denied ones are answered with 403 code.
+	pathAccess []*pathAccess
+
+	// The proxies whose X-Forwarded-For header is trusted, their networks are the ones of allow rules.
+	trustedProxies []accessRule
+
+	// If true the connections of trustedProxies start with a PROXY protocol header.
+	proxyProtocol bool
+}
+
+// sizeLimits returns the configured request size limits.
+func (c *buggyConfig) sizeLimits() sizeLimits {
+	return sizeLimits{request: c.maxRequestBytes, header: c.maxHeaderBytes, body: c.maxBodyBytes}
+}
+
+// noTimeout is the value of readTimeout and writeTimeout when there is no timeout, about 290 years.
+const noTimeout time.Duration = 1<<63 - 1
+
+// Sizes of the units accepted by the setters.
+const (
+	kiB = 1 << 10
+	miB = 1 << 20
+)
+
+// toBytes converts size units to bytes, zero or negative size means no limit and returns zero.
+func toBytes(size int, unit int) (int, error) {
+	if size <= 0 {
+		return 0, nil
+	}
+	if size > math.MaxInt/unit {
+		return 0, fmt.Errorf("size too large")
+	}
+	return size * unit, nil
 }
 
 // [buggyInstance] is the struct that implements the BuggyServer interface.
@@ -36,20 +179,73 @@ type buggyInstance struct {
 	// The net.Listener that accepts tcp connections.
 	listener net.Listener
 
+	// The listeners merged in listener, with the addresses they were opened for.
+	listeners []boundListener
+
 	// A channel that can be closed to signal the server to stop.
 	quit chan struct{}
 
 	// The configuration settings for the server.
 	config *buggyConfig
+
+	// The configuration used by new connections once the server has started,
+	// Reload replaces it while the server is running.
+	live atomic.Pointer[buggyConfig]
+
+	// Serializes the calls to Reload.
+	reloadMu sync.Mutex
+
+	// Closed when listenForConn returns.
+	acceptDone chan struct{}
+
+	// The open connections accepted by listenForConn.
+	connsMu sync.Mutex
+	conns   map[net.Conn]connState
+
+	// Set by Shutdown, that waits on drained for the connections to be closed
+	// once no connection can be accepted anymore.
+	draining      bool
+	acceptStopped bool
+	drained       chan struct{}
 }
 
 type BuggyServer interface {
 	SetReadTimeout(seconds int) error
 	SetWriteTimeout(seconds int) error
 	SetmaxRequestMiB(size int) error
+	SetMaxHeaderKiB(size int) error
+	SetMaxBodyMiB(size int) error
 	SetBaseDir(path string) error
+	SetErrorPage(code int, path string) error
+	SetUploads(enabled bool, createDirs bool) error
+	SetDeletePrefixes(prefixes []string, recursive bool) error
+	SetUploadEndpoint(endpoint string, maxPartMiB int) error
+	SetWebDAV(enabled bool) error
+	SetCGI(prefix string) error
+	SetFastCGI(pattern string, address string) error
+	SetProxy(prefix string, upstreams ...string) error
+	SetProxyTimeout(seconds int) error
+	SetProxyBalance(strategy string) error
+	SetHealthCheck(path string, intervalSeconds int) error
+	SetMaxFails(maxFails int, failTimeoutSeconds int) error
+	SetWebSocket(path string, handler WebSocketHandler) error
+	SetMaxMessageKiB(size int) error
+	SetEventStream(path string, handler EventStreamHandler) error
+	SetHeartbeat(seconds int) error
+	SetWatch(enabled bool) error
+	SetSPA(fallback string, exclude []string) error
+	SetRules(path string) error
+	SetUnixSocket(mode os.FileMode, owner string) error
+	SetBasicAuth(prefix string, htpasswdPath string, realm string) error
+	SetAccessRules(rules []string) error
+	SetPathAccessRules(prefix string, rules []string) error
+	SetTrustedProxies(proxies []string, proxyProtocol bool) error
+	Reload(cfg Config) error
 	StartBuggyServer(host string, port uint) error
+	StartBuggyServerOn(addresses ...string) error
 	StopBuggyServer() error
+	Shutdown(timeout time.Duration) error
+	Upgrade() error
 
 	handleConnection(conn net.Conn)
 	listenForConn()
@@ -60,16 +256,46 @@ type BuggyServer interface {
 //	baseDir: "./"
 //	readTimeout: 290 years -> NO timeout
 //	writeTimeout: 290 years -> NO timeout
-//	maxRequestMiB: -1 MiB -> NO maximum size
+//	maxRequestBytes: 0 -> NO maximum size
+//	maxHeaderBytes: 0 -> NO maximum size
+//	maxBodyBytes: 0 -> NO maximum size
+//	errorPages: none -> default error pages
+//	uploads: false -> read-only server
+//	deletePrefixes: none -> DELETE disabled
+//	uploadEndpoint: "" -> POST disabled
+//	webdav: false -> WebDAV disabled
+//	cgiPrefix: "" -> CGI disabled
+//	fastcgi: none -> no path is sent to FastCGI applications
+//	proxies: none -> no path is forwarded
+//	proxyTimeout: 0 -> NO timeout
+//	balance: "round-robin"
+//	healthCheckPath: "" -> NO active health checks
+//	maxFails: 3, failTimeout: 30 seconds
+//	websockets: none -> no WebSocket endpoint
+//	maxMessageBytes: 1 MiB
+//	eventStreams: none -> no event stream endpoint
+//	heartbeat: 15 seconds
+//	watch: false -> no live reload
+//	spaFallback: "" -> missing files are 404
+//	rules: none -> paths are not rewritten
+//	socketMode: 0, socketOwner: "" -> Unix sockets are created with the umask and the user of the process
+//	auth: none -> no path requires authentication
+//	access, pathAccess: none -> every client is allowed
+//	trustedProxies: none, proxyProtocol: false -> X-Forwarded-For and PROXY protocol headers are ignored
 func NewBuggyServer() BuggyServer {
 
 	// default values
 	return &buggyInstance{
 		config: &buggyConfig{
-			baseDir:       "./",
-			readTimeout:   (1<<63 - 1),
-			writeTimeout:  (1<<63 - 1),
-			maxRequestMiB: -1,
+			baseDir:         "./",
+			readTimeout:     noTimeout,
+			writeTimeout:    noTimeout,
+			errorPages:      make(map[int]string),
+			balance:         balanceRoundRobin,
+			maxFails:        3,
+			failTimeout:     30 * time.Second,
+			maxMessageBytes: 1024 * kiB,
+			heartbeat:       15 * time.Second,
 		},
 		quit: make(chan struct{}),
 	}
@@ -85,6 +311,19 @@ func NewBuggyServer() BuggyServer {
 //	host: The hostname or IP address on which the server should listen.
 //	port: The port number on which the server should listen.
 func (bs *buggyInstance) StartBuggyServer(host string, port uint) error {
+	return bs.StartBuggyServerOn(fmt.Sprintf("%s:%d", host, port))
+}
+
+// StartBuggyServerOn starts a BuggyServer that accepts connections on all the addresses:
+//
+//	host:port     a TCP socket
+//	unix:/path    a Unix domain socket, see SetUnixSocket()
+//	systemd       every socket passed by systemd socket activation
+//	systemd:NAME  the sockets passed by systemd with FileDescriptorName=NAME
+//
+// If an address cannot be listened on, the server is not started.
+// A process started by Upgrade() takes the listeners of its parent for the same addresses.
+func (bs *buggyInstance) StartBuggyServerOn(addresses ...string) error {
 
 	if bs.config.baseDir == "" ||
 		bs.quit == nil ||
@@ -92,18 +331,60 @@ func (bs *buggyInstance) StartBuggyServer(host string, port uint) error {
 		bs.config.writeTimeout == 0 {
 		return fmt.Errorf("StartBuggyServer(): Not all BuggyServer fields have a value, use NewBuggyServer()")
 	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("StartBuggyServerOn(): no address to listen on")
+	}
 
-	listenAddr := fmt.Sprintf("%s:%d", host, port)
-
-	l, err := net.Listen("tcp", listenAddr)
+	inherited, err := inheritedListeners()
 	if err != nil {
-		return fmt.Errorf("net.Listen(): %w", err)
+		return err
 	}
+	defer func() {
+		for _, ls := range inherited {
+			closeListeners(ls)
+		}
+	}()
 
-	log.Printf("Server started on: %s", listenAddr)
+	var bound []boundListener
+	var listeners []net.Listener
+	for _, address := range addresses {
+		ls, ok := inherited[address]
+		delete(inherited, address)
+		if !ok {
+			if ls, err = bs.listen(address); err != nil {
+				closeListeners(listeners)
+				return err
+			}
+		}
+		for _, l := range ls {
+			bound = append(bound, boundListener{Listener: l, address: address})
+		}
+		listeners = append(listeners, ls...)
+	}
 
-	bs.listener = l
+	for _, l := range listeners {
+		log.Printf("Server started on: %s", l.Addr())
+	}
+
+	bs.listeners = bound
+	if len(listeners) == 1 {
+		bs.listener = listeners[0]
+	} else {
+		bs.listener = newMultiListener(listeners)
+	}
+	bs.live.Store(bs.config)
+	bs.acceptDone = make(chan struct{})
 	go bs.listenForConn()
+	notifyUpgradeReady()
+
+	// Proxies and watch mode are not reloaded, so these use the configuration of the start, see Reload().
+	if bs.config.healthCheckPath != "" && len(bs.config.proxies) > 0 {
+		go runHealthChecks(bs.config, bs.quit)
+	}
+
+	if bs.config.liveReload != nil {
+		go runWatcher(bs.config.baseDir, bs.config.liveReload, bs.quit)
+	}
 	return nil
 
 }
@@ -119,7 +400,7 @@ func (bs *buggyInstance) SetReadTimeout(seconds int) error {
 	maxSeconds := (1<<63 - 1) / int(math.Pow(10, 9))
 
 	if seconds <= 0 {
-		bs.config.readTimeout = (1<<63 - 1)
+		bs.config.readTimeout = noTimeout
 		return nil
 	} else if seconds > maxSeconds {
 		return fmt.Errorf("SetReadTimeout(): number of seconds to large to fit in time.Duration ")
@@ -140,7 +421,7 @@ func (bs *buggyInstance) SetWriteTimeout(seconds int) error {
 	maxSeconds := (1<<63 - 1) / int(math.Pow(10, 9))
 
 	if seconds <= 0 {
-		bs.config.writeTimeout = (1<<63 - 1)
+		bs.config.writeTimeout = noTimeout
 		return nil
 	} else if seconds > maxSeconds {
 		return fmt.Errorf("SetWriteTimeout(): number of seconds to large to fit in time.Duration")
@@ -157,7 +438,41 @@ func (bs *buggyInstance) SetmaxRequestMiB(size int) error {
 		return fmt.Errorf("SetmaxRequestMiB(): BuggyServer has already been started, you can no longer change its configuration")
 	}
 
-	bs.config.maxRequestMiB = size
+	bytes, err := toBytes(size, miB)
+	if err != nil {
+		return fmt.Errorf("SetmaxRequestMiB(): %w", err)
+	}
+	bs.config.maxRequestBytes = bytes
+	return nil
+}
+
+// SetMaxHeaderKiB set the maximum size of request line and header section the server will accept in KiB.
+// Zero or negative value means there will be no maximum header size.
+func (bs *buggyInstance) SetMaxHeaderKiB(size int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetMaxHeaderKiB(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bytes, err := toBytes(size, kiB)
+	if err != nil {
+		return fmt.Errorf("SetMaxHeaderKiB(): %w", err)
+	}
+	bs.config.maxHeaderBytes = bytes
+	return nil
+}
+
+// SetMaxBodyMiB set the maximum size of request body the server will accept in MiB.
+// Zero or negative value means there will be no maximum body size.
+func (bs *buggyInstance) SetMaxBodyMiB(size int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetMaxBodyMiB(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bytes, err := toBytes(size, miB)
+	if err != nil {
+		return fmt.Errorf("SetMaxBodyMiB(): %w", err)
+	}
+	bs.config.maxBodyBytes = bytes
 	return nil
 }
 
@@ -189,22 +504,601 @@ func (bs *buggyInstance) SetBaseDir(path string) error {
 
 }
 
+// SetErrorPage set a custom page that is sent as body of error responses with the given code.
+// The path is relative to the base directory, code must be between 400 and 599.
+// Clients that prefer JSON over HTML still receive an application/problem+json body.
+func (bs *buggyInstance) SetErrorPage(code int, path string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetErrorPage(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if code < 400 || code > 599 {
+		return fmt.Errorf("SetErrorPage(): %d is not an error status code", code)
+	}
+	if path == "" {
+		return fmt.Errorf("SetErrorPage(): cannot be and empty string, the value won't be updated")
+	}
+
+	if bs.config.errorPages == nil {
+		bs.config.errorPages = make(map[int]string)
+	}
+	bs.config.errorPages[code] = path
+	return nil
+}
+
+// SetUploads enables PUT requests, that write their body to a file under the base directory.
+// If createDirs is true the missing intermediate directories of the file are created,
+// otherwise PUT requests to a missing directory are answered with 409 code.
+func (bs *buggyInstance) SetUploads(enabled bool, createDirs bool) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetUploads(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bs.config.uploads = enabled
+	bs.config.createDirs = createDirs
+	return nil
+}
+
+// SetDeletePrefixes enables DELETE requests for the files whose path starts with one of prefixes.
+// DELETE also requires uploads to be enabled with SetUploads().
+// Directories are removed, with all their content, only if recursive is true,
+// otherwise DELETE requests to a directory are answered with 409 code.
+func (bs *buggyInstance) SetDeletePrefixes(prefixes []string, recursive bool) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetDeletePrefixes(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	cleaned := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("SetDeletePrefixes(): prefix %q must start with /", prefix)
+		}
+		cleaned = append(cleaned, path.Clean(prefix))
+	}
+
+	bs.config.deletePrefixes = cleaned
+	bs.config.recursiveDelete = recursive
+	return nil
+}
+
+// SetUploadEndpoint enables an endpoint to upload files from a browser.
+// GET requests to endpoint + "/dir" receive an HTML form, that POSTs the selected files
+// as multipart/form-data to the same URL, the files are stored in "dir" under the base directory.
+// The endpoint also requires uploads to be enabled with SetUploads().
+// maxPartMiB is the maximum size of each file, zero or negative value means there will be no maximum size.
+// An empty endpoint disables it.
+func (bs *buggyInstance) SetUploadEndpoint(endpoint string, maxPartMiB int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetUploadEndpoint(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	if endpoint != "" {
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("SetUploadEndpoint(): endpoint %q must start with /", endpoint)
+		}
+		endpoint = path.Clean(endpoint)
+		if endpoint == "/" {
+			return fmt.Errorf("SetUploadEndpoint(): endpoint cannot be /")
+		}
+	}
+
+	maxPartBytes, err := toBytes(maxPartMiB, miB)
+	if err != nil {
+		return fmt.Errorf("SetUploadEndpoint(): %w", err)
+	}
+
+	bs.config.uploadEndpoint = endpoint
+	bs.config.maxPartBytes = maxPartBytes
+	return nil
+}
+
+// SetWebDAV enables the WebDAV class 1 methods PROPFIND and PROPPATCH, and,
+// if uploads are enabled with SetUploads(), MKCOL, COPY and MOVE.
+// MOVE, and COPY or MOVE that overwrite a resource, also require the
+// paths to be under one of the prefixes set with SetDeletePrefixes().
+func (bs *buggyInstance) SetWebDAV(enabled bool) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetWebDAV(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bs.config.webdav = enabled
+	return nil
+}
+
+// SetCGI enables the execution of CGI scripts, e.g. SetCGI("/cgi-bin").
+// Every executable file in the directory prefix, under the base directory, is run as a CGI script
+// for the requests whose path starts with prefix, instead of being served as a static file.
+// Scripts that run longer than the write timeout are killed. An empty prefix disables CGI.
+func (bs *buggyInstance) SetCGI(prefix string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetCGI(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	if prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("SetCGI(): prefix %q must start with /", prefix)
+		}
+		prefix = path.Clean(prefix)
+		if prefix == "/" {
+			return fmt.Errorf("SetCGI(): prefix cannot be /")
+		}
+	}
+
+	bs.config.cgiPrefix = prefix
+	return nil
+}
+
+// SetFastCGI sends the requests that match pattern to the FastCGI application listening on address.
+// pattern is a URL path prefix, e.g. "/app", or a file extension, e.g. "*.php".
+// address is "unix:/path/to/socket" or "host:port", e.g. SetFastCGI("*.php", "unix:/run/php/php-fpm.sock").
+// When more patterns match, the first one that has been set is used.
+func (bs *buggyInstance) SetFastCGI(pattern string, address string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetFastCGI(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	if strings.HasPrefix(pattern, "*.") {
+		if len(pattern) == 2 || strings.Contains(pattern, "/") {
+			return fmt.Errorf("SetFastCGI(): invalid extension %q", pattern)
+		}
+	} else if strings.HasPrefix(pattern, "/") {
+		pattern = path.Clean(pattern)
+	} else {
+		return fmt.Errorf("SetFastCGI(): pattern %q must start with / or *.", pattern)
+	}
+
+	client, err := newFcgiClient(address)
+	if err != nil {
+		return fmt.Errorf("SetFastCGI(): the address is not valid: %w", err)
+	}
+
+	bs.config.fastcgi = append(bs.config.fastcgi, &fastcgiRoute{pattern: pattern, client: client})
+	return nil
+}
+
+// SetProxy forwards the requests whose path starts with prefix to the upstream HTTP/1.1 servers,
+// e.g. SetProxy("/api", "http://127.0.0.1:3000", "http://127.0.0.1:3001").
+// If an upstream has a path, it replaces prefix in the requests it receives.
+// When more prefixes match, the longest one is used. Calling SetProxy again with
+// the same prefix adds upstreams to it, requests are balanced with the strategy set with SetProxyBalance().
+// Upstream servers that cannot be reached are answered with 502 code.
+func (bs *buggyInstance) SetProxy(prefix string, upstreams ...string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetProxy(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("SetProxy(): prefix %q must start with /", prefix)
+	}
+	if len(upstreams) == 0 {
+		return fmt.Errorf("SetProxy(): at least one upstream is required")
+	}
+
+	urls := make([]*url.URL, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return fmt.Errorf("SetProxy(): the upstream is not valid: %w", err)
+		}
+		if u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("SetProxy(): upstream %q must be an http:// URL", upstream)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("SetProxy(): upstream %q cannot have a query or a fragment", upstream)
+		}
+		urls = append(urls, u)
+	}
+
+	if bs.config.upstreams == nil {
+		bs.config.upstreams = newUpstreamPool()
+	}
+
+	prefix = path.Clean(prefix)
+	for i, route := range bs.config.proxies {
+		if route.prefix == prefix {
+			existing := make([]*url.URL, 0, len(route.backends)+len(urls))
+			for _, b := range route.backends {
+				existing = append(existing, b.upstream)
+			}
+			bs.config.proxies[i] = newProxyRoute(prefix, append(existing, urls...))
+			return nil
+		}
+	}
+	bs.config.proxies = append(bs.config.proxies, newProxyRoute(prefix, urls))
+	return nil
+}
+
+// SetProxyTimeout set the maximum duration in seconds to connect to an upstream server
+// and receive its response. If it is exceeded server respond with 504 code.
+// Zero or negative value means there will be no timeout.
+func (bs *buggyInstance) SetProxyTimeout(seconds int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetProxyTimeout(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	maxSeconds := (1<<63 - 1) / int(math.Pow(10, 9))
+
+	if seconds <= 0 {
+		bs.config.proxyTimeout = 0
+		return nil
+	} else if seconds > maxSeconds {
+		return fmt.Errorf("SetProxyTimeout(): number of seconds to large to fit in time.Duration")
+	}
+
+	bs.config.proxyTimeout = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// SetProxyBalance set the strategy to choose the backend of a proxied request, when a prefix has more upstreams:
+//
+//	"round-robin": every backend in turn
+//	"least-conn": the backend with the fewest requests in progress
+//	"ip-hash": a consistent hash of the client IP, so that a client always reaches the same backend
+func (bs *buggyInstance) SetProxyBalance(strategy string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetProxyBalance(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	switch strategy {
+	case balanceRoundRobin, balanceLeastConn, balanceIPHash:
+		bs.config.balance = strategy
+		return nil
+	}
+	return fmt.Errorf("SetProxyBalance(): unknown strategy %q", strategy)
+}
+
+// SetHealthCheck enables active health checks: every intervalSeconds a GET request for path is sent
+// to every backend, those that do not answer with a 2xx or 3xx code stop receiving requests until they pass a check.
+// An empty path disables the health checks.
+func (bs *buggyInstance) SetHealthCheck(path string, intervalSeconds int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetHealthCheck(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	if path == "" {
+		bs.config.healthCheckPath = ""
+		return nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("SetHealthCheck(): path %q must start with /", path)
+	}
+	if intervalSeconds <= 0 {
+		return fmt.Errorf("SetHealthCheck(): the interval must be greater than zero")
+	}
+
+	bs.config.healthCheckPath = path
+	bs.config.healthCheckInterval = time.Duration(intervalSeconds) * time.Second
+	return nil
+}
+
+// SetMaxFails set the number of consecutive failed requests after which a backend
+// is ejected, it does not receive requests for failTimeoutSeconds.
+// Zero or negative maxFails means backends are never ejected.
+func (bs *buggyInstance) SetMaxFails(maxFails int, failTimeoutSeconds int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetMaxFails(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if maxFails > 0 && failTimeoutSeconds <= 0 {
+		return fmt.Errorf("SetMaxFails(): the fail timeout must be greater than zero")
+	}
+
+	bs.config.maxFails = maxFails
+	bs.config.failTimeout = time.Duration(failTimeoutSeconds) * time.Second
+	return nil
+}
+
+// SetWebSocket accepts WebSocket connections on the URL path, every connection is handed to handler.
+// Requests to path that do not ask for an upgrade are answered with 426 code.
+func (bs *buggyInstance) SetWebSocket(path string, handler WebSocketHandler) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetWebSocket(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("SetWebSocket(): path must start with \"/\"")
+	}
+	if handler == nil {
+		return fmt.Errorf("SetWebSocket(): handler cannot be nil")
+	}
+
+	if bs.config.websockets == nil {
+		bs.config.websockets = make(map[string]WebSocketHandler)
+	}
+	bs.config.websockets[path] = handler
+	return nil
+}
+
+// SetMaxMessageKiB set the maximum size of a WebSocket message the server will accept in KiB.
+// Zero or negative value means there will be no maximum message size.
+func (bs *buggyInstance) SetMaxMessageKiB(size int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetMaxMessageKiB(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bytes, err := toBytes(size, kiB)
+	if err != nil {
+		return fmt.Errorf("SetMaxMessageKiB(): %w", err)
+	}
+	bs.config.maxMessageBytes = bytes
+	return nil
+}
+
+// SetEventStream answers GET requests to the URL path with a text/event-stream response
+// written by handler. The response stays open until handler returns.
+func (bs *buggyInstance) SetEventStream(path string, handler EventStreamHandler) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetEventStream(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("SetEventStream(): path must start with \"/\"")
+	}
+	if handler == nil {
+		return fmt.Errorf("SetEventStream(): handler cannot be nil")
+	}
+
+	if bs.config.eventStreams == nil {
+		bs.config.eventStreams = make(map[string]EventStreamHandler)
+	}
+	bs.config.eventStreams[path] = handler
+	return nil
+}
+
+// SetHeartbeat set the interval in seconds between the comments sent on event streams.
+// Zero or negative value means no heartbeat is sent.
+func (bs *buggyInstance) SetHeartbeat(seconds int) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetHeartbeat(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	bs.config.heartbeat = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// SetWatch enables the live reload of the HTML pages: baseDir is watched for changes,
+// a script is injected in the served pages, and when a file changes the browsers
+// that show them are told to reload through an event stream.
+func (bs *buggyInstance) SetWatch(enabled bool) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetWatch(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	if !enabled {
+		bs.config.liveReload = nil
+		delete(bs.config.eventStreams, liveReloadPath)
+		return nil
+	}
+
+	lr := newLiveReload()
+	if err := bs.SetEventStream(liveReloadPath, lr.handler); err != nil {
+		return fmt.Errorf("SetWatch(): %w", err)
+	}
+	bs.config.liveReload = lr
+	return nil
+}
+
+// SetSPA enables the fallback routing of single-page applications: GET and HEAD requests
+// for paths that match no file and have no extension are answered with the file at the URL
+// path fallback, like /index.html. Paths under the exclude prefixes, like /api, never fall back.
+// An empty fallback disables it.
+func (bs *buggyInstance) SetSPA(fallback string, exclude []string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetSPA(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if fallback != "" && !strings.HasPrefix(fallback, "/") {
+		return fmt.Errorf("SetSPA(): fallback %q must start with /", fallback)
+	}
+
+	cleaned := make([]string, 0, len(exclude))
+	for _, prefix := range exclude {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("SetSPA(): excluded prefix %q must start with /", prefix)
+		}
+		cleaned = append(cleaned, path.Clean(prefix))
+	}
+
+	bs.config.spaFallback = fallback
+	bs.config.spaExclude = cleaned
+	return nil
+}
+
+// SetUnixSocket set the permissions and the owner of the Unix domain sockets the server listens on.
+// owner is "user", ":group" or "user:group", with names or numeric ids.
+// Zero mode and empty owner mean the socket is created with the umask and the user of the process.
+func (bs *buggyInstance) SetUnixSocket(mode os.FileMode, owner string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetUnixSocket(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if mode&^os.ModePerm != 0 {
+		return fmt.Errorf("SetUnixSocket(): invalid permissions %o", mode)
+	}
+	if _, _, err := lookupOwner(owner); err != nil {
+		return fmt.Errorf("SetUnixSocket(): %w", err)
+	}
+
+	bs.config.socketMode = mode
+	bs.config.socketOwner = owner
+	return nil
+}
+
+// SetRules loads the rewrite and redirect rules of the file at path, one per line:
+//
+//	rewrite MATCHER PATTERN TARGET
+//	redirect CODE MATCHER PATTERN TARGET
+//
+// MATCHER is prefix, glob or regex. The first rule that matches the path of a request wins:
+// a rewrite changes the path that is served, a redirect answers with CODE and TARGET as location.
+// An empty path removes the rules.
+func (bs *buggyInstance) SetRules(path string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetRules(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if path == "" {
+		bs.config.rules = nil
+		return nil
+	}
+
+	rules, err := loadRules(path)
+	if err != nil {
+		return fmt.Errorf("SetRules(): %w", err)
+	}
+	bs.config.rules = rules
+	return nil
+}
+
+// SetBasicAuth requires the credentials of a user of the htpasswd file at htpasswdPath for the paths
+// under prefix, the other requests are answered with 401 code and a challenge for realm. Empty realm
+// means "BuggyServer". When more prefixes match, the longest one is used. Calling SetBasicAuth again
+// with the same prefix replaces its file and realm.
+func (bs *buggyInstance) SetBasicAuth(prefix string, htpasswdPath string, realm string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetBasicAuth(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("SetBasicAuth(): prefix %q must start with /", prefix)
+	}
+	if realm == "" {
+		realm = defaultRealm
+	}
+	if err := checkRealm(realm); err != nil {
+		return fmt.Errorf("SetBasicAuth(): %w", err)
+	}
+
+	users, err := loadHtpasswd(htpasswdPath)
+	if err != nil {
+		return fmt.Errorf("SetBasicAuth(): %w", err)
+	}
+
+	route := newAuthRoute(path.Clean(prefix), htpasswdPath, realm, users)
+	for i, existing := range bs.config.auth {
+		if existing.prefix == route.prefix {
+			bs.config.auth[i] = route
+			return nil
+		}
+	}
+	bs.config.auth = append(bs.config.auth, route)
+	return nil
+}
+
+// SetAccessRules set the rules checked in order on the client address of every connection, when it is accepted.
+// Rules are "allow NETWORK" or "deny NETWORK", NETWORK is an IPv4 or IPv6 CIDR, a single address, "unix" for
+// the clients on Unix domain sockets or "all". The first rule that matches wins, a client denied is closed
+// without response, a client that matches no rule is allowed. An empty list removes the rules.
+func (bs *buggyInstance) SetAccessRules(rules []string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetAccessRules(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+
+	parsed, err := parseAccessRules(rules)
+	if err != nil {
+		return fmt.Errorf("SetAccessRules(): %w", err)
+	}
+	bs.config.access = parsed
+	return nil
+}
+
+// SetPathAccessRules set the rules checked on the client of the requests under prefix, in the form of
+// SetAccessRules(). The requests of a client denied are answered with 403 code. When more prefixes match,
+// the longest one is used. Calling SetPathAccessRules again with the same prefix replaces its rules.
+func (bs *buggyInstance) SetPathAccessRules(prefix string, rules []string) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetPathAccessRules(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("SetPathAccessRules(): prefix %q must start with /", prefix)
+	}
+
+	parsed, err := parseAccessRules(rules)
+	if err != nil {
+		return fmt.Errorf("SetPathAccessRules(): %w", err)
+	}
+
+	pa := &pathAccess{prefix: path.Clean(prefix), rules: parsed}
+	for i, existing := range bs.config.pathAccess {
+		if existing.prefix == pa.prefix {
+			bs.config.pathAccess[i] = pa
+			return nil
+		}
+	}
+	bs.config.pathAccess = append(bs.config.pathAccess, pa)
+	return nil
+}
+
+// SetTrustedProxies set the proxies, CIDRs, addresses or "unix", whose X-Forwarded-For header gives the client
+// address checked by the path access rules. If proxyProtocol is true their connections must start with a
+// PROXY protocol header, version 1 or 2, that gives the client address of the connection, used everywhere.
+func (bs *buggyInstance) SetTrustedProxies(proxies []string, proxyProtocol bool) error {
+	if bs.listener != nil {
+		return fmt.Errorf("SetTrustedProxies(): BuggyServer has already been started, you can no longer change its configuration")
+	}
+	if proxyProtocol && len(proxies) == 0 {
+		return fmt.Errorf("SetTrustedProxies(): the PROXY protocol requires at least one trusted proxy")
+	}
+
+	trusted := make([]accessRule, 0, len(proxies))
+	for _, proxy := range proxies {
+		r, err := parseNetwork(strings.TrimSpace(proxy))
+		if err != nil {
+			return fmt.Errorf("SetTrustedProxies(): %w", err)
+		}
+		r.allow = true
+		trusted = append(trusted, r)
+	}
+
+	bs.config.trustedProxies = trusted
+	bs.config.proxyProtocol = proxyProtocol
+	return nil
+}
+
+// liveConfig returns the configuration for a new connection.
+func (bs *buggyInstance) liveConfig() *buggyConfig {
+	if config := bs.live.Load(); config != nil {
+		return config
+	}
+	return bs.config
+}
+
 func (bs *buggyInstance) handleConnection(conn net.Conn) {
 
 	defer func() {
-		if err := conn.Close(); err != nil {
+		// A hijacked connection can have already been closed by its handler.
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Printf("error: handleConnection(): conn.Close(): %s: %s", conn.RemoteAddr(), err.Error())
 		}
 	}()
 
+	defer bs.untrackConn(conn)
+
+	// The connection keeps the configuration it started with, even if the server is reloaded.
+	config := bs.liveConfig()
+
 	bufReader := bufio.NewReader(conn)
 
+	// The connection stays tracked as accepted, with the address of the proxy.
+	tracked := conn
+	if sendsProxyHeader(conn.RemoteAddr(), config) {
+		conn.SetReadDeadline(time.Now().Add(config.readTimeout))
+		proxied, err := readProxyHeader(conn, bufReader)
+		if err != nil {
+			log.Printf("error: handleConnection(): %s", err.Error())
+			return
+		}
+		conn = proxied
+
+		if !acceptAllowed(conn.RemoteAddr(), config) {
+			log.Printf("error: handleConnection(): %s is denied by the access rules, connection closed", conn.RemoteAddr())
+			return
+		}
+	}
+
 	for {
-		conn.SetReadDeadline(time.Now().Add(bs.config.readTimeout))
+		deadline := time.Now().Add(config.readTimeout)
+		conn.SetReadDeadline(deadline)
+
+		// An idle keep-alive connection is closed without answering when the server shuts down.
+		if !bs.waitForRequest(tracked, bufReader, deadline) {
+			break
+		}
 
 		var response *response
 
-		request, err := requestParser(bufReader, bs.config.maxRequestMiB)
+		request, err := requestParser(bufReader, config.sizeLimits(), conn)
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
 				log.Printf("error: handleConnection(): %s:%s, the underlying connection is closed", err.Error(), conn.RemoteAddr())
@@ -212,30 +1106,56 @@ func (bs *buggyInstance) handleConnection(conn net.Conn) {
 			}
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				response = r408()
+			} else if errors.Is(err, errExpectationFailed) {
+				response = r417()
+			} else if errors.Is(err, errPayloadTooLarge) {
+				response = r413()
+			} else if errors.Is(err, errHeaderTooLarge) {
+				response = r431()
 			} else {
 				response = r400()
 			}
 			log.Printf("error: handleConnection(): %s. %d sent", err.Error(), response.code)
 
 		} else {
-			response, err = generateResponse(request, bs.config.writeTimeout, bs.config.baseDir)
+			request.remoteAddr = conn.RemoteAddr().String()
+			request.localAddr = conn.LocalAddr().String()
+
+			response, err = generateResponse(request, config)
 			if err != nil {
 				log.Printf("error: handleConnection(): %s", err.Error())
 			}
 
-			if headerFinder(request.headers, "connection", "close") {
+			if response.hijack != nil {
+				// The connection header is set by the upgrade.
+
+			} else if !wantsKeepAlive(request) || bs.isDraining() {
 				addCloseConnectionHeader(response)
 
 			} else if _, ok := response.headers["connection"]; !ok {
-				addKeepAliveHeaders(response, int(bs.config.readTimeout))
+				addKeepAliveHeaders(response, int(config.readTimeout))
 			}
 		}
 
-		err = sendResponse(conn, response)
+		addErrorBody(response, request, config)
+		prepareStream(response, request)
+
+		err = sendResponse(conn, response, request)
 		if err != nil {
 			log.Printf("error: handleConnection(): %s", err.Error())
-		} else {
-			log.Printf("[ %s, %s, %s : %d ]", conn.RemoteAddr(), request.method, request.path, response.code)
+			break
+		}
+		client := conn.RemoteAddr().String()
+		if request.user != "" {
+			client = request.user + "@" + client
+		}
+		log.Printf("[ %s, %s, %s : %d ]", client, request.method, request.path, response.code)
+
+		// After an upgrade the connection no longer speaks HTTP.
+		if response.hijack != nil {
+			conn.SetReadDeadline(time.Time{})
+			response.hijack(conn, bufReader)
+			break
 		}
 
 		if values, ok := response.headers["connection"]; ok && values[0] == "close" {
@@ -247,6 +1167,8 @@ func (bs *buggyInstance) handleConnection(conn net.Conn) {
 }
 
 func (bs *buggyInstance) listenForConn() {
+	defer close(bs.acceptDone)
+
 	for {
 
 		conn, err := bs.listener.Accept()
@@ -261,6 +1183,15 @@ func (bs *buggyInstance) listenForConn() {
 
 		}
 
+		// The connections of the proxies that send a PROXY protocol header are checked once it has been read.
+		config := bs.liveConfig()
+		if !sendsProxyHeader(conn.RemoteAddr(), config) && !acceptAllowed(conn.RemoteAddr(), config) {
+			log.Printf("error: listenForConn(): %s is denied by the access rules, connection closed", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		bs.trackConn(conn)
 		go bs.handleConnection(conn)
 
 	}
@@ -281,6 +1212,7 @@ func (bs *buggyInstance) StopBuggyServer() (err error) {
 		return fmt.Errorf("StopBuggyServer(): nil bs.quit, StopBuggyServer() called before NewBuggyServer()")
 	}
 	close(bs.quit)
+	bs.closeClients()
 	err = bs.listener.Close()
 	if err != nil {
 		return fmt.Errorf("StopBuggyServer(): during bs.listener.Close(), %w", err)
@@ -288,7 +1220,14 @@ func (bs *buggyInstance) StopBuggyServer() (err error) {
 	return nil
 }
 
-func sendResponse(conn net.Conn, response *response) error {
+func sendResponse(conn net.Conn, response *response, request *request) error {
+	if response.stream != nil {
+		if err := writeStream(conn, response, request.method); err != nil {
+			return fmt.Errorf("sendResponse(): %s: %w", conn.RemoteAddr(), err)
+		}
+		return nil
+	}
+
 	if _, err := conn.Write([]byte(serializeResponse(response))); err != nil {
 		return fmt.Errorf("sendResponse(): %s: %w", conn.RemoteAddr(), err)
 	}
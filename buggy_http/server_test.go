@@ -1,8 +1,12 @@
 package buggy_http
 
 import (
+	"io"
 	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,10 +17,10 @@ func TestStartBuggyServer(t *testing.T) {
 	t.Run("missing baseDir", func(t *testing.T) {
 		bs := &buggyInstance{
 			config: &buggyConfig{
-				baseDir:       "",
-				readTimeout:   10,
-				writeTimeout:  10,
-				maxRequestMiB: 10,
+				baseDir:         "",
+				readTimeout:     10,
+				writeTimeout:    10,
+				maxRequestBytes: 10,
 			},
 			quit: make(chan struct{}),
 		}
@@ -28,10 +32,10 @@ func TestStartBuggyServer(t *testing.T) {
 	t.Run("missing readTimeout", func(t *testing.T) {
 		bs := &buggyInstance{
 			config: &buggyConfig{
-				baseDir:       "./foo",
-				readTimeout:   0,
-				writeTimeout:  10,
-				maxRequestMiB: 10,
+				baseDir:         "./foo",
+				readTimeout:     0,
+				writeTimeout:    10,
+				maxRequestBytes: 10,
 			},
 			quit: make(chan struct{}),
 		}
@@ -114,14 +118,518 @@ func TestSetmaxRequestMiB(t *testing.T) {
 		bs.listener = nil
 		err := bs.SetmaxRequestMiB(0)
 		assert.NoError(t, err)
-		assert.Equal(t, 0, bs.config.maxRequestMiB)
+		assert.Equal(t, 0, bs.config.maxRequestBytes)
 	})
 
 	t.Run("Success when listener is nil", func(t *testing.T) {
 		bs.listener = nil
 		err := bs.SetmaxRequestMiB(10)
 		assert.NoError(t, err)
-		assert.Equal(t, 10, bs.config.maxRequestMiB)
+		assert.Equal(t, 10*1024*1024, bs.config.maxRequestBytes)
+	})
+}
+
+func TestSetMaxHeaderKiB(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetMaxHeaderKiB(10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetMaxHeaderKiB(10)
+		assert.NoError(t, err)
+		assert.Equal(t, 10*1024, bs.config.sizeLimits().header)
+	})
+}
+
+func TestSetMaxBodyMiB(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetMaxBodyMiB(10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetMaxBodyMiB(10)
+		assert.NoError(t, err)
+		assert.Equal(t, 10*1024*1024, bs.config.sizeLimits().body)
+	})
+}
+
+func TestSetUploads(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetUploads(true, true)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUploads(true, false)
+		assert.NoError(t, err)
+		assert.True(t, bs.config.uploads)
+		assert.False(t, bs.config.createDirs)
+	})
+}
+
+func TestSetDeletePrefixes(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetDeletePrefixes([]string{"/tmp"}, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when prefix is relative", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetDeletePrefixes([]string{"tmp"}, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetDeletePrefixes([]string{"/tmp/", "/scratch"}, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/tmp", "/scratch"}, bs.config.deletePrefixes)
+		assert.True(t, bs.config.recursiveDelete)
+	})
+}
+
+func TestSetUploadEndpoint(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetUploadEndpoint("/_upload", 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when endpoint is relative", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUploadEndpoint("_upload", 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when endpoint is the root", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUploadEndpoint("/", 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUploadEndpoint("/_upload/", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, "/_upload", bs.config.uploadEndpoint)
+		assert.Equal(t, 10*1024*1024, bs.config.maxPartBytes)
+	})
+}
+
+func TestSetWebDAV(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetWebDAV(true)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWebDAV(true)
+		assert.NoError(t, err)
+		assert.True(t, bs.config.webdav)
+	})
+}
+
+func TestSetFastCGI(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetFastCGI("*.php", "127.0.0.1:9000")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when pattern is invalid", func(t *testing.T) {
+		bs.listener = nil
+		assert.Error(t, bs.SetFastCGI("app", "127.0.0.1:9000"))
+		assert.Error(t, bs.SetFastCGI("*.", "127.0.0.1:9000"))
+	})
+
+	t.Run("Error when address is invalid", func(t *testing.T) {
+		bs.listener = nil
+		assert.Error(t, bs.SetFastCGI("*.php", "127.0.0.1"))
+		assert.Error(t, bs.SetFastCGI("*.php", "unix:"))
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		assert.NoError(t, bs.SetFastCGI("*.php", "unix:/run/php/php-fpm.sock"))
+		assert.NoError(t, bs.SetFastCGI("/app/", "127.0.0.1:9000"))
+		assert.Len(t, bs.config.fastcgi, 2)
+		assert.Equal(t, "unix", bs.config.fastcgi[0].client.network)
+		assert.Equal(t, "/run/php/php-fpm.sock", bs.config.fastcgi[0].client.address)
+		assert.Equal(t, "/app", bs.config.fastcgi[1].pattern)
+	})
+}
+
+func TestSetCGI(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetCGI("/cgi-bin")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when prefix is invalid", func(t *testing.T) {
+		bs.listener = nil
+		assert.Error(t, bs.SetCGI("cgi-bin"))
+		assert.Error(t, bs.SetCGI("/"))
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetCGI("/cgi-bin/")
+		assert.NoError(t, err)
+		assert.Equal(t, "/cgi-bin", bs.config.cgiPrefix)
+	})
+}
+
+func TestSetProxy(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetProxy("/api", "http://127.0.0.1:3000")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when prefix is relative", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxy("api", "http://127.0.0.1:3000")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when upstream is not an http URL", func(t *testing.T) {
+		bs.listener = nil
+		assert.Error(t, bs.SetProxy("/api", "https://127.0.0.1:3000"))
+		assert.Error(t, bs.SetProxy("/api", "127.0.0.1:3000"))
+		assert.Error(t, bs.SetProxy("/api", "http://127.0.0.1:3000/?q=1"))
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxy("/api/", "http://127.0.0.1:3000/v1")
+		assert.NoError(t, err)
+		assert.Len(t, bs.config.proxies, 1)
+		assert.Equal(t, "/api", bs.config.proxies[0].prefix)
+		assert.Equal(t, "/v1", bs.config.proxies[0].backends[0].upstream.Path)
+		assert.NotNil(t, bs.config.upstreams)
+	})
+
+	t.Run("Same prefix adds upstreams", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxy("/api", "http://127.0.0.1:3001", "http://127.0.0.1:3002")
+		assert.NoError(t, err)
+		assert.Len(t, bs.config.proxies, 1)
+		assert.Len(t, bs.config.proxies[0].backends, 3)
+		assert.Equal(t, "127.0.0.1:3002", bs.config.proxies[0].backends[2].addr)
+	})
+
+	t.Run("Error without upstreams", func(t *testing.T) {
+		bs.listener = nil
+		assert.Error(t, bs.SetProxy("/other"))
+	})
+}
+
+func TestSetProxyTimeout(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetProxyTimeout(10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Zero or negative value disables the timeout", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxyTimeout(-1)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), bs.config.proxyTimeout)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxyTimeout(10)
+		assert.NoError(t, err)
+		assert.Equal(t, 10*time.Second, bs.config.proxyTimeout)
+	})
+}
+
+func TestSetProxyBalance(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetProxyBalance("least-conn")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when strategy is unknown", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxyBalance("random")
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetProxyBalance("ip-hash")
+		assert.NoError(t, err)
+		assert.Equal(t, "ip-hash", bs.config.balance)
+	})
+}
+
+func TestSetHealthCheck(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetHealthCheck("/healthz", 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when interval is not positive", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetHealthCheck("/healthz", 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetHealthCheck("/healthz", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, "/healthz", bs.config.healthCheckPath)
+		assert.Equal(t, 10*time.Second, bs.config.healthCheckInterval)
+	})
+}
+
+func TestSetMaxFails(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetMaxFails(3, 30)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when fail timeout is not positive", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetMaxFails(3, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetMaxFails(5, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, bs.config.maxFails)
+		assert.Equal(t, 10*time.Second, bs.config.failTimeout)
+	})
+}
+
+func TestSetWebSocket(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+	handler := func(ws WebSocketConn) {}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetWebSocket("/ws", handler)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when path is not absolute", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWebSocket("ws", handler)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when handler is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWebSocket("/ws", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWebSocket("/ws", handler)
+		assert.NoError(t, err)
+		assert.Contains(t, bs.config.websockets, "/ws")
+	})
+}
+
+func TestSetMaxMessageKiB(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetMaxMessageKiB(64)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetMaxMessageKiB(64)
+		assert.NoError(t, err)
+		assert.Equal(t, 64*1024, bs.config.maxMessageBytes)
+	})
+}
+
+func TestSetEventStream(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+	handler := func(es EventStream) {}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetEventStream("/events", handler)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when path is not absolute", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetEventStream("events", handler)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when handler is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetEventStream("/events", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetEventStream("/events", handler)
+		assert.NoError(t, err)
+		assert.Contains(t, bs.config.eventStreams, "/events")
+	})
+}
+
+func TestSetHeartbeat(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetHeartbeat(30)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetHeartbeat(30)
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Second, bs.config.heartbeat)
+	})
+}
+
+func TestSetWatch(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetWatch(true)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWatch(true)
+		assert.NoError(t, err)
+		assert.NotNil(t, bs.config.liveReload)
+		assert.Contains(t, bs.config.eventStreams, liveReloadPath)
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetWatch(false)
+		assert.NoError(t, err)
+		assert.Nil(t, bs.config.liveReload)
+		assert.NotContains(t, bs.config.eventStreams, liveReloadPath)
+	})
+}
+
+func TestSetSPA(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetSPA("/index.html", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when fallback is not absolute", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetSPA("index.html", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when an excluded prefix is not absolute", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetSPA("/index.html", []string{"api"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetSPA("/index.html", []string{"/api/"})
+		assert.NoError(t, err)
+		assert.Equal(t, "/index.html", bs.config.spaFallback)
+		assert.Equal(t, []string{"/api"}, bs.config.spaExclude)
+	})
+}
+
+func TestSetRules(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "rules.txt")
+	os.WriteFile(valid, []byte("rewrite prefix /a /b\n"), 0644)
+	invalid := filepath.Join(dir, "invalid.txt")
+	os.WriteFile(invalid, []byte("rewrite /a /b\n"), 0644)
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetRules(valid)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when the file is missing", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetRules(filepath.Join(dir, "missing.txt"))
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when a rule is invalid", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetRules(invalid)
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetRules(valid)
+		assert.NoError(t, err)
+		assert.Len(t, bs.config.rules, 1)
 	})
 }
 
@@ -208,3 +716,185 @@ func TestStopBuggyServer(t *testing.T) {
 	})
 
 }
+
+func TestSetErrorPage(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetErrorPage(404, "404.html")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when code is not an error code", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetErrorPage(200, "200.html")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when path is empty", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetErrorPage(404, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetErrorPage(404, "404.html")
+		assert.NoError(t, err)
+		assert.Equal(t, "404.html", bs.config.errorPages[404])
+	})
+}
+
+// roundTrip writes raw to a connection served by bs and returns
+// everything the server sends back until it closes the connection.
+func roundTrip(t *testing.T, bs *buggyInstance, raw string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go bs.handleConnection(server)
+	go client.Write([]byte(raw))
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(client)
+	if err != nil && !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("roundTrip(): %s", err.Error())
+	}
+	return string(b)
+}
+
+// startTestServer starts bs on a random port of the loopback interface,
+// and returns its address. The server is stopped at the end of the test.
+func startTestServer(t *testing.T, bs *buggyInstance) string {
+	if err := bs.StartBuggyServer("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.StopBuggyServer() })
+	return bs.listener.Addr().String()
+}
+
+// rawRequest sends raw to the server listening on addr and returns
+// everything the server sends back until it closes the connection.
+func rawRequest(t *testing.T, addr string, raw string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("rawRequest(): %s", err.Error())
+	}
+	return string(b)
+}
+
+func newTestInstance(t *testing.T) *buggyInstance {
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "index.html"), []byte("<html>index</html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := NewBuggyServer().(*buggyInstance)
+	bs.config.baseDir = baseDir
+	return bs
+}
+
+func TestHandleConnectionHTTPVersions(t *testing.T) {
+	bs := newTestInstance(t)
+
+	t.Run("HTTP/1.0 closes the connection by default", func(t *testing.T) {
+		out := roundTrip(t, bs, "GET / HTTP/1.0\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, out, "connection: close\r\n")
+		assert.True(t, strings.HasSuffix(out, "<html>index</html>"))
+	})
+
+	t.Run("HTTP/1.0 with keep-alive", func(t *testing.T) {
+		out := roundTrip(t, bs, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET / HTTP/1.0\r\n\r\n")
+		assert.Equal(t, 2, strings.Count(out, "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, out, "connection: keep-alive\r\n")
+	})
+
+	t.Run("HTTP/2.0 is not supported", func(t *testing.T) {
+		out := roundTrip(t, bs, "GET / HTTP/2.0\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+	})
+}
+
+func TestHandleConnectionExpect(t *testing.T) {
+	bs := newTestInstance(t)
+
+	t.Run("Unknown expectation", func(t *testing.T) {
+		out := roundTrip(t, bs, "GET / HTTP/1.1\r\nExpect: foo\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"))
+		assert.Contains(t, out, "connection: close\r\n")
+	})
+
+	t.Run("100 Continue precedes the final response", func(t *testing.T) {
+		out := roundTrip(t, bs, "GET / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 3\r\nConnection: close\r\n\r\nfoo")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n"))
+	})
+}
+
+func TestHandleConnectionSizeLimits(t *testing.T) {
+	bs := newTestInstance(t)
+	bs.config.maxBodyBytes = 1 << 20
+
+	out := roundTrip(t, bs, "PUT /foo HTTP/1.1\r\nContent-Length: 2097152\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+}
+
+func TestHandleConnectionPUT(t *testing.T) {
+	bs := newTestInstance(t)
+
+	t.Run("PUT not allowed when uploads are disabled", func(t *testing.T) {
+		out := roundTrip(t, bs, "PUT /foo.txt HTTP/1.1\r\nContent-Length: 3\r\nConnection: close\r\n\r\nfoo")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	})
+
+	t.Run("PUT with uploads enabled", func(t *testing.T) {
+		bs.config.uploads = true
+		out := roundTrip(t, bs, "PUT /foo.txt HTTP/1.1\r\nContent-Length: 3\r\nConnection: close\r\n\r\nfoo")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+
+		out = roundTrip(t, bs, "GET /foo.txt HTTP/1.1\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasSuffix(out, "\r\n\r\nfoo"))
+	})
+}
+
+func TestSetUnixSocket(t *testing.T) {
+	bs := &buggyInstance{config: &buggyConfig{}}
+
+	t.Run("Error when listener is not nil", func(t *testing.T) {
+		bs.listener = &net.TCPListener{}
+		err := bs.SetUnixSocket(0660, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when mode is not a permission", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUnixSocket(os.ModeDir|0755, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when owner is unknown", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUnixSocket(0660, ":no-such-group-bs")
+		assert.Error(t, err)
+	})
+
+	t.Run("Success when listener is nil", func(t *testing.T) {
+		bs.listener = nil
+		err := bs.SetUnixSocket(0660, "0:0")
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0660), bs.config.socketMode)
+		assert.Equal(t, "0:0", bs.config.socketOwner)
+	})
+}
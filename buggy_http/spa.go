@@ -0,0 +1,46 @@
+package buggy_http
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// spaFallback returns the request for the fallback file of a single-page application
+// that replaces request, or nil if request must be served as it is.
+// Only GET and HEAD requests for paths that match no file, have no extension
+// and are not under an excluded prefix fall back, so that the client-side router
+// receives deep links while missing assets are still answered with 404 code.
+func spaFallback(request *request, config *buggyConfig) *request {
+	if config.spaFallback == "" || (request.method != "GET" && request.method != "HEAD") {
+		return nil
+	}
+
+	rawPath, _, _ := strings.Cut(request.path, "?")
+	p, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil
+	}
+
+	if p == "/" {
+		if _, err := validatePath(config.baseDir, "/index.html"); err == nil {
+			return nil
+		}
+	} else if _, err := validatePath(config.baseDir, p); err == nil {
+		return nil
+	}
+
+	if path.Ext(p) != "" {
+		return nil
+	}
+
+	for _, prefix := range config.spaExclude {
+		if hasPathPrefix(p, prefix) {
+			return nil
+		}
+	}
+
+	fallback := *request
+	fallback.path = config.spaFallback
+	return &fallback
+}
@@ -0,0 +1,59 @@
+package buggy_http
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaFallback(t *testing.T) {
+	baseDir := t.TempDir()
+	os.WriteFile(filepath.Join(baseDir, "index.html"), []byte("<html>app</html>"), 0644)
+	os.Mkdir(filepath.Join(baseDir, "assets"), 0755)
+	os.WriteFile(filepath.Join(baseDir, "assets", "app.js"), []byte("app()"), 0644)
+
+	bs := &buggyInstance{config: &buggyConfig{baseDir: baseDir, writeTimeout: 1<<63 - 1}}
+	assert.NoError(t, bs.SetSPA("/index.html", []string{"/api/"}))
+
+	get := func(path string) *response {
+		r, _ := reply(&request{method: "GET", path: path, proto: "HTTP/1.1", headers: map[string][]string{}}, bs.config)
+		return r
+	}
+
+	t.Run("Deep links fall back", func(t *testing.T) {
+		for _, path := range []string{"/users/42", "/users/42?tab=posts", "/settings/", "/assets"} {
+			r := get(path)
+			assert.Equal(t, 200, r.code, path)
+			assert.Equal(t, "<html>app</html>", string(r.body), path)
+		}
+	})
+
+	t.Run("Existing files are served", func(t *testing.T) {
+		r := get("/assets/app.js")
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, "app()", string(r.body))
+	})
+
+	t.Run("Missing assets are 404", func(t *testing.T) {
+		assert.Equal(t, 404, get("/assets/missing.js").code)
+		assert.Equal(t, 404, get("/users/42.json").code)
+	})
+
+	t.Run("Excluded prefixes are 404", func(t *testing.T) {
+		assert.Equal(t, 404, get("/api/users").code)
+		assert.Equal(t, 404, get("/api").code)
+		assert.Equal(t, 200, get("/apiary").code)
+	})
+
+	t.Run("HEAD falls back", func(t *testing.T) {
+		r, _ := reply(&request{method: "HEAD", path: "/users/42", proto: "HTTP/1.1", headers: map[string][]string{}}, bs.config)
+		assert.Equal(t, 200, r.code)
+		assert.Equal(t, []string{"16"}, r.headers["content-length"])
+	})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		assert.Nil(t, spaFallback(&request{method: "GET", path: "/users/42"}, &buggyConfig{baseDir: baseDir}))
+	})
+}
@@ -0,0 +1,235 @@
+package buggy_http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a message sent on an event stream, empty fields are not sent.
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+type Event struct {
+	// The id the client sends back in Last-Event-ID when it reconnects.
+	ID string
+
+	// The type of the event, clients dispatch events without type as "message".
+	Event string
+
+	// The payload of the event, it can span more lines.
+	Data string
+
+	// How long the client waits before reconnecting, it is sent in milliseconds.
+	Retry time.Duration
+}
+
+// EventStreamHandler is called for every client connected to the path it has been set for,
+// the stream ends when it returns. It is not bound by the write timeout.
+type EventStreamHandler func(es EventStream)
+
+// EventStream is a text/event-stream response kept open with a client.
+// Events can be sent from more goroutines.
+type EventStream interface {
+	// Send writes event and flushes it to the client.
+	Send(event Event) error
+
+	// Comment writes a comment line, that clients ignore.
+	Comment(text string) error
+
+	// LastEventID returns the Last-Event-ID header sent by a reconnecting client, or "".
+	LastEventID() string
+
+	// Path returns the request target.
+	Path() string
+
+	// Done is closed when the client can no longer be reached.
+	Done() <-chan struct{}
+}
+
+// eventStream implements EventStream on the stream body of a response.
+type eventStream struct {
+	path        string
+	lastEventID string
+
+	mu  sync.Mutex
+	w   streamWriter
+	err error
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// findEventStreamHandler returns the handler set for the path of request, or nil.
+func findEventStreamHandler(request *request, config *buggyConfig) EventStreamHandler {
+	p, _, _ := strings.Cut(request.path, "?")
+	return config.eventStreams[p]
+}
+
+// replyToEventStream answers request with a text/event-stream body written by handler.
+// A comment is sent every heartbeat interval, so that idle connections are not dropped
+// by proxies and clients that went away are noticed.
+func replyToEventStream(request *request, handler EventStreamHandler, config *buggyConfig) (*response, error) {
+	if request.method != "GET" && request.method != "HEAD" {
+		return r405([]string{"GET", "HEAD"}), fmt.Errorf("replyToEventStream() -> %s, %s: event streams only accept GET. 405 sent", request.method, request.path)
+	}
+
+	t := time.Now().UTC()
+	r := &response{
+		proto:        "HTTP/1.1",
+		code:         200,
+		reasonPhrase: "OK",
+		headers: map[string][]string{
+			"date":          {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+			"server":        {"BuggyServer"},
+			"content-type":  {"text/event-stream; charset=utf-8"},
+			"cache-control": {"no-cache"},
+		},
+		body: make([]byte, 0),
+	}
+
+	r.stream = func(w streamWriter) error {
+		es := &eventStream{
+			path: request.path,
+			// The header is split on commas like any other.
+			lastEventID: strings.Join(request.headers["last-event-id"], ","),
+			w:           w,
+			done:        make(chan struct{}),
+		}
+
+		// The head is sent before the first event, so that the client knows the stream is open.
+		if err := es.flush(); err != nil {
+			return fmt.Errorf("replyToEventStream() -> %s, %s : %w", request.method, request.path, err)
+		}
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		if config.heartbeat > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				es.heartbeat(config.heartbeat, stop)
+			}()
+		}
+
+		handler(es)
+		close(stop)
+		wg.Wait()
+
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		if es.err != nil {
+			return fmt.Errorf("replyToEventStream() -> %s, %s : %w", request.method, request.path, es.err)
+		}
+		return nil
+	}
+
+	return r, nil
+}
+
+// heartbeat writes a comment every interval until stop is closed or the client is gone.
+func (es *eventStream) heartbeat(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-es.done:
+			return
+		case <-ticker.C:
+			es.Comment("heartbeat")
+		}
+	}
+}
+
+func (es *eventStream) Send(event Event) error {
+	if strings.ContainsAny(event.ID, "\r\n\x00") {
+		return fmt.Errorf("Send(): the id cannot contain line breaks or NULL")
+	}
+	if strings.ContainsAny(event.Event, "\r\n") {
+		return fmt.Errorf("Send(): the event type cannot contain line breaks")
+	}
+
+	var b strings.Builder
+	if event.ID != "" {
+		b.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		b.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	if event.Data != "" || (event.ID == "" && event.Event == "" && event.Retry <= 0) {
+		data := strings.ReplaceAll(event.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+
+	return es.write(b.String())
+}
+
+func (es *eventStream) Comment(text string) error {
+	var b strings.Builder
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", "\n"), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	return es.write(b.String())
+}
+
+// write sends s to the client at once. After a failed write
+// the stream is done and every following write fails.
+func (es *eventStream) write(s string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.err != nil {
+		return es.err
+	}
+	if _, err := es.w.Write([]byte(s)); err != nil {
+		es.fail(err)
+		return err
+	}
+	if err := es.w.Flush(); err != nil {
+		es.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (es *eventStream) flush() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if err := es.w.Flush(); err != nil {
+		es.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail records err and closes done, es.mu must be held.
+func (es *eventStream) fail(err error) {
+	es.err = err
+	es.doneOnce.Do(func() { close(es.done) })
+}
+
+func (es *eventStream) LastEventID() string {
+	return es.lastEventID
+}
+
+func (es *eventStream) Path() string {
+	return es.path
+}
+
+func (es *eventStream) Done() <-chan struct{} {
+	return es.done
+}
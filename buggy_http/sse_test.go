@@ -0,0 +1,101 @@
+package buggy_http
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferWriter is a streamWriter that keeps what is written.
+type bufferWriter struct {
+	bytes.Buffer
+	err error
+}
+
+func (bw *bufferWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	return bw.Buffer.Write(p)
+}
+
+func (bw *bufferWriter) Flush() error {
+	return bw.err
+}
+
+func TestEventStreamSend(t *testing.T) {
+	w := &bufferWriter{}
+	es := &eventStream{w: w, done: make(chan struct{})}
+
+	t.Run("Fields are written in order", func(t *testing.T) {
+		w.Reset()
+		assert.NoError(t, es.Send(Event{ID: "7", Event: "update", Data: "hello", Retry: 3 * time.Second}))
+		assert.Equal(t, "id: 7\nevent: update\nretry: 3000\ndata: hello\n\n", w.String())
+	})
+
+	t.Run("Data lines are split", func(t *testing.T) {
+		w.Reset()
+		assert.NoError(t, es.Send(Event{Data: "one\r\ntwo\rthree\nfour"}))
+		assert.Equal(t, "data: one\ndata: two\ndata: three\ndata: four\n\n", w.String())
+	})
+
+	t.Run("Event without fields has empty data", func(t *testing.T) {
+		w.Reset()
+		assert.NoError(t, es.Send(Event{}))
+		assert.Equal(t, "data: \n\n", w.String())
+	})
+
+	t.Run("Comment", func(t *testing.T) {
+		w.Reset()
+		assert.NoError(t, es.Comment("heartbeat"))
+		assert.Equal(t, ": heartbeat\n\n", w.String())
+	})
+
+	t.Run("Error when id has line breaks", func(t *testing.T) {
+		assert.Error(t, es.Send(Event{ID: "1\n2"}))
+	})
+
+	t.Run("Done is closed after a failed write", func(t *testing.T) {
+		w.err = errors.New("broken pipe")
+		assert.Error(t, es.Send(Event{Data: "lost"}))
+		assert.Error(t, es.Comment("lost"))
+		select {
+		case <-es.Done():
+		default:
+			t.Error("Done() is not closed")
+		}
+	})
+}
+
+func TestReplyToEventStream(t *testing.T) {
+	bs := newTestInstance(t)
+	bs.SetWriteTimeout(1)
+	bs.config.heartbeat = 100 * time.Millisecond
+	bs.SetEventStream("/events", func(es EventStream) {
+		es.Send(Event{ID: "1", Data: "resumed after " + es.LastEventID()})
+		// The stream outlives the write timeout.
+		time.Sleep(1200 * time.Millisecond)
+		es.Send(Event{ID: "2", Event: "done", Data: es.Path()})
+	})
+	addr := startTestServer(t, bs)
+
+	t.Run("Events are streamed", func(t *testing.T) {
+		out := rawRequest(t, addr, "GET /events?x=1 HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 41\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+		assert.Contains(t, out, "content-type: text/event-stream; charset=utf-8\r\n")
+		assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+		assert.Contains(t, out, "id: 1\ndata: resumed after 41\n\n")
+		assert.Contains(t, out, ": heartbeat\n\n")
+		assert.Contains(t, out, "id: 2\nevent: done\ndata: /events?x=1\n\n")
+		assert.True(t, strings.HasSuffix(out, "0\r\n\r\n"))
+	})
+
+	t.Run("POST is 405", func(t *testing.T) {
+		out := rawRequest(t, addr, "POST /events HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	})
+}
@@ -0,0 +1,230 @@
+package buggy_http
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables set by Upgrade() for the new process.
+const (
+	// The JSON list of the addresses of the listeners passed from listenFdsStart on.
+	envListeners = "BS_LISTENERS"
+
+	// The file descriptor on which the new process writes once it is serving.
+	envUpgradeReady = "BS_UPGRADE_READY"
+)
+
+// boundListener is a listener opened for address by StartBuggyServerOn.
+type boundListener struct {
+	net.Listener
+	address string
+}
+
+// connState is the state of an open connection.
+type connState int
+
+const (
+	// Accepted, it has not sent a request yet.
+	connNew connState = iota
+
+	// A keep-alive connection waiting for its next request.
+	connIdle
+
+	// Sending a request or waiting for its response.
+	connActive
+)
+
+// trackConn adds conn to the open connections.
+func (bs *buggyInstance) trackConn(conn net.Conn) {
+	bs.connsMu.Lock()
+	defer bs.connsMu.Unlock()
+
+	if bs.conns == nil {
+		bs.conns = make(map[net.Conn]connState)
+	}
+	bs.conns[conn] = connNew
+}
+
+// untrackConn removes conn from the open connections, and tells
+// Shutdown when the last one is closed.
+func (bs *buggyInstance) untrackConn(conn net.Conn) {
+	bs.connsMu.Lock()
+	defer bs.connsMu.Unlock()
+
+	if _, ok := bs.conns[conn]; !ok {
+		return
+	}
+	delete(bs.conns, conn)
+	if bs.acceptStopped && len(bs.conns) == 0 {
+		close(bs.drained)
+	}
+}
+
+// waitForRequest waits for the first byte of the next request on conn, reader is its buffered reader.
+// It returns false if conn is an idle keep-alive connection and the server is shutting down,
+// a new connection always waits for its first request. Read errors are left to requestParser,
+// that receives them again.
+func (bs *buggyInstance) waitForRequest(conn net.Conn, reader *bufio.Reader, deadline time.Time) bool {
+	bs.connsMu.Lock()
+	state, tracked := bs.conns[conn]
+	if tracked && state != connNew {
+		if bs.draining {
+			bs.connsMu.Unlock()
+			return false
+		}
+		bs.conns[conn] = connIdle
+	}
+	bs.connsMu.Unlock()
+
+	_, err := reader.Peek(1)
+
+	bs.connsMu.Lock()
+	defer bs.connsMu.Unlock()
+
+	if !tracked {
+		return true
+	}
+	bs.conns[conn] = connActive
+	if !bs.draining || state == connNew {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	// The request arrived before Shutdown interrupted the wait, it is answered.
+	conn.SetReadDeadline(deadline)
+	return true
+}
+
+// isDraining reports whether the server is shutting down.
+func (bs *buggyInstance) isDraining() bool {
+	bs.connsMu.Lock()
+	defer bs.connsMu.Unlock()
+	return bs.draining
+}
+
+// Shutdown stops a BuggyServer gracefully: it stops accepting connections, closes the idle
+// keep-alive ones, and answers the requests in progress with 'connection: close'. The connections
+// still open after timeout, like WebSockets and event streams, are closed.
+func (bs *buggyInstance) Shutdown(timeout time.Duration) error {
+	if bs.listener == nil {
+		return fmt.Errorf("Shutdown(): BuggyServer has not been started")
+	}
+
+	bs.connsMu.Lock()
+	if bs.draining {
+		bs.connsMu.Unlock()
+		return fmt.Errorf("Shutdown(): BuggyServer is already shutting down")
+	}
+	bs.draining = true
+	bs.drained = make(chan struct{})
+	for conn, state := range bs.conns {
+		if state == connIdle {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	bs.connsMu.Unlock()
+
+	close(bs.quit)
+	err := bs.listener.Close()
+	<-bs.acceptDone
+
+	// Every connection accepted is tracked now.
+	bs.connsMu.Lock()
+	bs.acceptStopped = true
+	if len(bs.conns) == 0 {
+		close(bs.drained)
+	}
+	bs.connsMu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-bs.drained:
+	case <-timer.C:
+		bs.connsMu.Lock()
+		log.Printf("error: Shutdown(): closing %d connections still open after %s", len(bs.conns), timeout)
+		for conn := range bs.conns {
+			conn.Close()
+		}
+		bs.connsMu.Unlock()
+	}
+
+	bs.closeClients()
+	if err != nil {
+		return fmt.Errorf("Shutdown(): during bs.listener.Close(), %w", err)
+	}
+	return nil
+}
+
+// closeClients closes the idle connections to the upstream servers and the FastCGI applications.
+func (bs *buggyInstance) closeClients() {
+	if bs.config.upstreams != nil {
+		bs.config.upstreams.closeAll()
+	}
+	for _, route := range bs.config.fastcgi {
+		route.client.closeAll()
+	}
+}
+
+// inheritedListeners returns, by address, the listeners passed by the process that started
+// this one with Upgrade(). It returns nil if this process was not started by Upgrade().
+func inheritedListeners() (map[string][]net.Listener, error) {
+	value, ok := os.LookupEnv(envListeners)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(envListeners)
+
+	var addresses []string
+	if err := json.Unmarshal([]byte(value), &addresses); err != nil {
+		return nil, fmt.Errorf("inheritedListeners(): %s: %w", envListeners, err)
+	}
+
+	listeners := make(map[string][]net.Listener)
+	for i, address := range addresses {
+		file := os.NewFile(uintptr(listenFdsStart+i), address)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, ls := range listeners {
+				closeListeners(ls)
+			}
+			return nil, fmt.Errorf("inheritedListeners(): %s: %w", address, err)
+		}
+
+		// The parent leaves the socket file to this process, that removes it when it stops.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		listeners[address] = append(listeners[address], l)
+	}
+	return listeners, nil
+}
+
+// notifyUpgradeReady tells the process that started this one with Upgrade() that it is serving.
+func notifyUpgradeReady() {
+	value, ok := os.LookupEnv(envUpgradeReady)
+	if !ok {
+		return
+	}
+	os.Unsetenv(envUpgradeReady)
+
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("error: notifyUpgradeReady(): invalid %s %q", envUpgradeReady, value)
+		return
+	}
+	file := os.NewFile(uintptr(fd), "upgrade")
+	if _, err := file.Write([]byte{1}); err != nil {
+		log.Printf("error: notifyUpgradeReady(): %s", err.Error())
+	}
+	file.Close()
+}
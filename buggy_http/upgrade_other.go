@@ -0,0 +1,10 @@
+//go:build !unix
+
+package buggy_http
+
+import "fmt"
+
+// Upgrade is only available on Unix systems, that can pass the listening sockets to a new process.
+func (bs *buggyInstance) Upgrade() error {
+	return fmt.Errorf("Upgrade(): not supported on this system")
+}
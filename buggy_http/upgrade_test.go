@@ -0,0 +1,111 @@
+package buggy_http
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	bs := newTestInstance(t)
+	bs.SetEventStream("/slow", func(es EventStream) {
+		time.Sleep(300 * time.Millisecond)
+		es.Send(Event{Data: "done"})
+	})
+
+	t.Run("Error before start", func(t *testing.T) {
+		assert.Error(t, bs.Shutdown(time.Second))
+	})
+
+	if err := bs.StartBuggyServer("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	addr := bs.listener.Addr().String()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// An idle keep-alive connection.
+	idle, idleReader := dial()
+	defer idle.Close()
+	idle.Write([]byte("GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if _, err := responseParser(idleReader, "GET", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request in progress.
+	slow, slowReader := dial()
+	defer slow.Close()
+	slow.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if _, err := responseHeadParser(slowReader); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	assert.NoError(t, bs.Shutdown(5*time.Second))
+	elapsed := time.Since(start)
+
+	t.Run("Requests in progress are completed", func(t *testing.T) {
+		assert.Less(t, elapsed, 2*time.Second)
+		rest, err := io.ReadAll(slowReader)
+		assert.NoError(t, err)
+		assert.Contains(t, string(rest), "data: done\n\n")
+		assert.True(t, strings.HasSuffix(string(rest), "0\r\n\r\n"))
+	})
+
+	t.Run("Idle connections are closed", func(t *testing.T) {
+		n, err := idleReader.Read(make([]byte, 1))
+		assert.Equal(t, 0, n)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("New connections are refused", func(t *testing.T) {
+		_, err := net.Dial("tcp", addr)
+		assert.Error(t, err)
+	})
+
+	t.Run("Error when called twice", func(t *testing.T) {
+		assert.Error(t, bs.Shutdown(time.Second))
+	})
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	bs := newTestInstance(t)
+	bs.SetEventStream("/forever", func(es EventStream) {
+		<-es.Done()
+	})
+	if err := bs.StartBuggyServer("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", bs.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /forever HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	if _, err := responseHeadParser(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	assert.NoError(t, bs.Shutdown(200*time.Millisecond))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The stream is cut.
+	_, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,138 @@
+//go:build unix
+
+package buggy_http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeTimeout is how long Upgrade waits for the new process to start serving.
+const upgradeTimeout = 30 * time.Second
+
+// Upgrade starts a new process of the executable of this one, with the same arguments,
+// that takes over the listening sockets. It returns once the new process is serving,
+// this one should then stop with Shutdown(). If the new process does not start serving
+// within upgradeTimeout it is killed, and this one keeps serving.
+func (bs *buggyInstance) Upgrade() error {
+	if bs.listener == nil {
+		return fmt.Errorf("Upgrade(): BuggyServer has not been started")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Upgrade(): %w", err)
+	}
+
+	// The descriptors are duplicated with syscall.Dup and passed with syscall.ForkExec:
+	// File() and os.StartProcess would put the sockets in blocking mode, and this
+	// process could then no longer close a listener while it is accepting.
+	fds := make([]int, 0, len(bs.listeners))
+	addresses := make([]string, 0, len(bs.listeners))
+	defer func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
+	for _, l := range bs.listeners {
+		fd, err := dupListener(l.Listener)
+		if err != nil {
+			return fmt.Errorf("Upgrade(): %s: %w", l.address, err)
+		}
+		fds = append(fds, fd)
+		addresses = append(addresses, l.address)
+	}
+	encoded, err := json.Marshal(addresses)
+	if err != nil {
+		return fmt.Errorf("Upgrade(): %w", err)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Upgrade(): %w", err)
+	}
+	defer ready.Close()
+
+	// The sockets passed by systemd are among the listeners, the new process must not look for them.
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		switch name, _, _ := strings.Cut(kv, "="); name {
+		case envListeners, envUpgradeReady, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		envListeners+"="+string(encoded),
+		envUpgradeReady+"="+strconv.Itoa(listenFdsStart+len(fds)),
+	)
+
+	files := []uintptr{uintptr(syscall.Stdin), uintptr(syscall.Stdout), uintptr(syscall.Stderr)}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	files = append(files, readyWriter.Fd())
+
+	pid, err := syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{Env: env, Files: files})
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("Upgrade(): %w", err)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("Upgrade(): %w", err)
+	}
+	log.Printf("Upgrade(): started %s with pid %d", executable, pid)
+
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		process.Kill()
+		process.Wait()
+		return fmt.Errorf("Upgrade(): the new process did not start serving: %w", err)
+	}
+	process.Release()
+
+	// The socket files now belong to the new process, this one must not remove them when it stops.
+	for _, l := range bs.listeners {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// dupListener returns a duplicate of the descriptor of l, that is closed on exec.
+func dupListener(l net.Listener) (int, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return -1, fmt.Errorf("the listener cannot be passed to another process")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	dup := -1
+	var dupErr error
+	err = raw.Control(func(fd uintptr) {
+		// Like the descriptors opened by the os package, it must not leak to the processes started meanwhile.
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+
+		dup, dupErr = syscall.Dup(int(fd))
+		if dupErr == nil {
+			syscall.CloseOnExec(dup)
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	return dup, dupErr
+}
@@ -0,0 +1,197 @@
+//go:build unix
+
+package buggy_http
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envUpgradeTestSocket makes the test binary run upgradeTestServer instead of the tests.
+const envUpgradeTestSocket = "BS_UPGRADE_TEST_SOCKET"
+
+func TestMain(m *testing.M) {
+	if socket := os.Getenv(envUpgradeTestSocket); socket != "" {
+		upgradeTestServer(socket)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradeTestServer serves on the Unix socket, it upgrades on SIGUSR2 and stops on SIGTERM.
+// /pid answers with the pid of the process, /slow too after one second.
+func upgradeTestServer(socket string) {
+	bs := NewBuggyServer()
+	bs.SetBaseDir(os.TempDir())
+	bs.SetEventStream("/pid", func(es EventStream) {
+		es.Send(Event{Data: strconv.Itoa(os.Getpid())})
+	})
+	bs.SetEventStream("/slow", func(es EventStream) {
+		time.Sleep(time.Second)
+		es.Send(Event{Data: strconv.Itoa(os.Getpid())})
+	})
+	if err := bs.StartBuggyServerOn("unix:" + socket); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2, syscall.SIGTERM)
+	for sig := range c {
+		if sig == syscall.SIGUSR2 {
+			if err := bs.Upgrade(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			bs.Shutdown(10 * time.Second)
+			os.Exit(0)
+		}
+		bs.StopBuggyServer()
+		os.Exit(0)
+	}
+}
+
+var pidData = regexp.MustCompile(`data: ([0-9]+)\n`)
+
+// requestPid requests path on socket and returns the pid in the response.
+func requestPid(socket string, path string) (int, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		return 0, err
+	}
+	match := pidData.FindSubmatch(b)
+	if match == nil {
+		return 0, fmt.Errorf("no pid in %q", b)
+	}
+	return strconv.Atoi(string(match[1]))
+}
+
+func TestUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts the test binary")
+	}
+
+	dir := socketDir(t)
+	socket := filepath.Join(dir, "bs.sock")
+	logFile, err := os.Create(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := exec.Command(executable, "-test.run=^$")
+	parent.Env = append(os.Environ(), envUpgradeTestSocket+"="+socket)
+	// A file, not a pipe, so that Wait does not wait for the new process that inherits it.
+	parent.Stdout, parent.Stderr = logFile, logFile
+	if err := parent.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var child int
+	defer func() {
+		parent.Process.Kill()
+		if child != 0 {
+			syscall.Kill(child, syscall.SIGTERM)
+		}
+		if t.Failed() {
+			out, _ := os.ReadFile(logFile.Name())
+			t.Logf("server log:\n%s", out)
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pid, err := requestPid(socket, "/pid")
+		if err == nil {
+			assert.Equal(t, parent.Process.Pid, pid)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server is not serving: %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// A request in progress during the upgrade is answered by the old process.
+	slow := make(chan int, 1)
+	go func() {
+		pid, err := requestPid(socket, "/slow")
+		if err != nil {
+			t.Errorf("/slow: %s", err)
+		}
+		slow <- pid
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	if err := parent.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	// No request fails while the new process takes over.
+	deadline = time.Now().Add(10 * time.Second)
+	for child == 0 {
+		pid, err := requestPid(socket, "/pid")
+		if !assert.NoError(t, err) {
+			return
+		}
+		if pid != parent.Process.Pid {
+			child = pid
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the new process is not serving")
+		}
+	}
+
+	assert.Equal(t, parent.Process.Pid, <-slow)
+
+	exited := make(chan error, 1)
+	go func() { exited <- parent.Wait() }()
+	select {
+	case err := <-exited:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the old process did not exit")
+	}
+
+	// The socket file is left to the new process.
+	pid, err := requestPid(socket, "/pid")
+	assert.NoError(t, err)
+	assert.Equal(t, child, pid)
+
+	syscall.Kill(child, syscall.SIGTERM)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the socket is not removed when the new process stops")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	child = 0
+}
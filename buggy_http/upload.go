@@ -0,0 +1,462 @@
+package buggy_http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// replyToPUT writes the body of the request to the file identified by its path.
+// The file is created with 201 code or replaced with 204 code, the missing intermediate
+// directories are created only if createDirs is enabled, otherwise 409 is sent.
+// If-Match and If-None-Match preconditions are evaluated against the existing file.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-9.3.4
+func replyToPUT(request *request, config *buggyConfig) (*response, error) {
+
+	path, err := url.QueryUnescape(request.path)
+	if err != nil {
+		return r400(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+	}
+
+	path, err = resolvePath(config.baseDir, path)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+	if err := checkRealDir(config.baseDir, filepath.Dir(path)); err != nil {
+		return r403(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 403 sent", request.method, request.path, err)
+	}
+
+	exists := false
+	fileInfo, err := os.Stat(path)
+	if err == nil {
+		exists = true
+		if fileInfo.IsDir() {
+			return r409(), fmt.Errorf("replyToPUT() -> %s, %s : path is a directory. 409 sent", request.method, request.path)
+		}
+	} else if errors.Is(err, syscall.ENOTDIR) {
+		return r409(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 409 sent", request.method, request.path, err)
+	} else if !os.IsNotExist(err) {
+		return r500(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	if !checkWritePreconditions(request.headers, exists) {
+		return r412(), fmt.Errorf("replyToPUT() -> %s, %s : precondition failed. 412 sent", request.method, request.path)
+	}
+
+	dir := filepath.Dir(path)
+	if config.createDirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return r409(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 409 sent", request.method, request.path, err)
+		}
+	} else if dirInfo, err := os.Stat(dir); err != nil || !dirInfo.IsDir() {
+		return r409(), fmt.Errorf("replyToPUT() -> %s, %s : parent directory does not exist. 409 sent", request.method, request.path)
+	}
+
+	if err := writeFileAtomic(path, bytes.NewReader(request.body)); err != nil {
+		return r500(), fmt.Errorf("replyToPUT() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	if exists {
+		return r204(), nil
+	}
+
+	r := r201()
+	r.headers["location"] = []string{request.path}
+	return r, nil
+}
+
+// replyToDELETE removes the file identified by the path of the request,
+// if the path starts with one of the configured delete prefixes.
+// Directories are removed only if recursiveDelete is enabled, otherwise 409 is sent.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-9.3.5
+func replyToDELETE(request *request, config *buggyConfig) (*response, error) {
+
+	urlPath, err := url.QueryUnescape(request.path)
+	if err != nil {
+		return r400(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+	}
+	urlPath = path.Clean("/" + urlPath)
+
+	if !deleteAllowed(urlPath, config) {
+		return r403(), fmt.Errorf("replyToDELETE() -> %s, %s : path is not under a delete prefix. 403 sent", request.method, request.path)
+	}
+
+	filePath, err := resolvePath(config.baseDir, urlPath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+	if err := checkRealDir(config.baseDir, filepath.Dir(filePath)); err != nil {
+		return r403(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 403 sent", request.method, request.path, err)
+	}
+
+	absBaseDir, err := filepath.Abs(config.baseDir)
+	if err != nil {
+		return r500(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+	if filePath == absBaseDir {
+		return r403(), fmt.Errorf("replyToDELETE() -> %s, %s : the base directory cannot be removed. 403 sent", request.method, request.path)
+	}
+
+	fileInfo, err := os.Lstat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return r404(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+		}
+		return r500(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	if !checkWritePreconditions(request.headers, true) {
+		return r412(), fmt.Errorf("replyToDELETE() -> %s, %s : precondition failed. 412 sent", request.method, request.path)
+	}
+
+	if fileInfo.IsDir() {
+		if !config.recursiveDelete {
+			return r409(), fmt.Errorf("replyToDELETE() -> %s, %s : path is a directory. 409 sent", request.method, request.path)
+		}
+		err = os.RemoveAll(filePath)
+	} else {
+		err = os.Remove(filePath)
+	}
+	if err != nil {
+		return r500(), fmt.Errorf("replyToDELETE() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	return r204(), nil
+}
+
+// deleteAllowed reports whether the URL path p is under one of the configured delete prefixes.
+func deleteAllowed(p string, config *buggyConfig) bool {
+	for _, prefix := range config.deletePrefixes {
+		if hasPathPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether the URL path p is prefix or is inside it.
+// "/tmp" is prefix of "/tmp" and "/tmp/foo", but not of "/tmpfoo".
+func hasPathPrefix(p, prefix string) bool {
+	if prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, prefix+"/")
+}
+
+// checkWritePreconditions evaluates the If-Match and If-None-Match headers
+// of a request that modifies a file, exists tells if the file is already present.
+// BuggyServer does not generate entity-tags, so only '*' can match.
+// See https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2
+func checkWritePreconditions(headers map[string][]string, exists bool) bool {
+	if values, ok := headers["if-match"]; ok {
+		if !exists || !(len(values) == 1 && values[0] == "*") {
+			return false
+		}
+	}
+
+	if values, ok := headers["if-none-match"]; ok {
+		if exists && len(values) == 1 && values[0] == "*" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeFileAtomic writes the content of r to a temporary file in the same directory of path,
+// then renames it to path. Readers never see a partially written file.
+func writeFileAtomic(path string, r io.Reader) error {
+	tmp, err := writeTempFile(path, r)
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic(): %w", err)
+	}
+
+	// Removing the temporary file fails once it has been renamed.
+	defer os.Remove(tmp)
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writeFileAtomic(): %w", err)
+	}
+	return nil
+}
+
+// writeFileExclusive is like writeFileAtomic, but it never replaces an existing file: if path
+// exists, even if it has been created by another request in the meantime, the error wraps fs.ErrExist.
+func writeFileExclusive(path string, r io.Reader) error {
+	tmp, err := writeTempFile(path, r)
+	if err != nil {
+		return fmt.Errorf("writeFileExclusive(): %w", err)
+	}
+	defer os.Remove(tmp)
+
+	// Unlike a rename, a hard link fails if path exists.
+	if err := os.Link(tmp, path); err != nil {
+		return fmt.Errorf("writeFileExclusive(): %w", err)
+	}
+	return nil
+}
+
+// writeTempFile writes the content of r to a new temporary file in the same directory of path,
+// and returns its name.
+func writeTempFile(path string, r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".upload-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// isUploadEndpoint reports whether the request targets the upload endpoint, if it is enabled.
+func isUploadEndpoint(request *request, config *buggyConfig) bool {
+	if !config.uploads || config.uploadEndpoint == "" {
+		return false
+	}
+
+	urlPath, err := url.QueryUnescape(request.path)
+	if err != nil {
+		return false
+	}
+	return hasPathPrefix(path.Clean("/"+urlPath), config.uploadEndpoint)
+}
+
+// uploadTarget returns the URL path and the filesystem path of the directory
+// targeted by a request to the upload endpoint, e.g. "/_upload/foo" targets "/foo".
+func uploadTarget(request *request, config *buggyConfig) (string, string, error) {
+	urlPath, err := url.QueryUnescape(request.path)
+	if err != nil {
+		return "", "", err
+	}
+
+	urlDir := strings.TrimPrefix(path.Clean("/"+urlPath), config.uploadEndpoint)
+	urlDir = path.Clean("/" + urlDir)
+
+	dirPath, err := resolvePath(config.baseDir, urlDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	return urlDir, dirPath, nil
+}
+
+// replyToUploadForm sends a minimal HTML form to upload files from a browser
+// to the directory targeted by the request.
+func replyToUploadForm(request *request, config *buggyConfig) (*response, error) {
+
+	urlDir, dirPath, err := uploadTarget(request, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToUploadForm() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	if dirInfo, err := os.Stat(dirPath); (err != nil || !dirInfo.IsDir()) && !config.createDirs {
+		return r404(), fmt.Errorf("replyToUploadForm() -> %s, %s : directory does not exist. 404 sent", request.method, request.path)
+	}
+
+	title := html.EscapeString("Upload to " + urlDir)
+	body := []byte("<!DOCTYPE html>\n" +
+		"<html>\n" +
+		"<head><title>" + title + "</title></head>\n" +
+		"<body>\n" +
+		"<h1>" + title + "</h1>\n" +
+		"<form method=\"post\" enctype=\"multipart/form-data\" action=\"" + html.EscapeString(request.path) + "\">\n" +
+		"<input type=\"file\" name=\"file\" multiple required>\n" +
+		"<button type=\"submit\">Upload</button>\n" +
+		"</form>\n" +
+		"</body>\n" +
+		"</html>\n")
+
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-type":   {"text/html; charset=utf-8"},
+		"content-length": {fmt.Sprintf("%v", len(body))},
+	}
+
+	if request.method == "HEAD" {
+		body = make([]byte, 0)
+	}
+
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         200,
+		reasonPhrase: "OK",
+		headers:      headers,
+		body:         body,
+	}, nil
+}
+
+// replyToPOST stores the files of a multipart/form-data request to the upload endpoint
+// in the directory it targets. Form fields that are not files are ignored,
+// existing files are not overwritten and every file must fit in maxPartBytes.
+// Either all the files are stored or none of them.
+func replyToPOST(request *request, config *buggyConfig) (*response, error) {
+
+	urlDir, dirPath, err := uploadTarget(request, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+	if err := checkRealDir(config.baseDir, dirPath); err != nil {
+		return r403(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 403 sent", request.method, request.path, err)
+	}
+
+	if dirInfo, err := os.Stat(dirPath); (err != nil || !dirInfo.IsDir()) && !config.createDirs {
+		return r404(), fmt.Errorf("replyToPOST() -> %s, %s : directory does not exist. 404 sent", request.method, request.path)
+	}
+
+	contentType := strings.Join(request.headers["content-type"], ", ")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "multipart/form-data" {
+		return r415(), fmt.Errorf("replyToPOST() -> %s, %s : content-type %q is not multipart/form-data. 415 sent", request.method, request.path, contentType)
+	}
+
+	// The parts are read twice: the first time every file is checked, so that a request
+	// that fails leaves nothing on disk, the second time they are written.
+	mr, err := newMultipartReader(bytes.NewReader(request.body), contentType, int64(config.maxPartBytes))
+	if err != nil {
+		return r400(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+	}
+
+	names := map[string]bool{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return r400(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+		}
+
+		if part.filename == "" {
+			continue
+		}
+
+		name := sanitizeFilename(part.filename)
+		if name == "" {
+			return r400(), fmt.Errorf("replyToPOST() -> %s, %s : invalid filename %q. 400 sent", request.method, request.path, part.filename)
+		}
+		if names[name] {
+			return r409(), fmt.Errorf("replyToPOST() -> %s, %s : %s is sent twice. 409 sent", request.method, request.path, name)
+		}
+		if _, err := os.Lstat(filepath.Join(dirPath, name)); err == nil {
+			return r409(), fmt.Errorf("replyToPOST() -> %s, %s : %s already exists. 409 sent", request.method, request.path, name)
+		}
+
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			if errors.Is(err, errPartTooLarge) {
+				return r413(), fmt.Errorf("replyToPOST() -> %s, %s : %s: %w. 413 sent", request.method, request.path, name, err)
+			}
+			return r400(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+		}
+		names[name] = true
+	}
+
+	if len(names) == 0 {
+		return r400(), fmt.Errorf("replyToPOST() -> %s, %s : no files in the request. 400 sent", request.method, request.path)
+	}
+
+	if config.createDirs {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			return r409(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 409 sent", request.method, request.path, err)
+		}
+	}
+
+	saved := []string{}
+	// The files already stored are removed if a later one cannot be.
+	removeSaved := func() {
+		for _, name := range saved {
+			os.Remove(filepath.Join(dirPath, name))
+		}
+	}
+
+	mr, _ = newMultipartReader(bytes.NewReader(request.body), contentType, int64(config.maxPartBytes))
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeSaved()
+			return r500(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+		}
+
+		if part.filename == "" {
+			continue
+		}
+
+		name := sanitizeFilename(part.filename)
+		if err := writeFileExclusive(filepath.Join(dirPath, name), part); err != nil {
+			removeSaved()
+			if errors.Is(err, fs.ErrExist) {
+				return r409(), fmt.Errorf("replyToPOST() -> %s, %s : %s already exists. 409 sent", request.method, request.path, name)
+			}
+			return r500(), fmt.Errorf("replyToPOST() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+		}
+
+		saved = append(saved, name)
+	}
+
+	var list strings.Builder
+	for _, name := range saved {
+		list.WriteString("<li>" + html.EscapeString(path.Join(urlDir, name)) + "</li>\n")
+	}
+
+	body := []byte("<!DOCTYPE html>\n" +
+		"<html>\n" +
+		"<head><title>Uploaded</title></head>\n" +
+		"<body>\n" +
+		"<h1>Uploaded</h1>\n" +
+		"<ul>\n" + list.String() + "</ul>\n" +
+		"<a href=\"" + html.EscapeString(request.path) + "\">Upload more files</a>\n" +
+		"</body>\n" +
+		"</html>\n")
+
+	r := r201()
+	r.headers["location"] = []string{path.Join(urlDir, saved[0])}
+	r.headers["content-type"] = []string{"text/html; charset=utf-8"}
+	r.headers["content-length"] = []string{fmt.Sprintf("%v", len(body))}
+	r.body = body
+	return r, nil
+}
+
+// sanitizeFilename returns the last element of a filename sent by a client,
+// some browsers send the full path of the file on the client's filesystem.
+// It returns an empty string if the name cannot be used.
+func sanitizeFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	if filename == "." || filename == ".." || strings.ContainsRune(filename, 0) {
+		return ""
+	}
+	return filename
+}
@@ -0,0 +1,342 @@
+package buggy_http
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyToPUT(t *testing.T) {
+	baseDir := t.TempDir()
+	config := &buggyConfig{baseDir: baseDir, uploads: true}
+
+	put := func(path string, body string, headers map[string][]string) *response {
+		if headers == nil {
+			headers = map[string][]string{}
+		}
+		r, _ := replyToPUT(&request{method: "PUT", path: path, proto: "HTTP/1.1", headers: headers, body: []byte(body)}, config)
+		return r
+	}
+
+	t.Run("Create a new file", func(t *testing.T) {
+		r := put("/new.txt", "hello", nil)
+		assert.Equal(t, 201, r.code)
+		assert.Equal(t, []string{"/new.txt"}, r.headers["location"])
+
+		content, err := os.ReadFile(filepath.Join(baseDir, "new.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+	})
+
+	t.Run("Replace an existing file", func(t *testing.T) {
+		r := put("/new.txt", "world", nil)
+		assert.Equal(t, 204, r.code)
+
+		content, _ := os.ReadFile(filepath.Join(baseDir, "new.txt"))
+		assert.Equal(t, "world", string(content))
+	})
+
+	t.Run("If-None-Match * prevents overwrites", func(t *testing.T) {
+		r := put("/new.txt", "again", map[string][]string{"if-none-match": {"*"}})
+		assert.Equal(t, 412, r.code)
+	})
+
+	t.Run("If-Match * requires an existing file", func(t *testing.T) {
+		r := put("/missing.txt", "data", map[string][]string{"if-match": {"*"}})
+		assert.Equal(t, 412, r.code)
+		_, err := os.Stat(filepath.Join(baseDir, "missing.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Missing directory without createDirs", func(t *testing.T) {
+		r := put("/a/b/file.txt", "data", nil)
+		assert.Equal(t, 409, r.code)
+	})
+
+	t.Run("Missing directory with createDirs", func(t *testing.T) {
+		config.createDirs = true
+		defer func() { config.createDirs = false }()
+
+		r := put("/a/b/file.txt", "data", nil)
+		assert.Equal(t, 201, r.code)
+		_, err := os.Stat(filepath.Join(baseDir, "a", "b", "file.txt"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Directory target", func(t *testing.T) {
+		r := put("/a", "data", nil)
+		assert.Equal(t, 409, r.code)
+	})
+
+	t.Run("Path traversal", func(t *testing.T) {
+		r := put("/../outside.txt", "data", nil)
+		assert.Equal(t, 404, r.code)
+	})
+
+	t.Run("No temporary files are left", func(t *testing.T) {
+		entries, _ := os.ReadDir(baseDir)
+		for _, e := range entries {
+			assert.NotContains(t, e.Name(), ".upload-")
+		}
+	})
+}
+
+func TestCheckWritePreconditions(t *testing.T) {
+	testCases := []struct {
+		name     string
+		headers  map[string][]string
+		exists   bool
+		expected bool
+	}{
+		{"No preconditions", map[string][]string{}, true, true},
+		{"If-Match * on existing file", map[string][]string{"if-match": {"*"}}, true, true},
+		{"If-Match * on missing file", map[string][]string{"if-match": {"*"}}, false, false},
+		{"If-Match entity-tag", map[string][]string{"if-match": {`"abc"`}}, true, false},
+		{"If-None-Match * on existing file", map[string][]string{"if-none-match": {"*"}}, true, false},
+		{"If-None-Match * on missing file", map[string][]string{"if-none-match": {"*"}}, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, checkWritePreconditions(tc.headers, tc.exists))
+		})
+	}
+}
+
+func TestReplyToDELETE(t *testing.T) {
+	baseDir := t.TempDir()
+	config := &buggyConfig{baseDir: baseDir, uploads: true, deletePrefixes: []string{"/tmp"}}
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(baseDir, "tmp", "dir"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(baseDir, "tmp", "file.txt"), []byte("data"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(baseDir, "tmp", "dir", "file.txt"), []byte("data"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(baseDir, "keep.txt"), []byte("data"), 0644))
+
+	del := func(path string) *response {
+		r, _ := replyToDELETE(&request{method: "DELETE", path: path, proto: "HTTP/1.1", headers: map[string][]string{}}, config)
+		return r
+	}
+
+	t.Run("Delete a file", func(t *testing.T) {
+		assert.Equal(t, 204, del("/tmp/file.txt").code)
+		_, err := os.Stat(filepath.Join(baseDir, "tmp", "file.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		assert.Equal(t, 404, del("/tmp/file.txt").code)
+	})
+
+	t.Run("Path outside the prefixes", func(t *testing.T) {
+		assert.Equal(t, 403, del("/keep.txt").code)
+		assert.Equal(t, 403, del("/tmp/../keep.txt").code)
+		_, err := os.Stat(filepath.Join(baseDir, "keep.txt"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("Directory without recursive", func(t *testing.T) {
+		assert.Equal(t, 409, del("/tmp/dir").code)
+	})
+
+	t.Run("Directory with recursive", func(t *testing.T) {
+		config.recursiveDelete = true
+		defer func() { config.recursiveDelete = false }()
+
+		assert.Equal(t, 204, del("/tmp/dir").code)
+		_, err := os.Stat(filepath.Join(baseDir, "tmp", "dir"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Base directory is never removed", func(t *testing.T) {
+		config.deletePrefixes = []string{"/"}
+		config.recursiveDelete = true
+		defer func() {
+			config.deletePrefixes = []string{"/tmp"}
+			config.recursiveDelete = false
+		}()
+
+		assert.Equal(t, 403, del("/").code)
+		_, err := os.Stat(baseDir)
+		assert.NoError(t, err)
+	})
+}
+
+func TestWritesThroughSymlinks(t *testing.T) {
+	baseDir := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(outside, "victim.txt"), []byte("data"), 0644))
+	if err := os.Symlink(outside, filepath.Join(baseDir, "out")); err != nil {
+		t.Skip(err)
+	}
+	config := &buggyConfig{
+		baseDir: baseDir, uploads: true, createDirs: true, recursiveDelete: true,
+		deletePrefixes: []string{"/"}, uploadEndpoint: "/_upload", webdav: true,
+	}
+
+	send := func(method, path string, headers map[string][]string, body string) *response {
+		if headers == nil {
+			headers = map[string][]string{}
+		}
+		r, _ := reply(&request{method: method, path: path, proto: "HTTP/1.1", headers: headers, body: []byte(body)}, config)
+		return r
+	}
+
+	assert.Equal(t, 403, send("PUT", "/out/new.txt", nil, "hello").code)
+	assert.Equal(t, 403, send("PUT", "/out/sub/new.txt", nil, "hello").code)
+	assert.Equal(t, 403, send("DELETE", "/out/victim.txt", nil, "").code)
+	assert.Equal(t, 403, send("MKCOL", "/out/dir", nil, "").code)
+	assert.Equal(t, 403, send("POST", "/_upload/out", map[string][]string{"content-type": {"multipart/form-data; boundary=XyZ"}}, testMultipartBody).code)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(baseDir, "in.txt"), []byte("data"), 0644))
+	assert.Equal(t, 403, send("COPY", "/in.txt", map[string][]string{"destination": {"/out/in.txt"}}, "").code)
+	assert.Equal(t, 403, send("MOVE", "/out/victim.txt", map[string][]string{"destination": {"/victim.txt"}}, "").code)
+
+	entries, _ := os.ReadDir(outside)
+	assert.Len(t, entries, 1)
+	_, err := os.Stat(filepath.Join(outside, "victim.txt"))
+	assert.NoError(t, err)
+
+	t.Run("Links inside the base directory are followed", func(t *testing.T) {
+		assert.NoError(t, os.Mkdir(filepath.Join(baseDir, "real"), 0755))
+		assert.NoError(t, os.Symlink(filepath.Join(baseDir, "real"), filepath.Join(baseDir, "alias")))
+		assert.Equal(t, 201, send("PUT", "/alias/new.txt", nil, "hello").code)
+		_, err := os.Stat(filepath.Join(baseDir, "real", "new.txt"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestHasPathPrefix(t *testing.T) {
+	assert.True(t, hasPathPrefix("/tmp", "/tmp"))
+	assert.True(t, hasPathPrefix("/tmp/foo", "/tmp"))
+	assert.True(t, hasPathPrefix("/foo", "/"))
+	assert.False(t, hasPathPrefix("/tmpfoo", "/tmp"))
+	assert.False(t, hasPathPrefix("/", "/tmp"))
+}
+
+func TestUploadEndpoint(t *testing.T) {
+	baseDir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(baseDir, "docs"), 0755))
+	config := &buggyConfig{baseDir: baseDir, uploads: true, uploadEndpoint: "/_upload"}
+
+	newRequest := func(method, path, body string) *request {
+		return &request{
+			method:  method,
+			path:    path,
+			proto:   "HTTP/1.1",
+			headers: map[string][]string{"content-type": {"multipart/form-data; boundary=XyZ"}},
+			body:    []byte(body),
+		}
+	}
+
+	t.Run("Form", func(t *testing.T) {
+		r, err := reply(newRequest("GET", "/_upload/docs", ""), config)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.code)
+		assert.Contains(t, string(r.body), `action="/_upload/docs"`)
+		assert.Contains(t, string(r.body), `enctype="multipart/form-data"`)
+	})
+
+	t.Run("Form for a missing directory", func(t *testing.T) {
+		r, _ := reply(newRequest("GET", "/_upload/missing", ""), config)
+		assert.Equal(t, 404, r.code)
+	})
+
+	t.Run("Upload files", func(t *testing.T) {
+		r, err := reply(newRequest("POST", "/_upload/docs", testMultipartBody), config)
+		assert.NoError(t, err)
+		assert.Equal(t, 201, r.code)
+		assert.Equal(t, []string{"/docs/a, b.txt"}, r.headers["location"])
+
+		content, err := os.ReadFile(filepath.Join(baseDir, "docs", "a, b.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "line one\r\n--not the boundary\r\nline two", string(content))
+
+		_, err = os.Stat(filepath.Join(baseDir, "docs", "title"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Existing files are not overwritten", func(t *testing.T) {
+		r, _ := reply(newRequest("POST", "/_upload/docs", testMultipartBody), config)
+		assert.Equal(t, 409, r.code)
+	})
+
+	t.Run("File larger than maxPartBytes", func(t *testing.T) {
+		config.maxPartBytes = 1 << 20
+		defer func() { config.maxPartBytes = 0 }()
+
+		body := "--XyZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"big.bin\"\r\n\r\n" +
+			strings.Repeat("a", 1<<20+1) + "\r\n--XyZ--\r\n"
+		r, _ := reply(newRequest("POST", "/_upload", body), config)
+		assert.Equal(t, 413, r.code)
+		_, err := os.Stat(filepath.Join(baseDir, "big.bin"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("A failed upload leaves no files", func(t *testing.T) {
+		config.maxPartBytes = 1 << 20
+		defer func() { config.maxPartBytes = 0 }()
+
+		part := func(filename, content string) string {
+			return "--XyZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"" + filename + "\"\r\n\r\n" + content + "\r\n"
+		}
+		for code, body := range map[int]string{
+			413: part("first.txt", "small") + part("second.bin", strings.Repeat("a", 1<<20+1)) + "--XyZ--\r\n",
+			409: part("first.txt", "small") + part("a, b.txt", "again") + "--XyZ--\r\n",
+			400: part("first.txt", "small") + part("..", "invalid") + "--XyZ--\r\n",
+		} {
+			r, _ := reply(newRequest("POST", "/_upload/docs", body), config)
+			assert.Equal(t, code, r.code)
+			_, err := os.Stat(filepath.Join(baseDir, "docs", "first.txt"))
+			assert.True(t, os.IsNotExist(err), code)
+		}
+
+		r, _ := reply(newRequest("POST", "/_upload/docs", part("twice.txt", "one")+part("twice.txt", "two")+"--XyZ--\r\n"), config)
+		assert.Equal(t, 409, r.code)
+		_, err := os.Stat(filepath.Join(baseDir, "docs", "twice.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Not multipart", func(t *testing.T) {
+		req := newRequest("POST", "/_upload/docs", "data")
+		req.headers["content-type"] = []string{"text/plain"}
+		r, _ := reply(req, config)
+		assert.Equal(t, 415, r.code)
+	})
+
+	t.Run("POST outside the endpoint", func(t *testing.T) {
+		r, _ := reply(newRequest("POST", "/docs", testMultipartBody), config)
+		assert.Equal(t, 405, r.code)
+		assert.Contains(t, r.headers["allow"], "POST")
+	})
+
+	t.Run("Endpoint disabled without uploads", func(t *testing.T) {
+		config.uploads = false
+		defer func() { config.uploads = true }()
+
+		r, _ := reply(newRequest("POST", "/_upload/docs", testMultipartBody), config)
+		assert.Equal(t, 405, r.code)
+	})
+}
+
+func TestWriteFileExclusive(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "file.txt")
+	assert.NoError(t, writeFileExclusive(p, strings.NewReader("first")))
+	assert.ErrorIs(t, writeFileExclusive(p, strings.NewReader("second")), fs.ErrExist)
+
+	content, _ := os.ReadFile(p)
+	assert.Equal(t, "first", string(content))
+	entries, _ := os.ReadDir(filepath.Dir(p))
+	assert.Len(t, entries, 1, "the temporary files are removed")
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	assert.Equal(t, "file.txt", sanitizeFilename("file.txt"))
+	assert.Equal(t, "file.txt", sanitizeFilename("../../file.txt"))
+	assert.Equal(t, "file.txt", sanitizeFilename(`C:\Users\me\file.txt`))
+	assert.Equal(t, "", sanitizeFilename(".."))
+	assert.Equal(t, "", sanitizeFilename("dir/"))
+}
@@ -0,0 +1,236 @@
+package buggy_http
+
+import (
+	"bytes"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveReloadPath is the URL path of the event stream that tells browsers to reload.
+const liveReloadPath = "/__bs/livereload"
+
+// reloadScript is injected in the HTML pages served in watch mode.
+const reloadScript = `<script>new EventSource("` + liveReloadPath + `").addEventListener("reload", function () { location.reload(); });</script>`
+
+// pollInterval is how often the base directory is scanned when the OS cannot notify changes.
+const pollInterval = 500 * time.Millisecond
+
+// reloadDelay groups the changes made together, like saving many files at once, in one reload.
+const reloadDelay = 100 * time.Millisecond
+
+// liveReload sends a reload event to the browsers connected to liveReloadPath.
+type liveReload struct {
+	mu      sync.Mutex
+	clients map[chan string]struct{}
+}
+
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan string]struct{})}
+}
+
+func (lr *liveReload) subscribe() chan string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	ch := make(chan string, 1)
+	lr.clients[ch] = struct{}{}
+	return ch
+}
+
+func (lr *liveReload) unsubscribe(ch chan string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if _, ok := lr.clients[ch]; ok {
+		delete(lr.clients, ch)
+		close(ch)
+	}
+}
+
+// notify tells every browser that file has changed.
+// A browser that has not received the previous notification only receives the first one.
+func (lr *liveReload) notify(file string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for ch := range lr.clients {
+		select {
+		case ch <- file:
+		default:
+		}
+	}
+}
+
+// closeAll ends the event streams of all the browsers.
+func (lr *liveReload) closeAll() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for ch := range lr.clients {
+		delete(lr.clients, ch)
+		close(ch)
+	}
+}
+
+// handler is the EventStreamHandler of liveReloadPath.
+func (lr *liveReload) handler(es EventStream) {
+	ch := lr.subscribe()
+	defer lr.unsubscribe(ch)
+
+	for {
+		select {
+		case <-es.Done():
+			return
+		case file, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := es.Send(Event{Event: "reload", Data: file}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// injectReloadScript adds reloadScript to a HTML response, before </body> if it has one.
+// HEAD responses only have their content-length updated.
+func injectReloadScript(r *response, method string) *response {
+	if r.code != 200 || len(r.headers["content-type"]) == 0 || !strings.HasPrefix(r.headers["content-type"][0], "text/html") {
+		return r
+	}
+
+	// Streamed responses have no content-length, they are sent unchanged.
+	if len(r.headers["content-length"]) == 0 {
+		return r
+	}
+	length, err := strconv.Atoi(r.headers["content-length"][0])
+	if err != nil {
+		return r
+	}
+	r.headers["content-length"] = []string{strconv.Itoa(length + len(reloadScript))}
+
+	if method == "HEAD" {
+		return r
+	}
+
+	if i := bytes.LastIndex(bytes.ToLower(r.body), []byte("</body>")); i >= 0 {
+		body := make([]byte, 0, len(r.body)+len(reloadScript))
+		body = append(body, r.body[:i]...)
+		body = append(body, reloadScript...)
+		r.body = append(body, r.body[i:]...)
+	} else {
+		r.body = append(r.body, reloadScript...)
+	}
+	return r
+}
+
+// runWatcher watches baseDir and notifies lr of its changes until quit is closed.
+// Changes are received from the OS if it can, otherwise baseDir is scanned every pollInterval.
+func runWatcher(baseDir string, lr *liveReload, quit chan struct{}) {
+	defer lr.closeAll()
+
+	changes := make(chan string, 64)
+	go func() {
+		if err := watchNative(baseDir, changes, quit); err != nil {
+			log.Printf("error: runWatcher(): %s, scanning %s every %s", err.Error(), baseDir, pollInterval)
+			pollChanges(baseDir, pollInterval, changes, quit)
+		}
+	}()
+
+	// The browsers are notified once the changes stop for reloadDelay.
+	var pending string
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-quit:
+			timer.Stop()
+			return
+		case file := <-changes:
+			if pending == "" {
+				pending = file
+			}
+			timer.Reset(reloadDelay)
+		case <-timer.C:
+			log.Printf("%s changed, reloading the browsers", pending)
+			lr.notify(pending)
+			pending = ""
+		}
+	}
+}
+
+// fileState is what pollChanges compares to find the files that changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshotDir returns the state of every file under dir, hidden files are skipped.
+func snapshotDir(dir string) map[string]fileState {
+	files := make(map[string]fileState)
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[p] = fileState{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return files
+}
+
+// pollChanges scans dir every interval and sends on changes the path,
+// relative to dir, of the files created, modified or removed.
+func pollChanges(dir string, interval time.Duration, changes chan<- string, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous := snapshotDir(dir)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		current := snapshotDir(dir)
+		for p, state := range current {
+			if old, ok := previous[p]; !ok || old != state {
+				sendChange(dir, p, changes, quit)
+			}
+		}
+		for p := range previous {
+			if _, ok := current[p]; !ok {
+				sendChange(dir, p, changes, quit)
+			}
+		}
+		previous = current
+	}
+}
+
+// sendChange sends the path of file relative to dir on changes.
+func sendChange(dir string, file string, changes chan<- string, quit chan struct{}) {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		rel = file
+	}
+	select {
+	case changes <- "/" + filepath.ToSlash(rel):
+	case <-quit:
+	}
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package buggy_http
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+
+// watchNative sends on changes the path, relative to dir, of the files changed under dir
+// until quit is closed. Changes are received with inotify, every directory has its own watch.
+// It returns an error if inotify cannot be used.
+func watchNative(dir string, changes chan<- string, quit chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("watchNative(): inotify_init1: %w", err)
+	}
+	// A non blocking descriptor is handled by the runtime poller,
+	// closing the file wakes up the pending Read.
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	w := &inotifyWatcher{fd: fd, dirs: make(map[int32]string)}
+	if err := w.addTree(dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	go func() {
+		<-quit
+		file.Close()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			return nil
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				sendChange(dir, dir, changes, quit)
+				continue
+			}
+
+			parent, ok := w.dirs[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, event.Wd)
+				continue
+			}
+
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			p := filepath.Join(parent, name)
+
+			// New directories are watched too, with the files that were created before the watch.
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addTree(p)
+			}
+			sendChange(dir, p, changes, quit)
+		}
+	}
+}
+
+// inotifyWatcher maps the watch descriptors to the directories they watch.
+type inotifyWatcher struct {
+	fd   int
+	dirs map[int32]string
+}
+
+// addTree adds a watch for root and every directory under it, hidden directories are skipped.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			// The limit of watches per user has been reached.
+			return fmt.Errorf("watchNative(): inotify_add_watch %s: %w", p, err)
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
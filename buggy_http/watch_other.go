@@ -0,0 +1,11 @@
+//go:build !linux
+
+package buggy_http
+
+import "errors"
+
+// watchNative is only implemented with inotify on Linux,
+// on the other systems the base directory is scanned.
+func watchNative(dir string, changes chan<- string, quit chan struct{}) error {
+	return errors.New("watchNative(): change notifications are not supported on this system")
+}
@@ -0,0 +1,170 @@
+package buggy_http
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInjectReloadScript(t *testing.T) {
+	page := func(body string) *response {
+		return &response{
+			code: 200,
+			headers: map[string][]string{
+				"content-type":   {"text/html; charset=utf-8"},
+				"content-length": {strconv.Itoa(len(body))},
+			},
+			body: []byte(body),
+		}
+	}
+
+	t.Run("Script is added before </body>", func(t *testing.T) {
+		r := injectReloadScript(page("<html><BODY>hi</BODY></html>"), "GET")
+		assert.Equal(t, "<html><BODY>hi"+reloadScript+"</BODY></html>", string(r.body))
+		assert.Equal(t, []string{strconv.Itoa(len(r.body))}, r.headers["content-length"])
+	})
+
+	t.Run("Script is appended without </body>", func(t *testing.T) {
+		r := injectReloadScript(page("<p>hi</p>"), "GET")
+		assert.Equal(t, "<p>hi</p>"+reloadScript, string(r.body))
+	})
+
+	t.Run("HEAD only updates content-length", func(t *testing.T) {
+		r := page("<p>hi</p>")
+		r.body = make([]byte, 0)
+		injectReloadScript(r, "HEAD")
+		assert.Empty(t, r.body)
+		assert.Equal(t, []string{strconv.Itoa(len("<p>hi</p>") + len(reloadScript))}, r.headers["content-length"])
+	})
+
+	t.Run("Other types are not changed", func(t *testing.T) {
+		r := page("body { color: red }")
+		r.headers["content-type"] = []string{"text/plain; charset=utf-8"}
+		injectReloadScript(r, "GET")
+		assert.Equal(t, "body { color: red }", string(r.body))
+	})
+
+	t.Run("Responses without content-length are not changed", func(t *testing.T) {
+		r := page("<p>hi</p>")
+		delete(r.headers, "content-length")
+		injectReloadScript(r, "GET")
+		assert.Equal(t, "<p>hi</p>", string(r.body))
+		assert.NotContains(t, r.headers, "content-length")
+	})
+}
+
+// expectChange waits for path on changes.
+func expectChange(t *testing.T, changes chan string, path string) {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case p := <-changes:
+			if p == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change received for %s", path)
+		}
+	}
+}
+
+func TestPollChanges(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("old"), 0644)
+
+	quit := make(chan struct{})
+	defer close(quit)
+	changes := make(chan string, 16)
+	go pollChanges(dir, 20*time.Millisecond, changes, quit)
+	time.Sleep(50 * time.Millisecond)
+
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("new content"), 0644)
+	expectChange(t, changes, "/index.html")
+
+	os.Remove(filepath.Join(dir, "index.html"))
+	expectChange(t, changes, "/index.html")
+}
+
+func TestWatchNative(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify is only available on Linux")
+	}
+
+	dir := t.TempDir()
+	quit := make(chan struct{})
+	defer close(quit)
+	changes := make(chan string, 16)
+	errs := make(chan error, 1)
+	go func() { errs <- watchNative(dir, changes, quit) }()
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case err := <-errs:
+		t.Skipf("inotify is not available: %s", err)
+	default:
+	}
+
+	os.WriteFile(filepath.Join(dir, "style.css"), []byte("p {}"), 0644)
+	expectChange(t, changes, "/style.css")
+
+	// Directories created after the start are watched too.
+	os.Mkdir(filepath.Join(dir, "blog"), 0755)
+	expectChange(t, changes, "/blog")
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir, "blog", "post.html"), []byte("post"), 0644)
+	expectChange(t, changes, "/blog/post.html")
+
+	// Hidden files are ignored.
+	os.WriteFile(filepath.Join(dir, ".swp"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("x"), 0644)
+	for p := <-changes; p != "/index.html"; p = <-changes {
+		assert.NotEqual(t, "/.swp", p)
+	}
+}
+
+func TestLiveReload(t *testing.T) {
+	bs := newTestInstance(t)
+	assert.NoError(t, bs.SetWatch(true))
+	addr := startTestServer(t, bs)
+
+	out := rawRequest(t, addr, "GET /index.html HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, out, "<html>index</html>"+reloadScript)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET " + liveReloadPath + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	r, err := responseHeadParser(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 200, r.code)
+
+	// Give the watcher and the stream time to start.
+	time.Sleep(200 * time.Millisecond)
+	os.WriteFile(filepath.Join(bs.config.baseDir, "index.html"), []byte("<html>changed</html>"), 0644)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "event: reload\n" {
+			break
+		}
+	}
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "data: /index.html\n", line)
+}
@@ -0,0 +1,536 @@
+package buggy_http
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WebDAV class 1 support, see https://www.rfc-editor.org/rfc/rfc4918
+// Only live properties are supported, dead properties cannot be stored.
+
+const davNamespace = "DAV:"
+
+// The live properties returned by allprop and propname.
+var davLiveProps = []string{"displayname", "getcontentlength", "getcontenttype", "getlastmodified", "resourcetype"}
+
+// davPropNames collects the names of the children of a DAV:prop element.
+type davPropNames []xml.Name
+
+func (pn *davPropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			*pn = append(*pn, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// davPropfind is the body of a PROPFIND request.
+type davPropfind struct {
+	XMLName  xml.Name     `xml:"DAV: propfind"`
+	Allprop  *struct{}    `xml:"DAV: allprop"`
+	Propname *struct{}    `xml:"DAV: propname"`
+	Prop     davPropNames `xml:"DAV: prop"`
+}
+
+// davPropertyupdate is the body of a PROPPATCH request.
+type davPropertyupdate struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop davPropNames `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop davPropNames `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+// davResponse is a response element of a multistatus body.
+type davResponse struct {
+	href     string
+	propstat []davPropstat
+}
+
+// davPropstat groups properties that have the same status.
+type davPropstat struct {
+	// Serialized property elements.
+	props  []string
+	status string
+}
+
+// isDAVMethod reports whether method is handled by the WebDAV methods.
+func isDAVMethod(method string) bool {
+	switch method {
+	case "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE":
+		return true
+	}
+	return false
+}
+
+// replyToDAV dispatches the WebDAV methods.
+// PROPFIND and PROPPATCH are always enabled with WebDAV,
+// MKCOL, COPY and MOVE also require uploads.
+func replyToDAV(request *request, config *buggyConfig) (*response, error) {
+	switch request.method {
+	case "PROPFIND":
+		return replyToPROPFIND(request, config)
+
+	case "PROPPATCH":
+		return replyToPROPPATCH(request, config)
+	}
+
+	if !config.uploads {
+		return r405(allowedMethods(config)), fmt.Errorf("replyToDAV() -> %s, %s: uploads are disabled. 405 sent", request.method, request.path)
+	}
+
+	switch request.method {
+	case "MKCOL":
+		return replyToMKCOL(request, config)
+
+	case "COPY", "MOVE":
+		return replyToCOPYMOVE(request, config)
+	}
+
+	return r405(allowedMethods(config)), fmt.Errorf("replyToDAV() -> %s, %s: HTTP method not allowed. 405 sent", request.method, request.path)
+}
+
+// davResource returns the cleaned URL path and the filesystem path of the resource of a request.
+func davResource(rawPath string, config *buggyConfig) (string, string, error) {
+	urlPath, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return "", "", err
+	}
+	urlPath = path.Clean("/" + urlPath)
+
+	filePath, err := resolvePath(config.baseDir, urlPath)
+	if err != nil {
+		return "", "", err
+	}
+	return urlPath, filePath, nil
+}
+
+func replyToPROPFIND(request *request, config *buggyConfig) (*response, error) {
+
+	urlPath, filePath, err := davResource(request.path, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPROPFIND() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPROPFIND() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	depth := "infinity"
+	if values, ok := request.headers["depth"]; ok {
+		depth = strings.ToLower(values[0])
+	}
+	if depth != "0" && depth != "1" {
+		// Servers may refuse infinite depth, see https://www.rfc-editor.org/rfc/rfc4918#section-9.1
+		r := r403()
+		r.body = []byte(xml.Header + `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		r.headers["content-type"] = []string{"application/xml; charset=utf-8"}
+		r.headers["content-length"] = []string{fmt.Sprintf("%v", len(r.body))}
+		return r, fmt.Errorf("replyToPROPFIND() -> %s, %s : depth %q not supported. 403 sent", request.method, request.path, depth)
+	}
+
+	// An empty body is an allprop request.
+	propfind := davPropfind{Allprop: &struct{}{}}
+	if len(bytes.TrimSpace(request.body)) > 0 {
+		propfind = davPropfind{}
+		if err := xml.Unmarshal(request.body, &propfind); err != nil {
+			return r400(), fmt.Errorf("replyToPROPFIND() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+		}
+	}
+
+	responses := []davResponse{davPropfindResponse(urlPath, fileInfo, &propfind)}
+
+	if depth == "1" && fileInfo.IsDir() {
+		entries, err := os.ReadDir(filePath)
+		if err != nil {
+			return r500(), fmt.Errorf("replyToPROPFIND() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+		}
+		for _, entry := range entries {
+			info, err := os.Stat(filepath.Join(filePath, entry.Name()))
+			if err != nil {
+				// Broken symbolic links are not listed.
+				continue
+			}
+			responses = append(responses, davPropfindResponse(path.Join(urlPath, entry.Name()), info, &propfind))
+		}
+	}
+
+	return r207(responses), nil
+}
+
+// davPropfindResponse returns the properties of a resource requested by propfind.
+func davPropfindResponse(urlPath string, info fs.FileInfo, propfind *davPropfind) davResponse {
+	href := (&url.URL{Path: urlPath}).EscapedPath()
+	if info.IsDir() && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+
+	found := davPropstat{status: "HTTP/1.1 200 OK"}
+	notFound := davPropstat{status: "HTTP/1.1 404 Not Found"}
+
+	switch {
+	case propfind.Propname != nil:
+		for _, name := range davLiveProps {
+			if _, ok := davLiveProp(name, urlPath, info); ok {
+				found.props = append(found.props, "<D:"+name+"/>")
+			}
+		}
+
+	case propfind.Allprop != nil:
+		for _, name := range davLiveProps {
+			if value, ok := davLiveProp(name, urlPath, info); ok {
+				found.props = append(found.props, value)
+			}
+		}
+
+	default:
+		for _, name := range propfind.Prop {
+			if name.Space == davNamespace {
+				if value, ok := davLiveProp(name.Local, urlPath, info); ok {
+					found.props = append(found.props, value)
+					continue
+				}
+			}
+			notFound.props = append(notFound.props, davEmptyProp(name))
+		}
+	}
+
+	r := davResponse{href: href}
+	if len(found.props) > 0 {
+		r.propstat = append(r.propstat, found)
+	}
+	if len(notFound.props) > 0 {
+		r.propstat = append(r.propstat, notFound)
+	}
+	return r
+}
+
+// davLiveProp returns the serialized value of a live property of a resource,
+// and false if the resource does not have it.
+func davLiveProp(name string, urlPath string, info fs.FileInfo) (string, bool) {
+	switch name {
+	case "displayname":
+		return "<D:displayname>" + xmlEscape(path.Base(urlPath)) + "</D:displayname>", true
+
+	case "getcontentlength":
+		if info.IsDir() {
+			return "", false
+		}
+		return fmt.Sprintf("<D:getcontentlength>%d</D:getcontentlength>", info.Size()), true
+
+	case "getcontenttype":
+		if info.IsDir() {
+			return "", false
+		}
+		contentType := mime.TypeByExtension(path.Ext(urlPath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		return "<D:getcontenttype>" + xmlEscape(contentType) + "</D:getcontenttype>", true
+
+	case "getlastmodified":
+		return "<D:getlastmodified>" + info.ModTime().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT") + "</D:getlastmodified>", true
+
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:resourcetype><D:collection/></D:resourcetype>", true
+		}
+		return "<D:resourcetype/>", true
+	}
+
+	return "", false
+}
+
+// davEmptyProp serializes an empty property element with its namespace.
+func davEmptyProp(name xml.Name) string {
+	if name.Space == davNamespace {
+		return "<D:" + name.Local + "/>"
+	}
+	if name.Space == "" {
+		return "<" + name.Local + " xmlns=\"\"/>"
+	}
+	return "<" + name.Local + " xmlns=\"" + xmlEscape(name.Space) + "\"/>"
+}
+
+// replyToPROPPATCH refuses every change, because dead properties cannot be stored
+// and live properties are protected.
+// See https://www.rfc-editor.org/rfc/rfc4918#section-9.2
+func replyToPROPPATCH(request *request, config *buggyConfig) (*response, error) {
+
+	urlPath, filePath, err := davResource(request.path, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPROPPATCH() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToPROPPATCH() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+
+	var update davPropertyupdate
+	if err := xml.Unmarshal(request.body, &update); err != nil {
+		return r400(), fmt.Errorf("replyToPROPPATCH() -> %s, %s : %w. 400 sent", request.method, request.path, err)
+	}
+
+	forbidden := davPropstat{status: "HTTP/1.1 403 Forbidden"}
+	for _, set := range update.Set {
+		for _, name := range set.Prop {
+			forbidden.props = append(forbidden.props, davEmptyProp(name))
+		}
+	}
+	for _, remove := range update.Remove {
+		for _, name := range remove.Prop {
+			forbidden.props = append(forbidden.props, davEmptyProp(name))
+		}
+	}
+
+	href := (&url.URL{Path: urlPath}).EscapedPath()
+	if fileInfo.IsDir() && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+
+	r := davResponse{href: href}
+	if len(forbidden.props) > 0 {
+		r.propstat = append(r.propstat, forbidden)
+	}
+
+	return r207([]davResponse{r}), nil
+}
+
+// replyToMKCOL creates a directory.
+// See https://www.rfc-editor.org/rfc/rfc4918#section-9.3
+func replyToMKCOL(request *request, config *buggyConfig) (*response, error) {
+
+	if len(request.body) > 0 {
+		return r415(), fmt.Errorf("replyToMKCOL() -> %s, %s : request body not supported. 415 sent", request.method, request.path)
+	}
+
+	_, filePath, err := davResource(request.path, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyToMKCOL() -> %s, %s : %w. 404 sent", request.method, request.path, err)
+	}
+	if err := checkRealDir(config.baseDir, filepath.Dir(filePath)); err != nil {
+		return r403(), fmt.Errorf("replyToMKCOL() -> %s, %s : %w. 403 sent", request.method, request.path, err)
+	}
+
+	if _, err := os.Lstat(filePath); err == nil {
+		return r405(allowedMethods(config)), fmt.Errorf("replyToMKCOL() -> %s, %s : resource already exists. 405 sent", request.method, request.path)
+	}
+
+	if err := os.Mkdir(filePath, 0755); err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return r409(), fmt.Errorf("replyToMKCOL() -> %s, %s : %w. 409 sent", request.method, request.path, err)
+		}
+		return r500(), fmt.Errorf("replyToMKCOL() -> %s, %s : %w. 500 sent", request.method, request.path, err)
+	}
+
+	return r201(), nil
+}
+
+// replyToCOPYMOVE copies or moves a resource to the destination header.
+// MOVE removes the source, so the source must be under a delete prefix,
+// and so must an existing destination that is overwritten.
+// See https://www.rfc-editor.org/rfc/rfc4918#section-9.8 and https://www.rfc-editor.org/rfc/rfc4918#section-9.9
+func replyToCOPYMOVE(request *request, config *buggyConfig) (*response, error) {
+
+	srcURLPath, srcPath, err := davResource(request.path, config)
+	if err != nil {
+		return r404(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 404 sent", request.method, request.method, request.path, err)
+	}
+
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return r404(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 404 sent", request.method, request.method, request.path, err)
+	}
+
+	// Symbolic links are not followed, they could point outside the base directory.
+	if request.method == "COPY" && !srcInfo.IsDir() && !srcInfo.Mode().IsRegular() {
+		return r403(), fmt.Errorf("replyToCOPY() -> %s, %s : not a regular file or directory. 403 sent", request.method, request.path)
+	}
+
+	// The request is validated completely before an existing destination is removed.
+	depth := "infinity"
+	if values, ok := request.headers["depth"]; ok && request.method == "COPY" {
+		depth = strings.ToLower(values[0])
+	}
+	if depth != "0" && depth != "infinity" {
+		return r400(), fmt.Errorf("replyToCOPY() -> %s, %s : invalid depth %q. 400 sent", request.method, request.path, depth)
+	}
+
+	values, ok := request.headers["destination"]
+	if !ok {
+		return r400(), fmt.Errorf("replyTo%s() -> %s, %s : missing destination header. 400 sent", request.method, request.method, request.path)
+	}
+
+	// The header parser splits values on commas, that are valid in URLs.
+	destination, err := url.Parse(strings.Join(values, ","))
+	if err != nil {
+		return r400(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 400 sent", request.method, request.method, request.path, err)
+	}
+
+	dstURLPath, dstPath, err := davResource(destination.EscapedPath(), config)
+	if err != nil {
+		return r403(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 403 sent", request.method, request.method, request.path, err)
+	}
+
+	if dstURLPath == srcURLPath || hasPathPrefix(dstURLPath, srcURLPath) || dstURLPath == "/" {
+		return r403(), fmt.Errorf("replyTo%s() -> %s, %s : invalid destination %s. 403 sent", request.method, request.method, request.path, dstURLPath)
+	}
+
+	if request.method == "MOVE" && !deleteAllowed(srcURLPath, config) {
+		return r403(), fmt.Errorf("replyToMOVE() -> %s, %s : path is not under a delete prefix. 403 sent", request.method, request.path)
+	}
+
+	if err := checkRealDir(config.baseDir, filepath.Dir(dstPath)); err != nil {
+		return r403(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 403 sent", request.method, request.method, request.path, err)
+	}
+	if request.method == "MOVE" {
+		if err := checkRealDir(config.baseDir, filepath.Dir(srcPath)); err != nil {
+			return r403(), fmt.Errorf("replyToMOVE() -> %s, %s : %w. 403 sent", request.method, request.path, err)
+		}
+	}
+
+	overwrite := !headerFinder(request.headers, "overwrite", "F")
+
+	exists := false
+	if _, err := os.Lstat(dstPath); err == nil {
+		exists = true
+		if !overwrite {
+			return r412(), fmt.Errorf("replyTo%s() -> %s, %s : destination exists. 412 sent", request.method, request.method, request.path)
+		}
+		if !deleteAllowed(dstURLPath, config) {
+			return r403(), fmt.Errorf("replyTo%s() -> %s, %s : destination is not under a delete prefix. 403 sent", request.method, request.method, request.path)
+		}
+	}
+
+	if parentInfo, err := os.Stat(filepath.Dir(dstPath)); err != nil || !parentInfo.IsDir() {
+		return r409(), fmt.Errorf("replyTo%s() -> %s, %s : destination parent does not exist. 409 sent", request.method, request.method, request.path)
+	}
+
+	if exists {
+		if err := os.RemoveAll(dstPath); err != nil {
+			return r500(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 500 sent", request.method, request.method, request.path, err)
+		}
+	}
+
+	if request.method == "MOVE" {
+		err = os.Rename(srcPath, dstPath)
+	} else {
+		err = copyResource(srcPath, dstPath, srcInfo, depth == "infinity")
+	}
+	if err != nil {
+		return r500(), fmt.Errorf("replyTo%s() -> %s, %s : %w. 500 sent", request.method, request.method, request.path, err)
+	}
+
+	if exists {
+		return r204(), nil
+	}
+
+	r := r201()
+	r.headers["location"] = []string{(&url.URL{Path: dstURLPath}).EscapedPath()}
+	return r, nil
+}
+
+// copyResource copies a file, or a directory with its content if recursive is true.
+// Symbolic links and special files in the directory are skipped, a link to an ancestor
+// would never end and a link outside the base directory would copy its target in.
+func copyResource(src, dst string, info fs.FileInfo, recursive bool) error {
+	if !info.IsDir() {
+		f, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("copyResource(): %w", err)
+		}
+		defer f.Close()
+		return writeFileAtomic(dst, f)
+	}
+
+	if err := os.Mkdir(dst, 0755); err != nil {
+		return fmt.Errorf("copyResource(): %w", err)
+	}
+	if !recursive {
+		return nil
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("copyResource(): %w", err)
+	}
+	for _, entry := range entries {
+		entryInfo, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("copyResource(): %w", err)
+		}
+		if !entryInfo.IsDir() && !entryInfo.Mode().IsRegular() {
+			continue
+		}
+		if err := copyResource(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), entryInfo, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// r207 builds a 207 Multi-Status response with an XML multistatus body.
+func r207(responses []davResponse) *response {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">` + "\n")
+	for _, r := range responses {
+		b.WriteString("<D:response>\n<D:href>" + xmlEscape(r.href) + "</D:href>\n")
+		for _, ps := range r.propstat {
+			sort.Strings(ps.props)
+			b.WriteString("<D:propstat>\n<D:prop>" + strings.Join(ps.props, "") + "</D:prop>\n")
+			b.WriteString("<D:status>" + ps.status + "</D:status>\n</D:propstat>\n")
+		}
+		b.WriteString("</D:response>\n")
+	}
+	b.WriteString("</D:multistatus>\n")
+
+	body := []byte(b.String())
+	t := time.Now().UTC()
+
+	headers := map[string][]string{
+		"date":           {t.Format("Mon, 02 Jan 2006 15:04:05 GMT")},
+		"server":         {"BuggyServer"},
+		"content-type":   {"application/xml; charset=utf-8"},
+		"content-length": {fmt.Sprintf("%v", len(body))},
+	}
+	return &response{
+		proto:        "HTTP/1.1",
+		code:         207,
+		reasonPhrase: "Multi-Status",
+		headers:      headers,
+		body:         body,
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
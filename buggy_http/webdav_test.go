@@ -0,0 +1,191 @@
+package buggy_http
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDAVTestServer(t *testing.T) (string, string) {
+	bs := newTestInstance(t)
+	bs.config.webdav = true
+	bs.config.uploads = true
+	bs.config.deletePrefixes = []string{"/"}
+
+	baseDir := bs.config.baseDir
+	if err := os.Mkdir(filepath.Join(baseDir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(baseDir, "docs", "a b.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return startTestServer(t, bs), baseDir
+}
+
+func davRequest(method, path string, headers map[string]string, body string) string {
+	raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n", method, path)
+	for name, value := range headers {
+		raw += name + ": " + value + "\r\n"
+	}
+	raw += fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	return raw
+}
+
+func TestWebDAVOptions(t *testing.T) {
+	addr, _ := newDAVTestServer(t)
+
+	out := rawRequest(t, addr, davRequest("OPTIONS", "/docs", nil, ""))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, out, "dav: 1\r\n")
+	assert.Contains(t, out, "PROPFIND, PROPPATCH, MKCOL, COPY, MOVE")
+}
+
+func TestWebDAVPropfind(t *testing.T) {
+	addr, _ := newDAVTestServer(t)
+
+	t.Run("Depth 1 allprop", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("PROPFIND", "/docs", map[string]string{"Depth": "1"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 207 Multi-Status\r\n"))
+		assert.Contains(t, out, "<D:href>/docs/</D:href>")
+		assert.Contains(t, out, "<D:href>/docs/a%20b.txt</D:href>")
+		assert.Contains(t, out, "<D:resourcetype><D:collection/></D:resourcetype>")
+		assert.Contains(t, out, "<D:getcontentlength>5</D:getcontentlength>")
+		assert.Contains(t, out, "<D:getcontenttype>text/plain; charset=utf-8</D:getcontenttype>")
+	})
+
+	t.Run("Depth 0 named properties", func(t *testing.T) {
+		body := `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><getcontentlength/><foo xmlns="urn:x"/></prop></propfind>`
+		out := rawRequest(t, addr, davRequest("PROPFIND", "/docs/a%20b.txt", map[string]string{"Depth": "0"}, body))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 207 Multi-Status\r\n"))
+		assert.Contains(t, out, "<D:prop><D:getcontentlength>5</D:getcontentlength></D:prop>")
+		assert.Contains(t, out, `<D:prop><foo xmlns="urn:x"/></D:prop>`+"\n<D:status>HTTP/1.1 404 Not Found</D:status>")
+		assert.NotContains(t, out, "<D:getlastmodified>")
+	})
+
+	t.Run("Infinite depth is refused", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("PROPFIND", "/", nil, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+		assert.Contains(t, out, "propfind-finite-depth")
+	})
+
+	t.Run("Missing resource", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("PROPFIND", "/missing", map[string]string{"Depth": "0"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	})
+}
+
+func TestWebDAVProppatch(t *testing.T) {
+	addr, _ := newDAVTestServer(t)
+
+	body := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><x:color xmlns:x="urn:x">red</x:color></D:prop></D:set></D:propertyupdate>`
+	out := rawRequest(t, addr, davRequest("PROPPATCH", "/docs", nil, body))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 207 Multi-Status\r\n"))
+	assert.Contains(t, out, `<color xmlns="urn:x"/>`)
+	assert.Contains(t, out, "HTTP/1.1 403 Forbidden</D:status>")
+}
+
+func TestWebDAVMkcol(t *testing.T) {
+	addr, baseDir := newDAVTestServer(t)
+
+	out := rawRequest(t, addr, davRequest("MKCOL", "/new", nil, ""))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+	info, err := os.Stat(filepath.Join(baseDir, "new"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	out = rawRequest(t, addr, davRequest("MKCOL", "/new", nil, ""))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+
+	out = rawRequest(t, addr, davRequest("MKCOL", "/missing/new", nil, ""))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 409 Conflict\r\n"))
+}
+
+func TestWebDAVCopyMove(t *testing.T) {
+	addr, baseDir := newDAVTestServer(t)
+
+	t.Run("Copy a directory", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs", map[string]string{"Destination": "http://" + addr + "/copy"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+		content, err := os.ReadFile(filepath.Join(baseDir, "copy", "a b.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+	})
+
+	t.Run("Copy without overwrite", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs", map[string]string{"Destination": "/copy", "Overwrite": "F"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"))
+	})
+
+	t.Run("Invalid depth keeps the destination", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs", map[string]string{"Destination": "/copy", "Overwrite": "T", "Depth": "1"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+		content, err := os.ReadFile(filepath.Join(baseDir, "copy", "a b.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+	})
+
+	t.Run("Move a file over an existing one", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("MOVE", "/docs/a%20b.txt", map[string]string{"Destination": "/copy/a%20b.txt"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+		_, err := os.Stat(filepath.Join(baseDir, "docs", "a b.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Move into itself", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("MOVE", "/docs", map[string]string{"Destination": "/docs/sub"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+	})
+
+	t.Run("Destination cannot leave the base directory", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs", map[string]string{"Destination": "/../outside"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+		_, err := os.Stat(filepath.Join(baseDir, "outside"))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(filepath.Dir(baseDir), "outside"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestWebDAVCopySymlinks(t *testing.T) {
+	addr, baseDir := newDAVTestServer(t)
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	if err := os.Symlink(outside, filepath.Join(baseDir, "docs", "secret.txt")); err != nil {
+		t.Skip(err)
+	}
+	os.Symlink(baseDir, filepath.Join(baseDir, "docs", "root"))
+
+	t.Run("Links in a directory are skipped", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs", map[string]string{"Destination": "/copy"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 201 Created\r\n"))
+
+		content, err := os.ReadFile(filepath.Join(baseDir, "copy", "a b.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+		_, err = os.Lstat(filepath.Join(baseDir, "copy", "secret.txt"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Lstat(filepath.Join(baseDir, "copy", "root"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Links are not copied", func(t *testing.T) {
+		out := rawRequest(t, addr, davRequest("COPY", "/docs/secret.txt", map[string]string{"Destination": "/secret.txt"}, ""))
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+		_, err := os.Lstat(filepath.Join(baseDir, "secret.txt"))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestWebDAVDisabled(t *testing.T) {
+	bs := newTestInstance(t)
+	addr := startTestServer(t, bs)
+
+	out := rawRequest(t, addr, davRequest("PROPFIND", "/", map[string]string{"Depth": "0"}, ""))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.NotContains(t, out, "dav: 1")
+}
@@ -0,0 +1,466 @@
+package buggy_http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The types of WebSocket data messages.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// WebSocket opcodes.
+// See https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes.
+// See https://www.rfc-editor.org/rfc/rfc6455#section-7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// wsGUID is concatenated to Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsCloseTimeout is how long Close waits for the close frame of the client.
+const wsCloseTimeout = 5 * time.Second
+
+// wsMaxFrameBytes is the maximum size of the payload of a frame, even when messages have no maximum size.
+// Larger messages can still be sent in more frames.
+const wsMaxFrameBytes = 16 << 20
+
+// WebSocketHandler is called in its own goroutine for every WebSocket connection
+// to the path it has been set for, the connection is closed when it returns.
+type WebSocketHandler func(ws WebSocketConn)
+
+// WebSocketConn is a WebSocket connection with a client.
+// Messages can be written while another goroutine reads.
+type WebSocketConn interface {
+	// ReadMessage returns the next data message, TextMessage or BinaryMessage, sent by the client.
+	// Ping frames are answered while reading. When the client closes the connection
+	// the error is a *WebSocketCloseError.
+	ReadMessage() (messageType int, data []byte, err error)
+
+	// WriteMessage sends a TextMessage or BinaryMessage to the client.
+	WriteMessage(messageType int, data []byte) error
+
+	// Ping sends a ping frame, the client answers with a pong that ReadMessage discards.
+	Ping(data []byte) error
+
+	// Close starts the close handshake and closes the connection.
+	Close(code int, reason string) error
+
+	// Path returns the request target of the handshake.
+	Path() string
+
+	// RemoteAddr returns the network address of the client.
+	RemoteAddr() string
+}
+
+// WebSocketCloseError is returned by ReadMessage when the connection has been closed.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsConn implements WebSocketConn on a connection handed over by handleConnection.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	path   string
+
+	// The maximum size in bytes of a message, zero or negative means no limit.
+	maxMessage int
+
+	// Serializes the frames written by ReadMessage, to answer pings, and by the handler.
+	wmu       sync.Mutex
+	closeSent bool
+
+	// Serializes the reads of ReadMessage and Close.
+	rmu sync.Mutex
+
+	// Set when the connection has been closed while reading, guarded by rmu.
+	closeErr *WebSocketCloseError
+}
+
+// isWebSocketUpgrade reports whether request asks to upgrade the connection to WebSocket.
+func isWebSocketUpgrade(request *request) bool {
+	return headerFinder(request.headers, "upgrade", "websocket")
+}
+
+// wsAccept computes the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// replyToWebSocket validates the opening handshake of request and, if it is valid,
+// answers with 101 code and hands the connection over to handler.
+// See https://www.rfc-editor.org/rfc/rfc6455#section-4.2
+func replyToWebSocket(request *request, handler WebSocketHandler, config *buggyConfig) (*response, error) {
+	if !isWebSocketUpgrade(request) {
+		return r426(), fmt.Errorf("replyToWebSocket() -> %s, %s : not a WebSocket upgrade. 426 sent", request.method, request.path)
+	}
+
+	if request.method != "GET" || isHTTP10(request) {
+		return r400(), fmt.Errorf("replyToWebSocket() -> %s, %s : handshake must be a HTTP/1.1 GET request. 400 sent", request.method, request.path)
+	}
+	if _, ok := request.headers["host"]; !ok || !headerFinder(request.headers, "connection", "upgrade") {
+		return r400(), fmt.Errorf("replyToWebSocket() -> %s, %s : missing host or connection: upgrade. 400 sent", request.method, request.path)
+	}
+
+	if !headerFinder(request.headers, "sec-websocket-version", "13") {
+		r := r426()
+		r.headers["sec-websocket-version"] = []string{"13"}
+		return r, fmt.Errorf("replyToWebSocket() -> %s, %s : unsupported WebSocket version. 426 sent", request.method, request.path)
+	}
+
+	keys := request.headers["sec-websocket-key"]
+	if len(keys) != 1 {
+		return r400(), fmt.Errorf("replyToWebSocket() -> %s, %s : invalid sec-websocket-key. 400 sent", request.method, request.path)
+	}
+	if nonce, err := base64.StdEncoding.DecodeString(keys[0]); err != nil || len(nonce) != 16 {
+		return r400(), fmt.Errorf("replyToWebSocket() -> %s, %s : invalid sec-websocket-key. 400 sent", request.method, request.path)
+	}
+
+	r := r101("websocket")
+	r.headers["sec-websocket-accept"] = []string{wsAccept(keys[0])}
+	r.hijack = func(conn net.Conn, reader *bufio.Reader) {
+		ws := &wsConn{conn: conn, reader: reader, path: request.path, maxMessage: config.maxMessageBytes}
+		handler(ws)
+		ws.Close(CloseNormal, "")
+	}
+	return r, nil
+}
+
+func (ws *wsConn) Path() string {
+	return ws.path
+}
+
+func (ws *wsConn) RemoteAddr() string {
+	return ws.conn.RemoteAddr().String()
+}
+
+// wsFrame is a frame received from the client, with its payload unmasked.
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readFrame reads a frame, limit is the maximum size of its payload if it is a data frame.
+// Negative limit means no maximum size other than wsMaxFrameBytes.
+func (ws *wsConn) readFrame(limit int) (wsFrame, error) {
+	if limit < 0 || limit > wsMaxFrameBytes {
+		limit = wsMaxFrameBytes
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return wsFrame{}, err
+	}
+
+	f := wsFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F}
+
+	// No extension has been negotiated.
+	if header[0]&0x70 != 0 {
+		return f, ws.fail(CloseProtocolError, "reserved bits set")
+	}
+	// Frames sent by clients are always masked.
+	if header[1]&0x80 == 0 {
+		return f, ws.fail(CloseProtocolError, "unmasked frame")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return f, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return f, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		// The most significant bit of a 64-bit length must be 0.
+		if length>>63 != 0 {
+			return f, ws.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	if f.opcode >= wsClose {
+		if !f.fin || length > 125 {
+			return f, ws.fail(CloseProtocolError, "invalid control frame")
+		}
+	} else if length > uint64(limit) {
+		return f, ws.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return f, err
+	}
+
+	// The payload is copied as it arrives, a client that does not send it does not get memory allocated.
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, ws.reader, int64(length)); err != nil {
+		return f, err
+	}
+	f.payload = payload.Bytes()
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+func (ws *wsConn) ReadMessage() (int, []byte, error) {
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+
+	if ws.closeErr != nil {
+		return 0, nil, ws.closeErr
+	}
+
+	var messageType int
+	var message []byte
+
+	for {
+		f, err := ws.readFrame(ws.frameLimit(len(message)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			return 0, nil, ws.receiveClose(f.payload)
+
+		case wsText, wsBinary:
+			if messageType != 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "new message before the end of a fragmented one")
+			}
+			messageType = int(f.opcode)
+
+		case wsContinuation:
+			if messageType == 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "continuation frame without a message")
+			}
+
+		default:
+			return 0, nil, ws.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, ws.fail(CloseInvalidPayload, "invalid UTF-8 text")
+		}
+		if message == nil {
+			message = make([]byte, 0)
+		}
+		return messageType, message, nil
+	}
+}
+
+// receiveClose handles the close frame of the client, it is echoed if
+// the server has not sent its own yet, then the connection is closed.
+func (ws *wsConn) receiveClose(payload []byte) error {
+	closeErr := &WebSocketCloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		ws.fail(CloseProtocolError, "invalid close payload")
+		return closeErr
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload[:2]))
+		closeErr.Reason = string(payload[2:])
+		if !isValidCloseCode(closeErr.Code) {
+			ws.fail(CloseProtocolError, "invalid close code")
+			return closeErr
+		}
+		if !utf8.Valid(payload[2:]) {
+			ws.fail(CloseInvalidPayload, "invalid UTF-8 reason")
+			return closeErr
+		}
+	}
+	ws.closeErr = closeErr
+
+	ws.wmu.Lock()
+	if !ws.closeSent {
+		ws.closeSent = true
+		writeWSFrame(ws.conn, wsClose, payload[:min(len(payload), 2)])
+	}
+	ws.wmu.Unlock()
+
+	ws.conn.Close()
+	return closeErr
+}
+
+// isValidCloseCode reports whether code can be sent in a close frame.
+// See https://www.rfc-editor.org/rfc/rfc6455#section-7.4
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the connection with code because the client broke the protocol.
+func (ws *wsConn) fail(code int, reason string) error {
+	ws.sendClose(code, reason)
+	ws.conn.Close()
+	ws.closeErr = &WebSocketCloseError{Code: code, Reason: reason}
+	return fmt.Errorf("websocket: %s: %w", reason, ws.closeErr)
+}
+
+func (ws *wsConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("WriteMessage(): invalid message type %d", messageType)
+	}
+	return ws.writeFrame(byte(messageType), data)
+}
+
+func (ws *wsConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return fmt.Errorf("Ping(): payload longer than 125 bytes")
+	}
+	return ws.writeFrame(wsPing, data)
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closeSent {
+		return errors.New("websocket: close already sent")
+	}
+	return writeWSFrame(ws.conn, opcode, payload)
+}
+
+// sendClose sends a close frame, if one has not been sent yet.
+func (ws *wsConn) sendClose(code int, reason string) (bool, error) {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if ws.closeSent {
+		return false, nil
+	}
+	ws.closeSent = true
+
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return true, writeWSFrame(ws.conn, wsClose, payload)
+}
+
+func (ws *wsConn) Close(code int, reason string) error {
+	sent, err := ws.sendClose(code, reason)
+	if !sent || err != nil {
+		ws.conn.Close()
+		return err
+	}
+
+	// Wait for the close frame of the client, the messages it sends in the meantime are discarded.
+	// The deadline also wakes up a ReadMessage running in another goroutine.
+	ws.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+
+	ws.rmu.Lock()
+	defer ws.rmu.Unlock()
+
+	for ws.closeErr == nil {
+		f, err := ws.readFrame(ws.frameLimit(0))
+		if err != nil || f.opcode == wsClose {
+			break
+		}
+	}
+	if err := ws.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// frameLimit returns the maximum payload size of the next data frame
+// of a message of which read bytes have been received.
+func (ws *wsConn) frameLimit(read int) int {
+	if ws.maxMessage <= 0 {
+		return -1
+	}
+	return ws.maxMessage - read
+}
+
+// writeWSFrame writes an unmasked frame, that is the only kind a server can send.
+func writeWSFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+
+	switch {
+	case len(payload) <= 125:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// findWebSocketHandler returns the handler set for the path of request, or nil.
+func findWebSocketHandler(request *request, config *buggyConfig) WebSocketHandler {
+	p, _, _ := strings.Cut(request.path, "?")
+	return config.websockets[p]
+}
@@ -0,0 +1,337 @@
+package buggy_http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const wsTestKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// dialWebSocket connects to the server at addr and completes the handshake for path.
+func dialWebSocket(t *testing.T, addr string, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + wsTestKey + "\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	r, err := responseHeadParser(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.code != 101 {
+		t.Fatalf("dialWebSocket(): handshake answered with %d", r.code)
+	}
+	return conn, reader
+}
+
+// writeClientFrame writes a frame masked like the frames sent by clients.
+func writeClientFrame(t *testing.T, conn net.Conn, fin bool, opcode byte, payload []byte) {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		header[1] |= byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] |= 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] |= 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+
+	frame := append(append(header, mask...), masked...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an unmasked frame sent by the server.
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, byte(0x80), header[0]&0x80, "server frames are never fragmented")
+	assert.Equal(t, byte(0), header[1]&0x80, "server frames are not masked")
+
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(reader, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func startEchoServer(t *testing.T, maxMessageKiB int) string {
+	bs := newTestInstance(t)
+	bs.SetMaxMessageKiB(maxMessageKiB)
+	bs.SetWebSocket("/echo", func(ws WebSocketConn) {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	})
+	return startTestServer(t, bs)
+}
+
+func TestWsAccept(t *testing.T) {
+	// The example of RFC 6455, section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wsAccept(wsTestKey))
+}
+
+func TestReplyToWebSocket(t *testing.T) {
+	config := &buggyConfig{websockets: map[string]WebSocketHandler{"/ws": func(ws WebSocketConn) {}}}
+
+	handshake := func() *request {
+		return &request{
+			method: "GET",
+			path:   "/ws?token=1",
+			proto:  "HTTP/1.1",
+			headers: map[string][]string{
+				"host":                  {"localhost"},
+				"upgrade":               {"websocket"},
+				"connection":            {"keep-alive", "Upgrade"},
+				"sec-websocket-key":     {wsTestKey},
+				"sec-websocket-version": {"13"},
+			},
+		}
+	}
+
+	t.Run("Valid handshake is 101", func(t *testing.T) {
+		r, err := reply(handshake(), config)
+		assert.NoError(t, err)
+		assert.Equal(t, 101, r.code)
+		assert.Equal(t, []string{"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="}, r.headers["sec-websocket-accept"])
+		assert.Equal(t, []string{"websocket"}, r.headers["upgrade"])
+		assert.NotNil(t, r.hijack)
+	})
+
+	t.Run("Request without upgrade is 426", func(t *testing.T) {
+		req := handshake()
+		delete(req.headers, "upgrade")
+		r, err := reply(req, config)
+		assert.Error(t, err)
+		assert.Equal(t, 426, r.code)
+	})
+
+	t.Run("Unsupported version is 426", func(t *testing.T) {
+		req := handshake()
+		req.headers["sec-websocket-version"] = []string{"8"}
+		r, err := reply(req, config)
+		assert.Error(t, err)
+		assert.Equal(t, 426, r.code)
+		assert.Equal(t, []string{"13"}, r.headers["sec-websocket-version"])
+	})
+
+	t.Run("Invalid handshakes are 400", func(t *testing.T) {
+		for name, change := range map[string]func(req *request){
+			"POST":          func(req *request) { req.method = "POST" },
+			"HTTP/1.0":      func(req *request) { req.proto = "HTTP/1.0" },
+			"no host":       func(req *request) { delete(req.headers, "host") },
+			"no connection": func(req *request) { req.headers["connection"] = []string{"keep-alive"} },
+			"short key":     func(req *request) { req.headers["sec-websocket-key"] = []string{"c2hvcnQ="} },
+			"no key":        func(req *request) { delete(req.headers, "sec-websocket-key") },
+		} {
+			req := handshake()
+			change(req)
+			r, err := reply(req, config)
+			assert.Error(t, err, name)
+			assert.Equal(t, 400, r.code, name)
+		}
+	})
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	addr := startEchoServer(t, 1024)
+
+	t.Run("Messages are echoed", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+
+		writeClientFrame(t, conn, true, wsText, []byte("hello"))
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsText), opcode)
+		assert.Equal(t, "hello", string(payload))
+
+		big := []byte(strings.Repeat("x", 70000))
+		writeClientFrame(t, conn, true, wsBinary, big)
+		opcode, payload = readServerFrame(t, reader)
+		assert.Equal(t, byte(wsBinary), opcode)
+		assert.Equal(t, big, payload)
+	})
+
+	t.Run("Fragments are reassembled and pings answered in between", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+
+		writeClientFrame(t, conn, false, wsText, []byte("hel"))
+		writeClientFrame(t, conn, true, wsPing, []byte("are you there?"))
+		writeClientFrame(t, conn, true, wsContinuation, []byte("lo"))
+
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsPong), opcode)
+		assert.Equal(t, "are you there?", string(payload))
+
+		opcode, payload = readServerFrame(t, reader)
+		assert.Equal(t, byte(wsText), opcode)
+		assert.Equal(t, "hello", string(payload))
+	})
+
+	t.Run("Close frame is echoed", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+
+		writeClientFrame(t, conn, true, wsClose, closePayload(CloseGoingAway, "bye"))
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsClose), opcode)
+		assert.Equal(t, closePayload(CloseGoingAway, ""), payload)
+
+		_, err := reader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	addr := startEchoServer(t, 1)
+
+	expectClose := func(t *testing.T, reader *bufio.Reader, code int) {
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsClose), opcode)
+		if assert.GreaterOrEqual(t, len(payload), 2) {
+			assert.Equal(t, code, int(binary.BigEndian.Uint16(payload)))
+		}
+	}
+
+	t.Run("Message too big is 1009", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		writeClientFrame(t, conn, false, wsBinary, make([]byte, 1000))
+		writeClientFrame(t, conn, true, wsContinuation, make([]byte, 1000))
+		expectClose(t, reader, CloseMessageTooBig)
+	})
+
+	t.Run("Invalid UTF-8 text is 1007", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		writeClientFrame(t, conn, true, wsText, []byte{0xff, 0xfe})
+		expectClose(t, reader, CloseInvalidPayload)
+	})
+
+	t.Run("Unmasked frame is 1002", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+		expectClose(t, reader, CloseProtocolError)
+	})
+
+	t.Run("Fragmented control frame is 1002", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		writeClientFrame(t, conn, false, wsPing, []byte("x"))
+		expectClose(t, reader, CloseProtocolError)
+	})
+
+	t.Run("Continuation without message is 1002", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		writeClientFrame(t, conn, true, wsContinuation, []byte("x"))
+		expectClose(t, reader, CloseProtocolError)
+	})
+}
+
+func TestWebSocketFrameLength(t *testing.T) {
+	// A masked binary frame header with a 64-bit length, and its masking key.
+	frameHeader := func(length uint64) []byte {
+		header := binary.BigEndian.AppendUint64([]byte{0x82, 0x80 | 127}, length)
+		return append(header, 1, 2, 3, 4)
+	}
+
+	expectClose := func(t *testing.T, reader *bufio.Reader, code int) {
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsClose), opcode)
+		if assert.GreaterOrEqual(t, len(payload), 2) {
+			assert.Equal(t, code, int(binary.BigEndian.Uint16(payload)))
+		}
+	}
+
+	// Zero means messages have no maximum size.
+	addr := startEchoServer(t, 0)
+
+	t.Run("Most significant bit set is 1002", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		conn.Write(frameHeader(1 << 63))
+		expectClose(t, reader, CloseProtocolError)
+	})
+
+	t.Run("Huge frames are 1009 without a message limit", func(t *testing.T) {
+		for _, length := range []uint64{1<<63 - 1, 1 << 40, wsMaxFrameBytes + 1} {
+			conn, reader := dialWebSocket(t, addr, "/echo")
+			conn.Write(frameHeader(length))
+			expectClose(t, reader, CloseMessageTooBig)
+		}
+	})
+
+	t.Run("Messages larger than a frame can be fragmented", func(t *testing.T) {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		writeClientFrame(t, conn, false, wsBinary, make([]byte, 1000))
+		writeClientFrame(t, conn, true, wsContinuation, make([]byte, 1000))
+		opcode, payload := readServerFrame(t, reader)
+		assert.Equal(t, byte(wsBinary), opcode)
+		assert.Len(t, payload, 2000)
+	})
+}
+
+func TestWebSocketHandlerReturns(t *testing.T) {
+	bs := newTestInstance(t)
+	bs.SetWebSocket("/hello", func(ws WebSocketConn) {
+		ws.WriteMessage(TextMessage, []byte("hello "+ws.Path()))
+	})
+	addr := startTestServer(t, bs)
+
+	conn, reader := dialWebSocket(t, addr, "/hello")
+
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(wsText), opcode)
+	assert.Equal(t, "hello /hello", string(payload))
+
+	opcode, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(wsClose), opcode)
+	assert.Equal(t, closePayload(CloseNormal, ""), payload)
+
+	writeClientFrame(t, conn, true, wsClose, closePayload(CloseNormal, ""))
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
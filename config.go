@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/raw-phil/bs/buggy_http"
+)
+
+// effectiveConfig merges, from the lowest to the highest precedence, the defaults,
+// the -config file, the BS_* environment variables and the flags set on the command line.
+func effectiveConfig() (buggy_http.Config, error) {
+	cfg := buggy_http.DefaultConfig()
+
+	if *configFile != "" {
+		if err := buggy_http.ReadConfigFile(*configFile, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		err = applyFlag(&cfg, f.Name)
+	})
+	return cfg, err
+}
+
+// applyFlag overwrites the field of cfg set by the flag name.
+func applyFlag(cfg *buggy_http.Config, name string) error {
+	switch name {
+	case "h":
+		cfg.Host = *host
+	case "p":
+		cfg.Port = *port
+	case "d":
+		cfg.Dir = *directory
+	case "listen":
+		cfg.Listen = listen
+	case "socket-mode":
+		cfg.SocketMode = *socketMode
+	case "socket-owner":
+		cfg.SocketOwner = *socketOwner
+	case "read-timeout":
+		cfg.ReadTimeout = *readTimeout
+	case "write-timeout":
+		cfg.WriteTimeout = *writeTimeout
+	case "max-request-size":
+		cfg.MaxRequestSize = *maxRequestMiB
+	case "max-header-size":
+		cfg.MaxHeaderSize = *maxHeaderKiB
+	case "max-body-size":
+		cfg.MaxBodySize = *maxBodyMiB
+	case "error-page":
+		cfg.ErrorPages = errorPages
+	case "uploads":
+		cfg.Uploads = *uploads
+	case "create-dirs":
+		cfg.CreateDirs = *createDirs
+	case "upload-endpoint":
+		cfg.UploadEndpoint = *uploadPath
+	case "max-upload-file-size":
+		cfg.MaxUploadFileSize = *maxPartMiB
+	case "delete-prefix":
+		cfg.DeletePrefixes = deletePrefix
+	case "recursive-delete":
+		cfg.RecursiveDelete = *recursiveDel
+	case "webdav":
+		cfg.WebDAV = *webdav
+	case "cgi":
+		cfg.CGI = *cgiPrefix
+	case "fastcgi":
+		cfg.FastCGI = nil
+		for _, app := range fastcgi {
+			pattern, address, ok := strings.Cut(app, "=")
+			if !ok {
+				return fmt.Errorf("-fastcgi expects PATTERN=ADDRESS, got %q", app)
+			}
+			cfg.FastCGI = append(cfg.FastCGI, buggy_http.FastCGIConfig{Pattern: pattern, Address: address})
+		}
+	case "proxy":
+		cfg.Proxies = nil
+		for _, proxy := range proxies {
+			prefix, upstream, ok := strings.Cut(proxy, "=")
+			if !ok {
+				return fmt.Errorf("-proxy expects PREFIX=URL[,URL...], got %q", proxy)
+			}
+			cfg.Proxies = append(cfg.Proxies, buggy_http.ProxyConfig{Prefix: prefix, Upstreams: strings.Split(upstream, ",")})
+		}
+	case "proxy-timeout":
+		cfg.ProxyTimeout = *proxyTimeout
+	case "proxy-balance":
+		cfg.ProxyBalance = *proxyBalance
+	case "health-check-path":
+		cfg.HealthCheckPath = *healthPath
+	case "health-check-interval":
+		cfg.HealthCheckInterval = *healthEvery
+	case "max-fails":
+		cfg.MaxFails = *maxFails
+	case "fail-timeout":
+		cfg.FailTimeout = *failTimeout
+	case "watch":
+		cfg.Watch = *watch
+	case "spa":
+		cfg.SPA = *spaFallback
+	case "spa-exclude":
+		cfg.SPAExclude = spaExclude
+	case "rules":
+		cfg.RulesFile = *rulesFile
+	case "basic-auth":
+		cfg.BasicAuth = nil
+		for _, auth := range basicAuth {
+			prefix, file, ok := strings.Cut(auth, "=")
+			if !ok {
+				return fmt.Errorf("-basic-auth expects PREFIX=FILE, got %q", auth)
+			}
+			cfg.BasicAuth = append(cfg.BasicAuth, buggy_http.BasicAuthConfig{Prefix: prefix, File: file})
+		}
+	case "auth-realm":
+		cfg.AuthRealm = *authRealm
+	case "access":
+		cfg.Access = access
+	case "path-access":
+		cfg.PathAccess = nil
+		for _, pa := range pathAccess {
+			prefix, rules, ok := strings.Cut(pa, "=")
+			if !ok {
+				return fmt.Errorf("-path-access expects PREFIX=RULE[,RULE...], got %q", pa)
+			}
+			cfg.PathAccess = append(cfg.PathAccess, buggy_http.PathAccessConfig{Prefix: prefix, Rules: strings.Split(rules, ",")})
+		}
+	case "trusted-proxy":
+		cfg.TrustedProxies = trustedProxy
+	case "proxy-protocol":
+		cfg.ProxyProtocol = *proxyProtocol
+	}
+	return nil
+}
+
+// reloadConfig reads again the -config file and the environment, and applies them to bs.
+// It returns the configuration in use afterwards, that is current if the new one is not valid.
+func reloadConfig(bs buggy_http.BuggyServer, current buggy_http.Config) buggy_http.Config {
+	log.Printf("SIGHUP received, reloading the configuration")
+
+	cfg, err := effectiveConfig()
+	if err == nil {
+		err = bs.Reload(cfg)
+	}
+	if err != nil {
+		log.Printf("error: reload failed, the configuration is not changed: %s", err.Error())
+		return current
+	}
+
+	if !slices.Equal(cfg.Addresses(), current.Addresses()) {
+		log.Printf("error: the listening addresses are applied only on restart")
+		cfg.Host, cfg.Port, cfg.Listen = current.Host, current.Port, current.Listen
+	}
+	return cfg
+}
+
+// checkConfig implements 'bs check-config [flags]': it validates the effective
+// configuration without starting the server, and prints it as JSON.
+func checkConfig(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		os.Exit(2)
+	}
+
+	cfg, err := effectiveConfig()
+	if err == nil {
+		_, err = buggy_http.NewBuggyServerFromConfig(cfg)
+	}
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	out, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+	fmt.Fprintln(os.Stderr, "configuration is valid")
+}
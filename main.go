@@ -3,13 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/raw-phil/bs/buggy_http"
 )
 
+// upgradeDrainTimeout is how long the connections of the old process can stay open after an upgrade.
+const upgradeDrainTimeout = 30 * time.Second
+
 var (
 	port          = flag.Uint("p", 8080, "Sets the port")
 	host          = flag.String("h", "0.0.0.0", "Sets the host")
@@ -18,10 +26,97 @@ var (
 	readTimeout   = flag.Int("read-timeout", -1, "Maximum duration in seconds server has for reading the entire request from the underling connection.\nZero or negative value means there will be no timeout.")
 	writeTimeout  = flag.Int("write-timeout", -1, "Maximum duration in seconds the server has to respond.\nZero or negative value means there will be no timeout.")
 	maxRequestMiB = flag.Int("max-request-size", -1, "Maximum size of request the server will accept in MiB.\nZero or negative value means there will be no maximum size.")
+	maxHeaderKiB  = flag.Int("max-header-size", -1, "Maximum size of request line and headers the server will accept in KiB.\nZero or negative value means there will be no maximum size.")
+	maxBodyMiB    = flag.Int("max-body-size", -1, "Maximum size of request body the server will accept in MiB.\nZero or negative value means there will be no maximum size.")
+	uploads       = flag.Bool("uploads", false, "Allow PUT requests to write files in the served directory")
+	createDirs    = flag.Bool("create-dirs", false, "Create missing intermediate directories of uploaded files")
+	uploadPath    = flag.String("upload-endpoint", "", "URL path of an endpoint to upload files from a browser, requires -uploads.\nEmpty value means the endpoint is disabled.")
+	maxPartMiB    = flag.Int("max-upload-file-size", -1, "Maximum size in MiB of each file uploaded to the upload endpoint.\nZero or negative value means there will be no maximum size.")
+	recursiveDel  = flag.Bool("recursive-delete", false, "Allow DELETE requests to remove directories with all their content")
+	webdav        = flag.Bool("webdav", false, "Enable WebDAV to mount the served directory as a network drive.\nMKCOL, COPY and MOVE also require -uploads.")
+	cgiPrefix     = flag.String("cgi", "", "URL path prefix of a directory with CGI scripts, e.g. /cgi-bin.\nEmpty value means CGI is disabled.")
+	proxyTimeout  = flag.Int("proxy-timeout", -1, "Maximum duration in seconds to connect to an upstream server and receive its response.\nZero or negative value means there will be no timeout.")
+	proxyBalance  = flag.String("proxy-balance", "round-robin", "Strategy to choose the upstream of a proxied request: round-robin, least-conn or ip-hash")
+	healthPath    = flag.String("health-check-path", "", "URL path requested to every upstream to check its health.\nEmpty value means there will be no active health checks.")
+	healthEvery   = flag.Int("health-check-interval", 10, "Interval in seconds between health checks of the upstreams")
+	maxFails      = flag.Int("max-fails", 3, "Consecutive failed requests after which an upstream is ejected.\nZero or negative value means upstreams are never ejected.")
+	failTimeout   = flag.Int("fail-timeout", 30, "Duration in seconds an ejected upstream does not receive requests")
+	watch         = flag.Bool("watch", false, "Watch the served directory and reload the HTML pages open in browsers when a file changes")
+	rulesFile     = flag.String("rules", "", "File with rewrite and redirect rules, one per line.\nEmpty value means paths are not rewritten.")
+	configFile    = flag.String("config", "", "JSON configuration file, flags take precedence over its values.\nEmpty value means only flags and BS_* environment variables are used.")
+	spaFallback   = flag.String("spa", "", "URL path of the file served for the paths without extension that match no file, e.g. /index.html.\nEmpty value means missing files are answered with 404.")
+	socketMode    = flag.String("socket-mode", "", "Octal permissions of the Unix sockets, e.g. 0660.\nEmpty value means the umask is used.")
+	socketOwner   = flag.String("socket-owner", "", "Owner of the Unix sockets, in the form USER, :GROUP or USER:GROUP.\nEmpty value means the user running bs.")
+	authRealm     = flag.String("auth-realm", "BuggyServer", "Realm sent to the clients of the -basic-auth prefixes")
+	proxyProtocol = flag.Bool("proxy-protocol", false, "Read the PROXY protocol header, version 1 or 2, at the start of the connections of the -trusted-proxy networks")
+	errorPages    = errorPagesFlag{}
+	deletePrefix  = stringsFlag{}
+	proxies       = stringsFlag{}
+	fastcgi       = stringsFlag{}
+	spaExclude    = stringsFlag{}
+	listen        = stringsFlag{}
+	basicAuth     = stringsFlag{}
+	access        = stringsFlag{}
+	pathAccess    = stringsFlag{}
+	trustedProxy  = stringsFlag{}
 )
 
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// errorPagesFlag collects the repeatable -error-page flag in the form CODE=PATH.
+type errorPagesFlag map[int]string
+
+func (e errorPagesFlag) String() string {
+	pages := make([]string, 0, len(e))
+	for code, path := range e {
+		pages = append(pages, fmt.Sprintf("%d=%s", code, path))
+	}
+	return strings.Join(pages, ",")
+}
+
+func (e errorPagesFlag) Set(value string) error {
+	code, path, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected CODE=PATH, got %q", value)
+	}
+	c, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("invalid status code %q", code)
+	}
+	e[c] = path
+	return nil
+}
+
+func init() {
+	flag.Var(&listen, "listen", "Address to listen on, replaces -h and -p: HOST:PORT, unix:/path/to/socket,\nsystemd for the sockets passed by systemd, or systemd:NAME for the ones named NAME.\nCan be repeated to listen on several addresses.")
+	flag.Var(&deletePrefix, "delete-prefix", "URL path prefix under which DELETE requests can remove files, requires -uploads.\nCan be repeated for different prefixes.")
+	flag.Var(&fastcgi, "fastcgi", "Send the requests that match a pattern to a FastCGI application, in the form PATTERN=ADDRESS.\nPATTERN is a path prefix or an extension like *.php, ADDRESS is host:port or unix:/path/to/socket.\nCan be repeated for different patterns.")
+	flag.Var(&spaExclude, "spa-exclude", "URL path prefix that never falls back to the -spa file, e.g. /api.\nCan be repeated for different prefixes.")
+	flag.Var(&proxies, "proxy", "Forward the requests under a path prefix to upstream servers, in the form PREFIX=URL[,URL...].\nCan be repeated for different prefixes.")
+	flag.Var(&basicAuth, "basic-auth", "Require the credentials of a user of an htpasswd file for a path prefix, in the form PREFIX=FILE.\nThe file can have bcrypt, SHA-256, SHA-512 and SHA-1 hashes, like the ones of htpasswd -B.\nCan be repeated for different prefixes.")
+	flag.Var(&access, "access", "Allow or deny the clients of a network when their connections are accepted, in the form allow NETWORK or deny NETWORK.\nNETWORK is a CIDR, an address, unix or all. Can be repeated, the first rule that matches wins.")
+	flag.Var(&pathAccess, "path-access", "Answer with 403 the requests under a path prefix of the clients denied by rules, in the form PREFIX=RULE[,RULE...].\nCan be repeated for different prefixes.")
+	flag.Var(&trustedProxy, "trusted-proxy", "Network of a proxy whose X-Forwarded-For header gives the client checked by -path-access.\nCan be repeated for different networks.")
+	flag.Var(errorPages, "error-page", "Custom error page in the form CODE=PATH, PATH is relative to the served directory.\nCan be repeated for different status codes.")
+}
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		checkConfig(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if !*noBanner {
@@ -36,40 +131,56 @@ func main() {
 	             |___/ |___/ |___/` + "\n\n")
 	}
 
-	bs := buggy_http.NewBuggyServer()
-
-	if err := bs.SetBaseDir(*directory); err != nil {
+	cfg, err := effectiveConfig()
+	if err != nil {
 		fmt.Printf("error: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	if err := bs.SetReadTimeout(*readTimeout); err != nil {
+	bs, err := buggy_http.NewBuggyServerFromConfig(cfg)
+	if err != nil {
 		fmt.Printf("error: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	if err := bs.SetWriteTimeout(*writeTimeout); err != nil {
+	if err := bs.StartBuggyServerOn(cfg.Addresses()...); err != nil {
 		fmt.Printf("error: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	if err := bs.SetmaxRequestMiB(*maxRequestMiB); err != nil {
-		fmt.Printf("error: %s\n", err.Error())
-		os.Exit(1)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
+
+	sig := <-c
+	for ; sig == syscall.SIGHUP || slices.Contains(upgradeSignals, sig); sig = <-c {
+		if sig == syscall.SIGHUP {
+			cfg = reloadConfig(bs, cfg)
+		} else if upgrade(bs, sig) {
+			return
+		}
 	}
 
-	if err := bs.StartBuggyServer(*host, *port); err != nil {
+	fmt.Printf("Signal: %s received\n", sig)
+	if err := bs.StopBuggyServer(); err != nil {
 		fmt.Printf("error: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+}
 
-	fmt.Printf("Signal: %s received\n", <-c)
-	if err := bs.StopBuggyServer(); err != nil {
-		fmt.Printf("error: %s\n", err.Error())
-		os.Exit(1)
+// upgrade starts a new process of bs that takes over its listeners, then waits for the connections
+// still open to be closed. It returns false if the new process did not start, bs is then still serving.
+func upgrade(bs buggy_http.BuggyServer, sig os.Signal) bool {
+	log.Printf("%s received, starting a new process", sig)
+
+	if err := bs.Upgrade(); err != nil {
+		log.Printf("error: upgrade failed, still serving: %s", err.Error())
+		return false
 	}
 
+	log.Printf("the new process is serving, closing the open connections")
+	if err := bs.Shutdown(upgradeDrainTimeout); err != nil {
+		log.Printf("error: %s", err.Error())
+	}
+	return true
 }
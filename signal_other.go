@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty, the listeners can only be passed to a new process on Unix systems.
+var upgradeSignals []os.Signal